@@ -0,0 +1,220 @@
+// Package idempotency lets a service answer a request sent with an
+// Idempotency-Key header only once, replaying the stored response to
+// retries. Services share one table, with keys scoped per service.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxKeyLength = 255
+	// A running first request holds its key for lockLease and renews it
+	// every lockRefresh; one whose lease runs out is assumed to have died
+	lockLease       = 2 * time.Minute
+	lockRefresh     = 30 * time.Second
+	cleanupInterval = time.Hour
+)
+
+// Key remembers the response to a request sent with an Idempotency-Key
+// header so a retry gets the same response
+type Key struct {
+	ID          uint   `gorm:"primaryKey"`
+	Scope       string `gorm:"uniqueIndex:idx_idempotency_keys_scope_key"` // service, method and path
+	Key         string `gorm:"uniqueIndex:idx_idempotency_keys_scope_key"`
+	Fingerprint string // of the request body and caller
+	StatusCode  int    // 0 while the first request is running
+	ContentType string
+	Body        []byte
+	LockedUntil time.Time // while the first request is running
+	ExpiresAt   time.Time `gorm:"index"`
+	CreatedAt   time.Time
+}
+
+func (Key) TableName() string { return "idempotency_keys" }
+
+// Store keeps one service's keys
+type Store struct {
+	db      *gorm.DB
+	service string
+	ttl     time.Duration
+}
+
+// New keeps service's keys in db, replaying responses for IDEMPOTENCY_TTL
+// (24h by default)
+func New(db *gorm.DB, service string) (*Store, error) {
+	ttl := 24 * time.Hour
+	if value := os.Getenv("IDEMPOTENCY_TTL"); value != "" {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid IDEMPOTENCY_TTL %q", value)
+		}
+	}
+	return &Store{db: db, service: service, ttl: ttl}, nil
+}
+
+// Records a handler's response so it can be stored
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Who's asking: a key reused by a different caller, signed in or holding a
+// different cart, doesn't match and never sees the first caller's response
+func fingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	for _, part := range []string{r.URL.RawQuery, r.Header.Get("Authorization"), r.Header.Get("X-Cart-Token")} {
+		hash.Write([]byte(part + "\n"))
+	}
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Middleware honours the Idempotency-Key header: the first request runs and
+// its response is stored; repeats from the same caller with the same body
+// get that response back, other ones get 422, and ones arriving while the
+// first is still running get 409. Server errors aren't stored, so they can
+// be retried.
+func (s *Store) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := fingerprint(r, body)
+		scope := s.service + " " + r.Method + " " + r.URL.Path
+
+		record := Key{Scope: scope, Key: key, Fingerprint: fingerprint, LockedUntil: time.Now().Add(lockLease), ExpiresAt: time.Now().Add(s.ttl)}
+		for attempt := 0; ; attempt++ {
+			created := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+			if created.Error != nil {
+				log.Println("❌ Error storing idempotency key:", created.Error)
+				http.Error(w, "Error processing request", http.StatusInternalServerError)
+				return
+			}
+			if created.RowsAffected == 1 {
+				break
+			}
+
+			var existing Key
+			if err := s.db.Where("scope = ? AND key = ?", scope, key).First(&existing).Error; err != nil {
+				if attempt < 2 {
+					continue
+				}
+				http.Error(w, "Error processing request", http.StatusInternalServerError)
+				return
+			}
+			now := time.Now()
+			stale := existing.ExpiresAt.Before(now) ||
+				(existing.StatusCode == 0 && existing.LockedUntil.Before(now))
+			if stale && attempt < 2 {
+				// Only while still stale, so a lease renewed meanwhile holds
+				s.db.Where("id = ? AND (expires_at < ? OR (status_code = 0 AND locked_until < ?))", existing.ID, now, now).
+					Delete(&Key{})
+				continue
+			}
+
+			if existing.Fingerprint != fingerprint {
+				http.Error(w, "Idempotency-Key was used with a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			if existing.StatusCode == 0 {
+				http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+				return
+			}
+			if existing.ContentType != "" {
+				w.Header().Set("Content-Type", existing.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(existing.StatusCode)
+			w.Write(existing.Body)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		done := make(chan struct{})
+		go s.renewLease(record.ID, done)
+		func() {
+			defer close(done)
+			next(recorder, r)
+		}()
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		if recorder.status >= 500 {
+			s.db.Where("id = ?", record.ID).Delete(&Key{})
+			return
+		}
+		s.db.Model(&record).Updates(map[string]interface{}{
+			"status_code":  recorder.status,
+			"content_type": w.Header().Get("Content-Type"),
+			"body":         recorder.body.Bytes(),
+		})
+	}
+}
+
+// Keep a running request's key locked until done is closed
+func (s *Store) renewLease(id uint, done chan struct{}) {
+	ticker := time.NewTicker(lockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.db.Model(&Key{}).Where("id = ? AND status_code = 0", id).Update("locked_until", time.Now().Add(lockLease))
+		}
+	}
+}
+
+// RunCleanup drops the service's expired keys now and then
+func (s *Store) RunCleanup() {
+	for {
+		result := s.db.Where("scope LIKE ? AND expires_at < ?", s.service+" %", time.Now()).Delete(&Key{})
+		if result.Error != nil {
+			log.Println("❌ Error cleaning up idempotency keys:", result.Error)
+		} else if result.RowsAffected > 0 {
+			log.Printf("🧹 Removed %d expired idempotency keys", result.RowsAffected)
+		}
+		time.Sleep(cleanupInterval)
+	}
+}
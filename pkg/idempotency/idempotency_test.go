@@ -0,0 +1,142 @@
+package idempotency
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func testStore(t *testing.T) *Store {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to ":memory:" is a database of its own
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&Key{}); err != nil {
+		t.Fatal(err)
+	}
+	store, err := New(db, "test-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// A handler that answers each call with a new number
+func counter(status int) (http.HandlerFunc, *int) {
+	calls := 0
+	return func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "call %d", calls)
+	}, &calls
+}
+
+func send(handler http.HandlerFunc, key, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestRepeatIsReplayed(t *testing.T) {
+	next, calls := counter(http.StatusCreated)
+	handler := testStore(t).Middleware(next)
+
+	first := send(handler, "key-1", `{"a":1}`)
+	repeat := send(handler, "key-1", `{"a":1}`)
+	if *calls != 1 {
+		t.Fatalf("handler ran %d times", *calls)
+	}
+	if repeat.Code != http.StatusCreated || repeat.Body.String() != first.Body.String() || repeat.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("repeat got %d %q, want the first response replayed", repeat.Code, repeat.Body.String())
+	}
+
+	if w := send(handler, "key-2", `{"a":1}`); w.Body.String() != "call 2" {
+		t.Fatalf("another key got %q", w.Body.String())
+	}
+}
+
+func TestKeyReusedByAnotherRequest(t *testing.T) {
+	next, calls := counter(http.StatusCreated)
+	handler := testStore(t).Middleware(next)
+	send(handler, "key-1", `{"a":1}`, "X-Cart-Token", "cart-a", "Authorization", "Bearer a")
+
+	for name, headers := range map[string][]string{
+		"other body":     {"X-Cart-Token", "cart-a", "Authorization", "Bearer a"},
+		"other cart":     {"X-Cart-Token", "cart-b", "Authorization", "Bearer a"},
+		"other user":     {"X-Cart-Token", "cart-a", "Authorization", "Bearer b"},
+		"no credentials": nil,
+	} {
+		body := `{"a":1}`
+		if name == "other body" {
+			body = `{"a":2}`
+		}
+		if w := send(handler, "key-1", body, headers...); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: got %d %q, want 422", name, w.Code, w.Body.String())
+		}
+	}
+	if *calls != 1 {
+		t.Fatalf("handler ran %d times", *calls)
+	}
+}
+
+func TestServerErrorsAreNotStored(t *testing.T) {
+	next, calls := counter(http.StatusBadGateway)
+	handler := testStore(t).Middleware(next)
+
+	send(handler, "key-1", `{}`)
+	if w := send(handler, "key-1", `{}`); w.Body.String() != "call 2" {
+		t.Fatalf("retry got %q, want the handler to run again", w.Body.String())
+	}
+	if *calls != 2 {
+		t.Fatalf("handler ran %d times", *calls)
+	}
+}
+
+func TestRunningRequestKeepsItsKey(t *testing.T) {
+	store := testStore(t)
+	var handler http.HandlerFunc
+	var during, takeover *httptest.ResponseRecorder
+	calls := 0
+	handler = store.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			// However long it has been running, a request holding its lease
+			// keeps the key
+			store.db.Model(&Key{}).Where("key = ?", "key-1").Update("created_at", time.Now().Add(-time.Hour))
+			during = send(handler, "key-1", `{}`)
+
+			// One whose lease ran out has died, and a retry takes over
+			store.db.Model(&Key{}).Where("key = ?", "key-1").Update("locked_until", time.Now().Add(-time.Second))
+			takeover = send(handler, "key-1", `{}`)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "call %d", calls)
+	})
+
+	send(handler, "key-1", `{}`)
+	if during.Code != http.StatusConflict {
+		t.Fatalf("retry while running got %d %q, want 409", during.Code, during.Body.String())
+	}
+	if takeover.Code != http.StatusCreated || calls != 2 {
+		t.Fatalf("retry after the lease ran out got %d %q after %d calls, want it to run", takeover.Code, takeover.Body.String(), calls)
+	}
+}
@@ -0,0 +1,3 @@
+module ecommerce/pkg/money
+
+go 1.24.1
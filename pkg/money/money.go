@@ -0,0 +1,35 @@
+// Package money rounds amounts to what each currency can express. Product
+// Service prices with it and Order Service totals and charges with it, so
+// both always agree on a currency's minor unit.
+package money
+
+import "math"
+
+// ISO 4217 minor units for currencies that don't use two decimals
+var currencyMinorUnits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// MinorUnits is the number of decimals currency is written with
+func MinorUnits(currency string) int {
+	if digits, ok := currencyMinorUnits[currency]; ok {
+		return digits
+	}
+	return 2
+}
+
+// Round half away from zero to the currency's minor unit
+func Round(amount float64, currency string) float64 {
+	scale := math.Pow10(MinorUnits(currency))
+	// Trim binary noise first so 1.005 rounds to 1.01, not 1.00
+	scaled := math.Round(amount*scale*1e6) / 1e6
+	return math.Round(scaled) / scale
+}
+
+// ToMinorUnits gives amount in the currency's minor unit (cents), as
+// payment providers want it
+func ToMinorUnits(amount float64, currency string) int64 {
+	return int64(math.Round(Round(amount, currency) * math.Pow10(MinorUnits(currency))))
+}
@@ -0,0 +1,41 @@
+package money
+
+import "testing"
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     float64
+	}{
+		{1.005, "USD", 1.01},
+		{2.675, "EUR", 2.68},
+		{-1.005, "USD", -1.01},
+		{1234.5, "JPY", 1235},
+		{1.0005, "KWD", 1.001},
+		{19.999, "XXX", 20},
+	}
+	for _, test := range tests {
+		if got := Round(test.amount, test.currency); got != test.want {
+			t.Errorf("Round(%v, %s) = %v, want %v", test.amount, test.currency, got, test.want)
+		}
+	}
+}
+
+func TestToMinorUnits(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     int64
+	}{
+		{19.99, "USD", 1999},
+		{0.1 + 0.2, "USD", 30},
+		{1500, "JPY", 1500},
+		{1.234, "BHD", 1234},
+	}
+	for _, test := range tests {
+		if got := ToMinorUnits(test.amount, test.currency); got != test.want {
+			t.Errorf("ToMinorUnits(%v, %s) = %d, want %d", test.amount, test.currency, got, test.want)
+		}
+	}
+}
@@ -25,12 +25,15 @@ type User struct {
 	Email    string `gorm:"unique" json:"email"`
 	Password string `json:"password,omitempty"`
 	Role     string `json:"role"` // "customer" or "admin"
+	// Picks the price list the user buys at; set by an admin
+	CustomerGroup string `json:"customer_group,omitempty"`
 }
 
 // Claims structure for JWT
 type Claims struct {
-	Email string `json:"email"`
-	Role  string `json:"role"`
+	Email         string `json:"email"`
+	Role          string `json:"role"`
+	CustomerGroup string `json:"customer_group,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -61,7 +64,7 @@ func connectDB() {
 func corsMiddleware() func(http.Handler) http.Handler {
 	return cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://127.0.0.1:3000", "http://localhost:3000"}, // ✅ Allow frontend
-		AllowedMethods:   []string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Authorization", "Content-Type"},
 		AllowCredentials: true, // ✅ Allows cookies & authorization headers
 	}).Handler
@@ -78,6 +81,7 @@ func register(w http.ResponseWriter, r *http.Request) {
 	hash, _ := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	user.Password = string(hash)
 	user.Role = "customer"
+	user.CustomerGroup = ""
 	db.Create(&user)
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprintln(w, "✅ User registered successfully")
@@ -104,8 +108,9 @@ func login(w http.ResponseWriter, r *http.Request) {
 
 	expirationTime := time.Now().Add(24 * time.Hour)
 	claims := &Claims{
-		Email: user.Email,
-		Role:  user.Role,
+		Email:         user.Email,
+		Role:          user.Role,
+		CustomerGroup: user.CustomerGroup,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
@@ -175,7 +180,42 @@ func me(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("👤 User Authenticated: %s (%s)", claims.Email, claims.Role)
-	json.NewEncoder(w).Encode(map[string]string{"email": claims.Email, "role": claims.Role})
+	json.NewEncoder(w).Encode(map[string]string{"email": claims.Email, "role": claims.Role, "customer_group": claims.CustomerGroup})
+}
+
+// Admin: put a user in a customer group (empty for none). It reaches the
+// user's token at their next login.
+func setCustomerGroup(w http.ResponseWriter, r *http.Request) {
+	tokenStr := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	})
+	if err != nil || !token.Valid {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if claims, ok := token.Claims.(*Claims); !ok || claims.Role != "admin" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var input struct {
+		CustomerGroup string `json:"customer_group"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "❌ Invalid data", http.StatusBadRequest)
+		return
+	}
+	result := db.Model(&User{}).Where("email = ?", chi.URLParam(r, "email")).Update("customer_group", strings.TrimSpace(input.CustomerGroup))
+	if result.Error != nil {
+		http.Error(w, "❌ Error updating user", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "❌ User not found", http.StatusNotFound)
+		return
+	}
+	fmt.Fprintln(w, "✅ Customer group updated")
 }
 
 func main() {
@@ -188,6 +228,7 @@ func main() {
 	r.Get("/auth/me", func(w http.ResponseWriter, r *http.Request) {
 		authMiddleware(http.HandlerFunc(me)).ServeHTTP(w, r)
 	})
+	r.Put("/auth/users/{email}/customer-group", setCustomerGroup)
 
 	log.Println("🔐 Auth Service running on :8084")
 	http.ListenAndServe(":8084", r)
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Kinds of stock alert
+const (
+	alertLowStock   = "low_stock"
+	alertOutOfStock = "out_of_stock"
+)
+
+const (
+	alertCheckInterval = 10 * time.Second
+	alertSweepInterval = 5 * time.Minute
+	alertMaxBackoff    = 30 * time.Minute
+	alertMaxAttempts   = 20
+	alertBatchSize     = 20
+	alertLease         = 5 * time.Minute  // to notify a claimed batch before another checker may take it
+	alertNotifyTimeout = 30 * time.Second // for all of one alert's notifiers
+)
+
+// ReorderRule says when a product needs restocking and by how much
+type ReorderRule struct {
+	ProductID       uint      `gorm:"primaryKey" json:"product_id"`
+	ReorderPoint    int       `json:"reorder_point"`    // alert when stock falls to this or below
+	ReorderQuantity int       `json:"reorder_quantity"` // suggested quantity to order
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// StockAlert is raised when a product's stock crosses its reorder point or
+// runs out. It stays open until stock recovers or an admin acknowledges it.
+type StockAlert struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	ProductID       uint       `gorm:"index" json:"product_id"`
+	Kind            string     `gorm:"index" json:"kind"`
+	Stock           int        `json:"stock"`
+	ReorderPoint    int        `json:"reorder_point"`
+	ReorderQuantity int        `json:"reorder_quantity"`
+	CreatedAt       time.Time  `json:"created_at"`
+	NotifiedAt      *time.Time `gorm:"index" json:"notified_at,omitempty"`
+	NotifiedBy      string     `json:"-"` // comma-separated notifiers that have it, so retries skip them
+	NextAttemptAt   time.Time  `json:"-"`
+	Attempts        int        `json:"-"`
+	LastError       string     `json:"last_error,omitempty"`
+	FailedAt        *time.Time `json:"failed_at,omitempty"` // gave up after alertMaxAttempts
+	AcknowledgedAt  *time.Time `json:"acknowledged_at,omitempty"`
+	ResolvedAt      *time.Time `gorm:"index" json:"resolved_at,omitempty"`
+}
+
+func (a StockAlert) subject() string {
+	if a.Kind == alertOutOfStock {
+		return fmt.Sprintf("Product %d is out of stock", a.ProductID)
+	}
+	return fmt.Sprintf("Product %d is low on stock", a.ProductID)
+}
+
+func (a StockAlert) summary() string {
+	return fmt.Sprintf("%s: %d left (reorder point %d, suggested reorder %d)",
+		a.subject(), a.Stock, a.ReorderPoint, a.ReorderQuantity)
+}
+
+// Delivers alerts; set up in main
+var notifier multiNotifier
+
+// Called by applyMovement when a product's total stock goes from before to
+// after. Raises an alert for each threshold crossed downwards and resolves
+// open alerts once stock is back above them.
+func checkStockThresholds(tx *gorm.DB, productID uint, before, after int) error {
+	var rule ReorderRule
+	if err := tx.Where("product_id = ?", productID).Limit(1).Find(&rule).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if after > 0 {
+		if err := tx.Model(&StockAlert{}).
+			Where("product_id = ? AND kind = ? AND resolved_at IS NULL", productID, alertOutOfStock).
+			Update("resolved_at", now).Error; err != nil {
+			return err
+		}
+	}
+	if rule.ProductID != 0 && after > rule.ReorderPoint {
+		if err := tx.Model(&StockAlert{}).
+			Where("product_id = ? AND kind = ? AND resolved_at IS NULL", productID, alertLowStock).
+			Update("resolved_at", now).Error; err != nil {
+			return err
+		}
+	}
+
+	var kinds []string
+	if rule.ProductID != 0 && before > rule.ReorderPoint && after <= rule.ReorderPoint {
+		kinds = append(kinds, alertLowStock)
+	}
+	if before > 0 && after <= 0 {
+		kinds = append(kinds, alertOutOfStock)
+	}
+	for _, kind := range kinds {
+		if err := raiseAlert(tx, rule, productID, kind, after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open an alert unless one of the same kind is already open
+func raiseAlert(tx *gorm.DB, rule ReorderRule, productID uint, kind string, stock int) error {
+	var open int64
+	if err := tx.Model(&StockAlert{}).
+		Where("product_id = ? AND kind = ? AND resolved_at IS NULL", productID, kind).
+		Count(&open).Error; err != nil {
+		return err
+	}
+	if open > 0 {
+		return nil
+	}
+
+	log.Printf("⚠️ Raising %s alert for Product %d (stock %d)", kind, productID, stock)
+	return tx.Create(&StockAlert{
+		ProductID:       productID,
+		Kind:            kind,
+		Stock:           stock,
+		ReorderPoint:    rule.ReorderPoint,
+		ReorderQuantity: rule.ReorderQuantity,
+		NextAttemptAt:   time.Now(),
+	}).Error
+}
+
+// Raise alerts for products already at or below their reorder point, e.g.
+// after a rule was added or raised
+func sweepStockAlerts() error {
+	var rows []struct {
+		ProductID       uint
+		Stock           int
+		ReorderPoint    int
+		ReorderQuantity int
+	}
+	if err := db.Model(&ReorderRule{}).
+		Select("reorder_rules.product_id, inventories.stock, reorder_rules.reorder_point, reorder_rules.reorder_quantity").
+		Joins("JOIN inventories ON inventories.product_id = reorder_rules.product_id").
+		Where("inventories.stock <= reorder_rules.reorder_point").
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			rule := ReorderRule{ProductID: row.ProductID, ReorderPoint: row.ReorderPoint, ReorderQuantity: row.ReorderQuantity}
+			if err := raiseAlert(tx, rule, row.ProductID, alertLowStock, row.Stock); err != nil {
+				return err
+			}
+			if row.Stock <= 0 {
+				if err := raiseAlert(tx, rule, row.ProductID, alertOutOfStock, row.Stock); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Claim due alerts by pushing their next attempt out by alertLease, so
+// nothing stays locked while notifiers are called. A checker that dies
+// mid-batch leaves its alerts to be retried once the lease runs out.
+func claimPendingAlerts() ([]StockAlert, error) {
+	var alerts []StockAlert
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("notified_at IS NULL AND failed_at IS NULL AND next_attempt_at <= ?", now).
+			Order("id").
+			Limit(alertBatchSize).
+			Find(&alerts).Error; err != nil {
+			return err
+		}
+		if len(alerts) == 0 {
+			return nil
+		}
+		ids := make([]uint, len(alerts))
+		for i, alert := range alerts {
+			ids[i] = alert.ID
+		}
+		return tx.Model(&StockAlert{}).Where("id IN ?", ids).Update("next_attempt_at", now.Add(alertLease)).Error
+	})
+	return alerts, err
+}
+
+// Notify one claimed alert and record how it went, backing off on failure
+// and giving up after alertMaxAttempts
+func notifyAlert(alert StockAlert) error {
+	attempts := alert.Attempts + 1
+	ctx, cancel := context.WithTimeout(context.Background(), alertNotifyTimeout)
+	defer cancel()
+	notifiedBy, err := notifier.Notify(ctx, alert)
+
+	updates := map[string]interface{}{"attempts": attempts, "notified_by": notifiedBy}
+	switch {
+	case err == nil:
+		updates["notified_at"] = time.Now()
+		updates["last_error"] = ""
+	case attempts >= alertMaxAttempts:
+		updates["failed_at"] = time.Now()
+		updates["last_error"] = err.Error()
+		log.Printf("❌ Giving up on alert %d after %d attempts: %v", alert.ID, attempts, err)
+	default:
+		backoff := time.Duration(1<<uint(min(alert.Attempts, 10))) * 10 * time.Second
+		if backoff > alertMaxBackoff {
+			backoff = alertMaxBackoff
+		}
+		updates["next_attempt_at"] = time.Now().Add(backoff)
+		updates["last_error"] = err.Error()
+		log.Printf("⏳ Alert %d notification failed on attempt %d: %v", alert.ID, attempts, err)
+	}
+	return db.Model(&StockAlert{}).Where("id = ?", alert.ID).Updates(updates).Error
+}
+
+// Send alerts that haven't been notified yet
+func notifyPendingAlerts() error {
+	alerts, err := claimPendingAlerts()
+	if err != nil {
+		return err
+	}
+	for _, alert := range alerts {
+		if err := notifyAlert(alert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Background checker: deliver alerts as they are raised and periodically
+// sweep for products that are already below their reorder point
+func runAlertChecker() {
+	ticker := time.NewTicker(alertCheckInterval)
+	defer ticker.Stop()
+	lastSweep := time.Time{}
+
+	for range ticker.C {
+		if time.Since(lastSweep) >= alertSweepInterval {
+			if err := sweepStockAlerts(); err != nil {
+				log.Println("❌ Stock alert sweep failed:", err)
+			}
+			lastSweep = time.Now()
+		}
+		if err := notifyPendingAlerts(); err != nil {
+			log.Println("❌ Error sending stock alerts:", err)
+		}
+	}
+}
+
+func listReorderRules(w http.ResponseWriter, r *http.Request) {
+	rules := []ReorderRule{}
+	db.Order("product_id").Find(&rules)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// Admin: set a product's reorder point and quantity
+func setReorderRule(w http.ResponseWriter, r *http.Request) {
+	var inventory Inventory
+	if err := db.First(&inventory, "product_id = ?", chi.URLParam(r, "productID")).Error; err != nil {
+		http.Error(w, "Product not found in inventory", http.StatusNotFound)
+		return
+	}
+
+	var rule ReorderRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid reorder rule", http.StatusBadRequest)
+		return
+	}
+	if rule.ReorderPoint < 0 || rule.ReorderQuantity < 0 {
+		http.Error(w, "Reorder point and quantity must not be negative", http.StatusBadRequest)
+		return
+	}
+	rule.ProductID = inventory.ProductID
+
+	if err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&rule).Error; err != nil {
+		log.Println("❌ Error saving reorder rule:", err)
+		http.Error(w, "Error saving reorder rule", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📐 Reorder rule for Product %d: point %d, quantity %d", rule.ProductID, rule.ReorderPoint, rule.ReorderQuantity)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func deleteReorderRule(w http.ResponseWriter, r *http.Request) {
+	db.Delete(&ReorderRule{}, "product_id = ?", chi.URLParam(r, "productID"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Alerts for the admin dashboard. Open (unresolved, unacknowledged) alerts
+// by default; ?status=all for history.
+func listAlerts(w http.ResponseWriter, r *http.Request) {
+	tx := db.Order("id DESC")
+	switch r.URL.Query().Get("status") {
+	case "", "open":
+		tx = tx.Where("resolved_at IS NULL AND acknowledged_at IS NULL")
+	case "all":
+		tx = tx.Limit(500)
+	default:
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	if productID := r.URL.Query().Get("product_id"); productID != "" {
+		tx = tx.Where("product_id = ?", productID)
+	}
+
+	alerts := []StockAlert{}
+	if err := tx.Find(&alerts).Error; err != nil {
+		log.Println("❌ Error loading alerts:", err)
+		http.Error(w, "Error loading alerts", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+// Admin: hide an alert from the open list without waiting for restock
+func acknowledgeAlert(w http.ResponseWriter, r *http.Request) {
+	var alert StockAlert
+	if err := db.First(&alert, chi.URLParam(r, "id")).Error; err != nil {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	if alert.AcknowledgedAt == nil {
+		now := time.Now()
+		alert.AcknowledgedAt = &now
+		db.Model(&alert).Update("acknowledged_at", now)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alert)
+}
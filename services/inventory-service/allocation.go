@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"gorm.io/gorm"
+)
+
+// Allocation strategies: which locations an order's stock is taken from
+const (
+	// Fill each item from locations in priority order, splitting if needed
+	allocationPriority = "priority"
+	// Prefer the highest-priority location that can ship the whole order,
+	// falling back to priority when none can
+	allocationSingleLocation = "single_location"
+	// Take each item from the locations holding the most of it
+	allocationMostStock = "most_stock"
+)
+
+// Default strategy, checked in main
+var allocationStrategy = getEnv("ALLOCATION_STRATEGY", allocationPriority)
+
+func validStrategy(strategy string) bool {
+	switch strategy {
+	case allocationPriority, allocationSingleLocation, allocationMostStock:
+		return true
+	}
+	return false
+}
+
+// allocation takes Quantity units of a product from a location
+type allocation struct {
+	ProductID  uint `json:"product_id"`
+	LocationID uint `json:"location_id"`
+	Quantity   int  `json:"quantity"`
+}
+
+type candidateStock struct {
+	ProductID  uint
+	LocationID uint
+	Quantity   int
+	Priority   int
+}
+
+// Choose locations for demand (product ID → quantity). Fails with
+// errInsufficientStock if active locations don't hold enough in total.
+func allocate(tx *gorm.DB, demand map[uint]int, strategy string) ([]allocation, error) {
+	if len(demand) == 0 {
+		return nil, nil
+	}
+	productIDs := make([]uint, 0, len(demand))
+	for productID := range demand {
+		productIDs = append(productIDs, productID)
+	}
+	sort.Slice(productIDs, func(i, j int) bool { return productIDs[i] < productIDs[j] })
+
+	var candidates []candidateStock
+	if err := tx.Model(&LocationStock{}).
+		Select("location_stocks.product_id, location_stocks.location_id, location_stocks.quantity, locations.priority").
+		Joins("JOIN locations ON locations.id = location_stocks.location_id AND locations.active").
+		Where("location_stocks.product_id IN ? AND location_stocks.quantity > 0", productIDs).
+		Order("locations.priority, locations.id").
+		Scan(&candidates).Error; err != nil {
+		return nil, err
+	}
+
+	byProduct := map[uint][]candidateStock{}
+	for _, c := range candidates {
+		byProduct[c.ProductID] = append(byProduct[c.ProductID], c)
+	}
+
+	if strategy == allocationSingleLocation {
+		if locationID, ok := singleLocation(candidates, demand); ok {
+			allocations := make([]allocation, 0, len(productIDs))
+			for _, productID := range productIDs {
+				allocations = append(allocations, allocation{ProductID: productID, LocationID: locationID, Quantity: demand[productID]})
+			}
+			return allocations, nil
+		}
+	}
+
+	var allocations []allocation
+	for _, productID := range productIDs {
+		options := byProduct[productID]
+		if strategy == allocationMostStock {
+			sort.SliceStable(options, func(i, j int) bool { return options[i].Quantity > options[j].Quantity })
+		}
+
+		remaining := demand[productID]
+		for _, option := range options {
+			if remaining == 0 {
+				break
+			}
+			take := option.Quantity
+			if take > remaining {
+				take = remaining
+			}
+			allocations = append(allocations, allocation{ProductID: productID, LocationID: option.LocationID, Quantity: take})
+			remaining -= take
+		}
+		if remaining > 0 {
+			return nil, fmt.Errorf("%w for product %d", errInsufficientStock, productID)
+		}
+	}
+	return allocations, nil
+}
+
+// The first location (candidates are in priority order) holding enough of
+// every product in demand
+func singleLocation(candidates []candidateStock, demand map[uint]int) (uint, bool) {
+	covered := map[uint]int{}
+	var order []uint
+	for _, c := range candidates {
+		if _, seen := covered[c.LocationID]; !seen {
+			order = append(order, c.LocationID)
+			covered[c.LocationID] = 0
+		}
+		if c.Quantity >= demand[c.ProductID] {
+			covered[c.LocationID]++
+		}
+	}
+	for _, locationID := range order {
+		if covered[locationID] == len(demand) {
+			return locationID, true
+		}
+	}
+	return 0, false
+}
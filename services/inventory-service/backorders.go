@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Backorder policies
+const (
+	backorderNone = "none"
+	// Sell past zero; waiting orders are filled as stock arrives
+	backorderAllow = "backorder"
+	// Sell before release: every unit is backordered until AvailableFrom,
+	// then the queue is filled from stock on hand
+	backorderPreorder = "preorder"
+)
+
+// Backorder statuses
+const (
+	backorderWaiting   = "waiting"
+	backorderAllocated = "allocated"
+	backorderCancelled = "cancelled"
+)
+
+const (
+	movementBackorder = "backorder_allocated"
+
+	backorderCheckInterval = 30 * time.Second
+)
+
+// Order Service is told when a backordered order has all its stock
+var orderServiceURL = getEnv("ORDER_SERVICE_URL", "http://order-service:8081")
+
+// BackorderPolicy lets a product be ordered when there isn't enough stock.
+// Cap limits the units waiting on backorder at any time.
+type BackorderPolicy struct {
+	ProductID     uint       `gorm:"primaryKey" json:"product_id"`
+	Mode          string     `gorm:"size:16" json:"mode"`
+	Cap           int        `json:"cap"`
+	AvailableFrom *time.Time `json:"available_from,omitempty"` // pre-orders: release date
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// Stock for a pre-order is held back until the release date
+func (p BackorderPolicy) released() bool {
+	return p.Mode != backorderPreorder || (p.AvailableFrom != nil && !p.AvailableFrom.After(time.Now()))
+}
+
+// Backorder is the part of an order line that couldn't be allocated when
+// the order was placed. They are filled oldest first.
+type Backorder struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	ProductID   uint       `gorm:"index" json:"product_id"`
+	Reference   string     `gorm:"index" json:"reference"` // e.g. "order:12"
+	Quantity    int        `json:"quantity"`
+	Allocated   int        `json:"allocated"`
+	Status      string     `gorm:"index" json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	AllocatedAt *time.Time `json:"allocated_at,omitempty"`
+	NotifiedAt  *time.Time `json:"notified_at,omitempty"`
+}
+
+func validBackorderMode(mode string) bool {
+	switch mode {
+	case backorderNone, backorderAllow, backorderPreorder:
+		return true
+	}
+	return false
+}
+
+// Stock a product has at active locations
+func availableStock(tx *gorm.DB, productID uint) (int, error) {
+	var available int
+	err := tx.Model(&LocationStock{}).
+		Select("COALESCE(SUM(location_stocks.quantity), 0)").
+		Joins("JOIN locations ON locations.id = location_stocks.location_id AND locations.active").
+		Where("location_stocks.product_id = ?", productID).
+		Scan(&available).Error
+	return available, err
+}
+
+// Put the part of demand that stock can't cover on backorder for products
+// whose policy allows it. Demand is reduced to what can be allocated now;
+// returns the backordered quantities.
+func reserveBackorders(tx *gorm.DB, demand map[uint]int, reference string) (map[uint]int, error) {
+	productIDs := make([]uint, 0, len(demand))
+	for productID := range demand {
+		productIDs = append(productIDs, productID)
+	}
+	sort.Slice(productIDs, func(i, j int) bool { return productIDs[i] < productIDs[j] })
+
+	backordered := map[uint]int{}
+	for _, productID := range productIDs {
+		var policy BackorderPolicy
+		if err := tx.Where("product_id = ?", productID).Limit(1).Find(&policy).Error; err != nil {
+			return nil, err
+		}
+		if policy.ProductID == 0 || policy.Mode == backorderNone {
+			continue
+		}
+
+		// Serialise with other orders and with fillBackorders
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&Inventory{}, "product_id = ?", productID).Error; err != nil {
+			return nil, errProductNotFound
+		}
+
+		var outstanding int
+		if err := tx.Model(&Backorder{}).
+			Select("COALESCE(SUM(quantity - allocated), 0)").
+			Where("product_id = ? AND status = ?", productID, backorderWaiting).
+			Scan(&outstanding).Error; err != nil {
+			return nil, err
+		}
+
+		// Orders already waiting come first
+		available := 0
+		if policy.released() && outstanding == 0 {
+			var err error
+			if available, err = availableStock(tx, productID); err != nil {
+				return nil, err
+			}
+		}
+		shortfall := demand[productID] - max(available, 0)
+		if shortfall <= 0 {
+			continue
+		}
+		if outstanding+shortfall > policy.Cap {
+			return nil, fmt.Errorf("%w: backorder cap reached for product %d", errInsufficientStock, productID)
+		}
+
+		if err := tx.Create(&Backorder{
+			ProductID: productID,
+			Reference: reference,
+			Quantity:  shortfall,
+			Status:    backorderWaiting,
+		}).Error; err != nil {
+			return nil, err
+		}
+		backordered[productID] = shortfall
+		if demand[productID] -= shortfall; demand[productID] == 0 {
+			delete(demand, productID)
+		}
+	}
+	return backordered, nil
+}
+
+// Cancel what reference still waits for; returns the units that were
+// never allocated, so they aren't put back into stock
+func cancelBackorders(tx *gorm.DB, productID uint, reference string) (int, error) {
+	if reference == "" {
+		return 0, nil
+	}
+	var waiting []Backorder
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("product_id = ? AND reference = ? AND status = ?", productID, reference, backorderWaiting).
+		Find(&waiting).Error; err != nil {
+		return 0, err
+	}
+	unallocated := 0
+	for _, backorder := range waiting {
+		unallocated += backorder.Quantity - backorder.Allocated
+		if err := tx.Model(&backorder).Update("status", backorderCancelled).Error; err != nil {
+			return 0, err
+		}
+	}
+	return unallocated, nil
+}
+
+// Give stock at active locations to waiting backorders, oldest first.
+// applyMovement calls this whenever a product's stock goes up.
+func fillBackorders(tx *gorm.DB, productID uint) error {
+	var policy BackorderPolicy
+	if err := tx.Where("product_id = ?", productID).Limit(1).Find(&policy).Error; err != nil {
+		return err
+	}
+	if !policy.released() {
+		return nil
+	}
+
+	var waiting []Backorder
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("product_id = ? AND status = ?", productID, backorderWaiting).
+		Order("id").
+		Find(&waiting).Error; err != nil {
+		return err
+	}
+	if len(waiting) == 0 {
+		return nil
+	}
+
+	available, err := availableStock(tx, productID)
+	if err != nil {
+		return err
+	}
+	for _, backorder := range waiting {
+		if available <= 0 {
+			break
+		}
+		take := min(backorder.Quantity-backorder.Allocated, available)
+		allocations, err := allocate(tx, map[uint]int{productID: take}, allocationStrategy)
+		if err != nil {
+			return err
+		}
+		for _, a := range allocations {
+			if err := applyMovement(tx, StockMovement{
+				ProductID:  productID,
+				LocationID: a.LocationID,
+				Quantity:   -a.Quantity,
+				Reason:     movementBackorder,
+				Reference:  backorder.Reference,
+			}); err != nil {
+				return err
+			}
+		}
+		available -= take
+
+		updates := map[string]interface{}{"allocated": backorder.Allocated + take}
+		if backorder.Allocated+take == backorder.Quantity {
+			updates["status"] = backorderAllocated
+			updates["allocated_at"] = time.Now()
+		}
+		if err := tx.Model(&backorder).Updates(updates).Error; err != nil {
+			return err
+		}
+		log.Printf("📦 Allocated %d of Product %d to backorder %d (%s)", take, productID, backorder.ID, backorder.Reference)
+	}
+	return nil
+}
+
+// Tell Order Service about orders whose backorders are all allocated
+func notifyAllocatedBackorders() error {
+	var references []string
+	if err := db.Model(&Backorder{}).
+		Select("reference").
+		Group("reference").
+		Having("bool_and(status <> ?) AND bool_or(status = ? AND notified_at IS NULL)", backorderWaiting, backorderAllocated).
+		Pluck("reference", &references).Error; err != nil {
+		return err
+	}
+
+	for _, reference := range references {
+		body, _ := json.Marshal(map[string]string{"reference": reference})
+		req, err := newInternalRequest(http.MethodPost, orderServiceURL+"/orders/backorders/allocated", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("contacting Order Service: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("order service returned %d for %s", resp.StatusCode, reference)
+		}
+		db.Model(&Backorder{}).
+			Where("reference = ? AND status = ? AND notified_at IS NULL", reference, backorderAllocated).
+			Update("notified_at", time.Now())
+		log.Printf("📨 Order Service told %s has its stock", reference)
+	}
+	return nil
+}
+
+// Background worker: fill pre-orders once released (and anything stock
+// changes missed), then notify Order Service
+func runBackorderWorker() {
+	for {
+		var productIDs []uint
+		db.Model(&Backorder{}).Where("status = ?", backorderWaiting).Distinct().Pluck("product_id", &productIDs)
+		for _, productID := range productIDs {
+			if err := db.Transaction(func(tx *gorm.DB) error {
+				return fillBackorders(tx, productID)
+			}); err != nil {
+				log.Printf("❌ Error filling backorders for Product %d: %v", productID, err)
+			}
+		}
+		if err := notifyAllocatedBackorders(); err != nil {
+			log.Println("❌ Error notifying allocated backorders:", err)
+		}
+		time.Sleep(backorderCheckInterval)
+	}
+}
+
+func listBackorderPolicies(w http.ResponseWriter, r *http.Request) {
+	policies := []BackorderPolicy{}
+	db.Order("product_id").Find(&policies)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies)
+}
+
+// Admin: let a product be backordered or pre-ordered, up to cap units
+func setBackorderPolicy(w http.ResponseWriter, r *http.Request) {
+	var inventory Inventory
+	if err := db.First(&inventory, "product_id = ?", chi.URLParam(r, "productID")).Error; err != nil {
+		http.Error(w, "Product not found in inventory", http.StatusNotFound)
+		return
+	}
+
+	var policy BackorderPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil || !validBackorderMode(policy.Mode) {
+		http.Error(w, "Invalid backorder policy", http.StatusBadRequest)
+		return
+	}
+	if policy.Mode != backorderNone && policy.Cap <= 0 {
+		http.Error(w, "Cap must be positive", http.StatusBadRequest)
+		return
+	}
+	policy.ProductID = inventory.ProductID
+
+	if err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&policy).Error; err != nil {
+		log.Println("❌ Error saving backorder policy:", err)
+		http.Error(w, "Error saving backorder policy", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📝 Backorder policy for Product %d: %s, cap %d", policy.ProductID, policy.Mode, policy.Cap)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+func deleteBackorderPolicy(w http.ResponseWriter, r *http.Request) {
+	db.Delete(&BackorderPolicy{}, "product_id = ?", chi.URLParam(r, "productID"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Backorders, oldest first; waiting ones unless ?status= says otherwise
+func listBackorders(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status == "" {
+		status = backorderWaiting
+	}
+	tx := db.Order("id").Limit(500)
+	if status != "all" {
+		tx = tx.Where("status = ?", status)
+	}
+	if productID := query.Get("product_id"); productID != "" {
+		tx = tx.Where("product_id = ?", productID)
+	}
+	if reference := query.Get("reference"); reference != "" {
+		tx = tx.Where("reference = ?", reference)
+	}
+
+	backorders := []Backorder{}
+	if err := tx.Find(&backorders).Error; err != nil {
+		log.Println("❌ Error loading backorders:", err)
+		http.Error(w, "Error loading backorders", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backorders)
+}
@@ -3,6 +3,7 @@ module inventory-service
 go 1.24.1
 
 require (
+	ecommerce/pkg/idempotency v0.0.0
 	github.com/go-chi/chi/v5 v5.2.1
 	gorm.io/driver/postgres v1.5.11
 	gorm.io/gorm v1.25.12
@@ -19,3 +20,5 @@ require (
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 )
+
+replace ecommerce/pkg/idempotency => ../../pkg/idempotency
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Header services authenticate internal calls with
+const internalKeyHeader = "X-Internal-Key"
+
+// Shared secret for service-to-service calls
+var internalAPIKey = getEnv("INTERNAL_API_KEY", "")
+
+// HTTP client for calls to other services
+var httpClient = &http.Client{Timeout: 5 * time.Second}
+
+// Build a request to another service's internal endpoint
+func newInternalRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(internalKeyHeader, internalAPIKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Location is a warehouse or store that holds stock. Lower Priority is
+// preferred when allocating orders; inactive locations are never allocated.
+type Location struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Code      string    `gorm:"uniqueIndex" json:"code"`
+	Name      string    `json:"name"`
+	Priority  int       `json:"priority"`
+	Active    bool      `gorm:"not null;default:true" json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LocationStock is the quantity of a product held at one location.
+// Inventory.Stock is kept equal to the sum over locations.
+type LocationStock struct {
+	ProductID  uint `gorm:"primaryKey" json:"product_id"`
+	LocationID uint `gorm:"primaryKey;index" json:"location_id"`
+	Quantity   int  `json:"quantity"`
+}
+
+// Stock that predates locations, and stock registered without one, lives here
+var defaultLocationCode = getEnv("DEFAULT_LOCATION", "MAIN")
+var defaultLocationID uint
+
+// Create the default location if needed and move stock that has no
+// location yet into it
+func setupDefaultLocation() {
+	location := Location{Code: defaultLocationCode, Name: "Main warehouse", Active: true}
+	if err := db.Where(Location{Code: defaultLocationCode}).FirstOrCreate(&location).Error; err != nil {
+		log.Fatal("❌ Failed to create default location:", err)
+	}
+	defaultLocationID = location.ID
+
+	result := db.Exec(`
+		INSERT INTO location_stocks (product_id, location_id, quantity)
+		SELECT product_id, ?, stock FROM inventories
+		WHERE NOT EXISTS (SELECT 1 FROM location_stocks WHERE location_stocks.product_id = inventories.product_id)`,
+		defaultLocationID)
+	if result.Error != nil {
+		log.Fatal("❌ Failed to assign stock to the default location:", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("🏭 Moved stock of %d product(s) into location %s", result.RowsAffected, defaultLocationCode)
+	}
+}
+
+func listLocations(w http.ResponseWriter, r *http.Request) {
+	locations := []Location{}
+	db.Order("priority, id").Find(&locations)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(locations)
+}
+
+func createLocation(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Code     string `json:"code"`
+		Name     string `json:"name"`
+		Priority int    `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid location data", http.StatusBadRequest)
+		return
+	}
+	request.Code = strings.ToUpper(strings.TrimSpace(request.Code))
+	if request.Code == "" {
+		http.Error(w, "Location code is required", http.StatusBadRequest)
+		return
+	}
+
+	var existing Location
+	if err := db.First(&existing, "code = ?", request.Code).Error; err == nil {
+		http.Error(w, "Location code already exists", http.StatusConflict)
+		return
+	}
+
+	location := Location{Code: request.Code, Name: request.Name, Priority: request.Priority, Active: true}
+	if err := db.Create(&location).Error; err != nil {
+		log.Println("❌ Error creating location:", err)
+		http.Error(w, "Error creating location", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🏭 Created location %s (ID: %d)", location.Code, location.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(location)
+}
+
+// Rename, reprioritise or (de)activate a location
+func updateLocation(w http.ResponseWriter, r *http.Request) {
+	var location Location
+	if err := db.First(&location, chi.URLParam(r, "id")).Error; err != nil {
+		http.Error(w, "Location not found", http.StatusNotFound)
+		return
+	}
+
+	var request struct {
+		Name     *string `json:"name"`
+		Priority *int    `json:"priority"`
+		Active   *bool   `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid location data", http.StatusBadRequest)
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if request.Name != nil {
+		updates["name"] = *request.Name
+	}
+	if request.Priority != nil {
+		updates["priority"] = *request.Priority
+	}
+	if request.Active != nil {
+		updates["active"] = *request.Active
+	}
+	if len(updates) > 0 {
+		if err := db.Model(&location).Updates(updates).Error; err != nil {
+			log.Println("❌ Error updating location:", err)
+			http.Error(w, "Error updating location", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	db.First(&location, location.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(location)
+}
+
+// Stock of a product per location, with the total
+func getLocationStock(w http.ResponseWriter, r *http.Request) {
+	productID := r.URL.Query().Get("product_id")
+	if productID == "" {
+		http.Error(w, "Missing product_id parameter", http.StatusBadRequest)
+		return
+	}
+
+	var inventory Inventory
+	if err := db.First(&inventory, "product_id = ?", productID).Error; err != nil {
+		http.Error(w, "Producto no encontrado", http.StatusNotFound)
+		return
+	}
+
+	type locationQuantity struct {
+		LocationID uint   `json:"location_id"`
+		Code       string `json:"code"`
+		Name       string `json:"name"`
+		Active     bool   `json:"active"`
+		Quantity   int    `json:"quantity"`
+	}
+	locations := []locationQuantity{}
+	db.Model(&LocationStock{}).
+		Select("location_stocks.location_id, locations.code, locations.name, locations.active, location_stocks.quantity").
+		Joins("JOIN locations ON locations.id = location_stocks.location_id").
+		Where("location_stocks.product_id = ?", inventory.ProductID).
+		Order("locations.priority, locations.id").
+		Scan(&locations)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"product_id": inventory.ProductID,
+		"stock":      inventory.Stock,
+		"locations":  locations,
+	})
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	movementQuarantine = "quarantine"
+	movementRelease    = "quarantine_released"
+
+	// Stock of a lot-tracked product that arrived without a lot number.
+	// It has no expiry, so FEFO uses it last.
+	unassignedLot = "UNASSIGNED"
+
+	expiryCheckInterval = time.Hour
+)
+
+var (
+	errLotQuarantined    = errors.New("lot is quarantined")
+	errLotNotQuarantined = errors.New("lot is not quarantined")
+	errLotNotFound       = errors.New("lot not found")
+)
+
+// Lot is a batch of a lot-tracked product at one location. Quarantined lots
+// keep their quantity but are taken out of location stock, so nothing can
+// be allocated from them until they are released.
+type Lot struct {
+	ID               uint       `gorm:"primaryKey" json:"id"`
+	ProductID        uint       `gorm:"uniqueIndex:idx_lots_product_location_number" json:"product_id"`
+	LocationID       uint       `gorm:"uniqueIndex:idx_lots_product_location_number" json:"location_id"`
+	LotNumber        string     `gorm:"uniqueIndex:idx_lots_product_location_number" json:"lot_number"`
+	ExpiresAt        *time.Time `gorm:"index" json:"expires_at,omitempty"`
+	Quantity         int        `json:"quantity"`
+	Quarantined      bool       `gorm:"index" json:"quarantined"`
+	QuarantineReason string     `json:"quarantine_reason,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// Find or create the lot a lot number refers to at a location
+func findOrCreateLot(tx *gorm.DB, productID, locationID uint, lotNumber string, expiresAt *time.Time) (Lot, error) {
+	lot := Lot{ProductID: productID, LocationID: locationID, LotNumber: lotNumber, ExpiresAt: expiresAt}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&lot).Error; err != nil {
+		return lot, err
+	}
+	err := tx.Where("product_id = ? AND location_id = ? AND lot_number = ?", productID, locationID, lotNumber).First(&lot).Error
+	return lot, err
+}
+
+// Change a lot's quantity for a movement. Quarantine movements only move
+// stock in or out of availability; the lot keeps its quantity.
+func moveLot(tx *gorm.DB, movement StockMovement) error {
+	var lot Lot
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lot, *movement.LotID).Error; err != nil {
+		return errLotNotFound
+	}
+	if lot.ProductID != movement.ProductID || lot.LocationID != movement.LocationID {
+		return fmt.Errorf("%w at this location", errLotNotFound)
+	}
+	if movement.Reason == movementQuarantine || movement.Reason == movementRelease {
+		return nil
+	}
+	if lot.Quarantined {
+		return errLotQuarantined
+	}
+	if lot.Quantity+movement.Quantity < 0 {
+		return errInsufficientStock
+	}
+	return tx.Model(&lot).Update("quantity", lot.Quantity+movement.Quantity).Error
+}
+
+// A movement of a lot-tracked product that doesn't name a lot is split
+// into per-lot movements. Decreases take from the lots that expire first
+// (FEFO). Increases go back to the lots the same reference took from, and
+// the rest to the location's unassigned lot.
+func applyLotMovements(tx *gorm.DB, movement StockMovement) error {
+	if movement.Quantity < 0 {
+		var lots []Lot
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("product_id = ? AND location_id = ? AND quantity > 0 AND NOT quarantined", movement.ProductID, movement.LocationID).
+			Order("expires_at NULLS LAST, id").
+			Find(&lots).Error; err != nil {
+			return err
+		}
+
+		remaining := -movement.Quantity
+		for _, lot := range lots {
+			if remaining == 0 {
+				break
+			}
+			take := min(lot.Quantity, remaining)
+			part := movement
+			part.LotID = &lot.ID
+			part.Quantity = -take
+			if err := applyMovement(tx, part); err != nil {
+				return err
+			}
+			remaining -= take
+		}
+		if remaining > 0 {
+			return errInsufficientStock
+		}
+		return nil
+	}
+
+	remaining := movement.Quantity
+	if movement.Reference != "" {
+		var taken []struct {
+			LotID    uint
+			Quantity int
+		}
+		if err := tx.Model(&StockMovement{}).
+			Select("lot_id, -SUM(quantity) AS quantity").
+			Where("product_id = ? AND location_id = ? AND reference = ? AND lot_id IS NOT NULL", movement.ProductID, movement.LocationID, movement.Reference).
+			Group("lot_id").
+			Having("SUM(quantity) < 0").
+			Order("lot_id").
+			Scan(&taken).Error; err != nil {
+			return err
+		}
+		for _, t := range taken {
+			if remaining == 0 {
+				break
+			}
+			back := min(t.Quantity, remaining)
+			part := movement
+			part.LotID = &t.LotID
+			part.Quantity = back
+			if err := applyMovement(tx, part); err != nil {
+				return err
+			}
+			remaining -= back
+		}
+	}
+	if remaining == 0 {
+		return nil
+	}
+
+	lot, err := findOrCreateLot(tx, movement.ProductID, movement.LocationID, unassignedLot, nil)
+	if err != nil {
+		return err
+	}
+	movement.LotID = &lot.ID
+	movement.Quantity = remaining
+	return applyMovement(tx, movement)
+}
+
+// After stock left fromLocation under reference, put the same lots (by
+// number and expiry) into toLocation
+func mirrorLots(tx *gorm.DB, productID, fromLocation, toLocation uint, reference, reason, note string) error {
+	var moved []struct {
+		LotID    uint
+		Quantity int
+	}
+	if err := tx.Model(&StockMovement{}).
+		Select("lot_id, -SUM(quantity) AS quantity").
+		Where("product_id = ? AND location_id = ? AND reference = ? AND lot_id IS NOT NULL", productID, fromLocation, reference).
+		Group("lot_id").
+		Having("SUM(quantity) < 0").
+		Scan(&moved).Error; err != nil {
+		return err
+	}
+
+	for _, m := range moved {
+		var source Lot
+		if err := tx.First(&source, m.LotID).Error; err != nil {
+			return err
+		}
+		target, err := findOrCreateLot(tx, productID, toLocation, source.LotNumber, source.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		if err := applyMovement(tx, StockMovement{
+			ProductID:  productID,
+			LocationID: toLocation,
+			LotID:      &target.ID,
+			Quantity:   m.Quantity,
+			Reason:     reason,
+			Reference:  reference,
+			Note:       note,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Turn on lot tracking for a product. Stock already on hand goes into
+// each location's unassigned lot. Tracking can't be turned off again.
+func enableLotTracking(w http.ResponseWriter, r *http.Request) {
+	var inventory Inventory
+	if err := db.First(&inventory, "product_id = ?", chi.URLParam(r, "productID")).Error; err != nil {
+		http.Error(w, "Product not found in inventory", http.StatusNotFound)
+		return
+	}
+	if inventory.LotTracked {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&inventory, "product_id = ?", inventory.ProductID).Error; err != nil {
+			return err
+		}
+		var stocks []LocationStock
+		if err := tx.Where("product_id = ? AND quantity > 0", inventory.ProductID).Find(&stocks).Error; err != nil {
+			return err
+		}
+		for _, stock := range stocks {
+			lot, err := findOrCreateLot(tx, stock.ProductID, stock.LocationID, unassignedLot, nil)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&lot).Update("quantity", stock.Quantity).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&inventory).Update("lot_tracked", true).Error
+	})
+	if err != nil {
+		log.Println("❌ Error enabling lot tracking:", err)
+		http.Error(w, "Error enabling lot tracking", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🏷️ Lot tracking enabled for Product %d", inventory.ProductID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listLots(w http.ResponseWriter, r *http.Request) {
+	tx := db.Order("expires_at NULLS LAST, id")
+	if productID := r.URL.Query().Get("product_id"); productID != "" {
+		tx = tx.Where("product_id = ?", productID)
+	}
+	if locationID := r.URL.Query().Get("location_id"); locationID != "" {
+		tx = tx.Where("location_id = ?", locationID)
+	}
+	if empty, _ := strconv.ParseBool(r.URL.Query().Get("include_empty")); !empty {
+		tx = tx.Where("quantity > 0")
+	}
+
+	lots := []Lot{}
+	if err := tx.Find(&lots).Error; err != nil {
+		log.Println("❌ Error loading lots:", err)
+		http.Error(w, "Error loading lots", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lots)
+}
+
+// Lots with stock that expire within ?days= (default 30), including any
+// already expired, soonest first
+func expiringLots(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		var err error
+		if days, err = strconv.Atoi(raw); err != nil || days < 0 {
+			http.Error(w, "Invalid days", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx := db.Where("quantity > 0 AND expires_at IS NOT NULL AND expires_at <= ?", time.Now().AddDate(0, 0, days)).
+		Order("expires_at, id")
+	if locationID := r.URL.Query().Get("location_id"); locationID != "" {
+		tx = tx.Where("location_id = ?", locationID)
+	}
+
+	lots := []Lot{}
+	if err := tx.Find(&lots).Error; err != nil {
+		log.Println("❌ Error loading expiring lots:", err)
+		http.Error(w, "Error loading lots", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lots)
+}
+
+// Take a lot out of available stock
+func quarantineLot(tx *gorm.DB, lotID uint, reason string) (Lot, error) {
+	var lot Lot
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lot, lotID).Error; err != nil {
+		return lot, errLotNotFound
+	}
+	if lot.Quarantined {
+		return lot, errLotQuarantined
+	}
+	if lot.Quantity > 0 {
+		if err := applyMovement(tx, StockMovement{
+			ProductID:  lot.ProductID,
+			LocationID: lot.LocationID,
+			LotID:      &lot.ID,
+			Quantity:   -lot.Quantity,
+			Reason:     movementQuarantine,
+			Reference:  fmt.Sprintf("lot:%d", lot.ID),
+			Note:       reason,
+		}); err != nil {
+			return lot, err
+		}
+	}
+	lot.Quarantined = true
+	lot.QuarantineReason = reason
+	return lot, tx.Model(&lot).Updates(map[string]interface{}{"quarantined": true, "quarantine_reason": reason}).Error
+}
+
+func quarantineLotHandler(w http.ResponseWriter, r *http.Request) {
+	lotID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Lot not found", http.StatusNotFound)
+		return
+	}
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+
+	var lot Lot
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		lot, err = quarantineLot(tx, uint(lotID), request.Reason)
+		return err
+	})
+	if err != nil {
+		lotError(w, err)
+		return
+	}
+
+	log.Printf("🚫 Lot %s of Product %d quarantined: %s", lot.LotNumber, lot.ProductID, request.Reason)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lot)
+}
+
+// Put a quarantined lot back into available stock
+func releaseLot(w http.ResponseWriter, r *http.Request) {
+	var lot Lot
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lot, chi.URLParam(r, "id")).Error; err != nil {
+			return errLotNotFound
+		}
+		if !lot.Quarantined {
+			return errLotNotQuarantined
+		}
+		if lot.Quantity > 0 {
+			if err := applyMovement(tx, StockMovement{
+				ProductID:  lot.ProductID,
+				LocationID: lot.LocationID,
+				LotID:      &lot.ID,
+				Quantity:   lot.Quantity,
+				Reason:     movementRelease,
+				Reference:  fmt.Sprintf("lot:%d", lot.ID),
+			}); err != nil {
+				return err
+			}
+		}
+		lot.Quarantined = false
+		lot.QuarantineReason = ""
+		return tx.Model(&lot).Updates(map[string]interface{}{"quarantined": false, "quarantine_reason": ""}).Error
+	})
+	if err != nil {
+		lotError(w, err)
+		return
+	}
+
+	log.Printf("✅ Lot %s of Product %d released", lot.LotNumber, lot.ProductID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lot)
+}
+
+func lotError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errLotNotFound):
+		http.Error(w, "Lot not found", http.StatusNotFound)
+	case errors.Is(err, errLotQuarantined):
+		http.Error(w, "Lot is already quarantined", http.StatusConflict)
+	case errors.Is(err, errLotNotQuarantined):
+		http.Error(w, "Lot is not quarantined", http.StatusConflict)
+	default:
+		movementError(w, err)
+	}
+}
+
+// Quarantine lots as they expire so they can't be sold
+func quarantineExpiredLots() error {
+	var ids []uint
+	if err := db.Model(&Lot{}).
+		Where("expires_at <= ? AND NOT quarantined AND quantity > 0", time.Now()).
+		Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			_, err := quarantineLot(tx, id, "expired")
+			return err
+		})
+		if errors.Is(err, errLotQuarantined) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("lot %d: %w", id, err)
+		}
+		log.Printf("⌛ Quarantined expired lot %d", id)
+	}
+	return nil
+}
+
+func runExpiryChecker() {
+	for {
+		if err := quarantineExpiredLots(); err != nil {
+			log.Println("❌ Error quarantining expired lots:", err)
+		}
+		time.Sleep(expiryCheckInterval)
+	}
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 
+	"ecommerce/pkg/idempotency"
 	"github.com/go-chi/chi/v5"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -18,10 +21,22 @@ import (
 var db *gorm.DB
 var ctx = context.Background()
 
-// Inventory model
+// Inventory model. Stock is the total available across locations.
+// LotTracked products also keep their stock by lot (see lots.go), and
+// SerialTracked ones by unit (see serials.go).
 type Inventory struct {
-	ProductID uint `gorm:"primaryKey"`
-	Stock     int
+	ProductID     uint `gorm:"primaryKey"`
+	Stock         int
+	LotTracked    bool `gorm:"not null;default:false"`
+	SerialTracked bool `gorm:"not null;default:false"`
+}
+
+// Read an environment variable with a default
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
 }
 
 // Connect to PostgreSQL with retries
@@ -42,18 +57,26 @@ func connectDB() {
 		log.Fatal("❌ Failed to connect to database:", err)
 	}
 
-	if err := db.AutoMigrate(&Inventory{}); err != nil {
-		log.Fatal("❌ Failed to migrate Inventory table:", err)
+	if err := db.AutoMigrate(
+		&Inventory{}, &Location{}, &LocationStock{}, &StockMovement{}, &Transfer{},
+		&ReorderRule{}, &StockAlert{},
+		&Supplier{}, &PurchaseOrder{}, &PurchaseOrderLine{},
+		&Stocktake{}, &StocktakeLine{}, &Lot{},
+		&SerialNumber{}, &SerialEvent{},
+		&BackorderPolicy{}, &Backorder{},
+		&ProductCost{}, &CostLayer{}, &idempotency.Key{},
+	); err != nil {
+		log.Fatal("❌ Failed to migrate Inventory tables:", err)
 	}
-	log.Println("✅ Connected to PostgreSQL and Inventory table migrated")
+	log.Println("✅ Connected to PostgreSQL and Inventory tables migrated")
 }
 
 // 🛠️ Enable CORS Middleware
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*") // Allow all origins
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
 
 		// Handle OPTIONS preflight request
 		if r.Method == "OPTIONS" {
@@ -79,21 +102,67 @@ func getStock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Bundles have no row of their own; their stock is what the components allow
+	if stock, isBundle, err := bundleStock(uint(productID)); err != nil {
+		log.Printf("❌ Error computing bundle stock for product %d: %v", productID, err)
+	} else if isBundle {
+		log.Printf("📊 Stock for bundle %d: %d", productID, stock)
+		fmt.Fprintf(w, "Stock disponible: %d", stock)
+		return
+	}
+
 	var inventory Inventory
 	if err := db.First(&inventory, "product_id = ?", productID).Error; err != nil {
 		http.Error(w, "Producto no encontrado", http.StatusNotFound)
 		return
 	}
 
-	log.Printf("📊 Stock for product %d: %d", productID, inventory.Stock)
-	fmt.Fprintf(w, "Stock disponible: %d", inventory.Stock)
+	// Only active locations can ship
+	available, _ := availableStock(db, uint(productID))
+
+	log.Printf("📊 Stock for product %d: %d", productID, available)
+	fmt.Fprintf(w, "Stock disponible: %d", available)
 }
 
-// Register initial stock for a new product
+// How many complete bundles the components' stock allows. Product Service
+// keeps bundle composition in the shared database.
+func bundleStock(productID uint) (int, bool, error) {
+	var components []struct {
+		Quantity int
+		Stock    int
+	}
+	err := db.Raw(`
+		SELECT bundle_components.quantity, COALESCE(SUM(location_stocks.quantity), 0) AS stock
+		FROM bundle_components
+		LEFT JOIN location_stocks ON location_stocks.product_id = bundle_components.component_id
+			AND location_stocks.location_id IN (SELECT id FROM locations WHERE active)
+		WHERE bundle_components.bundle_id = ?
+		GROUP BY bundle_components.component_id, bundle_components.quantity`, productID).Scan(&components).Error
+	if err != nil || len(components) == 0 {
+		return 0, false, err
+	}
+
+	available := -1
+	for _, component := range components {
+		bundles := component.Stock / component.Quantity
+		if bundles < 0 {
+			bundles = 0
+		}
+		if available < 0 || bundles < available {
+			available = bundles
+		}
+	}
+	return available, true, nil
+}
+
+// Register initial stock for a new product, in the default location unless
+// location_id is given
 func createStock(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		ProductID uint `json:"product_id"`
-		Stock     int  `json:"stock"`
+		ProductID  uint     `json:"product_id"`
+		Stock      int      `json:"stock"`
+		LocationID uint     `json:"location_id"`
+		UnitCost   *float64 `json:"unit_cost"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -117,9 +186,32 @@ func createStock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if request.Stock < 0 {
+		http.Error(w, "Stock insuficiente", http.StatusBadRequest)
+		return
+	}
+	if request.LocationID == 0 {
+		request.LocationID = defaultLocationID
+	}
+
 	// Save stock in the database
-	inventory := Inventory{ProductID: request.ProductID, Stock: request.Stock}
-	if err := db.Create(&inventory).Error; err != nil {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&Inventory{ProductID: request.ProductID}).Error; err != nil {
+			return err
+		}
+		return applyMovement(tx, StockMovement{
+			ProductID:  request.ProductID,
+			LocationID: request.LocationID,
+			Quantity:   request.Stock,
+			Reason:     movementInitial,
+			UnitCost:   request.UnitCost,
+		})
+	})
+	if errors.Is(err, errLocationNotFound) {
+		http.Error(w, "Location not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
 		log.Println("❌ Error saving stock:", err)
 		http.Error(w, "Error al registrar stock", http.StatusInternalServerError)
 		return
@@ -130,10 +222,23 @@ func createStock(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "Stock inicial registrado")
 }
 
-// 🔄 Update stock when orders are placed or canceled
+// 🔄 Update stock when orders are placed or canceled. Decreases are
+// allocated to locations by strategy (ALLOCATION_STRATEGY unless the request
+// names one); increases with a reference go back where that reference took
+// stock from. All items succeed or none do.
+//
+// With allow_backorder, what stock can't cover is backordered for products
+// whose policy allows it; the response is then 202 with the backordered
+// quantities. Increases cancel the reference's waiting backorders first.
+// With taken_only, increases give back no more than the reference took, so
+// releasing a reservation that may never have happened is safe.
 func updateStock(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		Items []struct {
+		Reference      string `json:"reference"` // e.g. "order:12"
+		Strategy       string `json:"strategy"`
+		AllowBackorder bool   `json:"allow_backorder"`
+		TakenOnly      bool   `json:"taken_only"`
+		Items          []struct {
 			ProductID uint `json:"product_id"`
 			Change    int  `json:"change"`
 		} `json:"items"`
@@ -144,81 +249,289 @@ func updateStock(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request data", http.StatusBadRequest)
 		return
 	}
+	if request.Strategy == "" {
+		request.Strategy = allocationStrategy
+	}
+	if !validStrategy(request.Strategy) {
+		http.Error(w, "Invalid allocation strategy", http.StatusBadRequest)
+		return
+	}
 
 	log.Println("📡 Received stock update request:", request)
 
-	// Process each stock change
+	demand := map[uint]int{}
 	for _, item := range request.Items {
-		var inventory Inventory
-		if err := db.First(&inventory, "product_id = ?", item.ProductID).Error; err != nil {
-			log.Printf("❌ Product %d not found in inventory", item.ProductID)
+		if item.Change < 0 {
+			demand[item.ProductID] -= item.Change
+		}
+	}
+
+	var backordered map[uint]int
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if request.AllowBackorder && request.Reference != "" {
+			var err error
+			if backordered, err = reserveBackorders(tx, demand, request.Reference); err != nil {
+				return err
+			}
+		}
+		allocations, err := allocate(tx, demand, request.Strategy)
+		if err != nil {
+			return err
+		}
+		for _, a := range allocations {
+			if err := applyMovement(tx, StockMovement{
+				ProductID:  a.ProductID,
+				LocationID: a.LocationID,
+				Quantity:   -a.Quantity,
+				Reason:     movementOrder,
+				Reference:  request.Reference,
+			}); err != nil {
+				return err
+			}
+			log.Printf("✅ Allocated %d of product %d from location %d", a.Quantity, a.ProductID, a.LocationID)
+		}
+
+		for _, item := range request.Items {
+			if item.Change > 0 {
+				unallocated, err := cancelBackorders(tx, item.ProductID, request.Reference)
+				if err != nil {
+					return err
+				}
+				if change := item.Change - unallocated; change > 0 {
+					if err := returnStock(tx, item.ProductID, change, request.Reference, request.TakenOnly); err != nil {
+						return err
+					}
+				}
+				if err := releaseSerials(tx, item.ProductID, request.Reference); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("❌ Stock update failed:", err)
+		if errors.Is(err, errInsufficientStock) || errors.Is(err, errProductNotFound) {
 			http.Error(w, "Stock insuficiente o producto no encontrado", http.StatusBadRequest)
 			return
 		}
+		movementError(w, err)
+		return
+	}
 
-		// Prevent negative stock
-		newStock := inventory.Stock + item.Change
-		if newStock < 0 {
-			log.Printf("❌ Stock insuficiente for product %d", item.ProductID)
-			http.Error(w, "Stock insuficiente", http.StatusBadRequest)
-			return
+	stockChanged()
+	if len(backordered) > 0 {
+		type line struct {
+			ProductID uint `json:"product_id"`
+			Quantity  int  `json:"quantity"`
 		}
+		lines := make([]line, 0, len(backordered))
+		for productID, quantity := range backordered {
+			lines = append(lines, line{productID, quantity})
+		}
+		log.Printf("⏳ %s backordered: %v", request.Reference, backordered)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{"backordered": lines})
+		return
+	}
+	fmt.Fprintln(w, "Stock actualizado con éxito")
+}
 
-		// Update stock
-		db.Model(&inventory).Update("stock", newStock)
-		log.Printf("✅ Stock updated for product %d. New stock: %d", item.ProductID, newStock)
+// Put quantity back, first to the locations reference took it from, the
+// rest to the default location unless takenOnly
+func returnStock(tx *gorm.DB, productID uint, quantity int, reference string, takenOnly bool) error {
+	var taken []struct {
+		LocationID uint
+		Quantity   int
+	}
+	if reference != "" {
+		if err := tx.Model(&StockMovement{}).
+			Select("location_id, -SUM(quantity) AS quantity").
+			Where("product_id = ? AND reference = ?", productID, reference).
+			Group("location_id").
+			Having("SUM(quantity) < 0").
+			Order("location_id").
+			Scan(&taken).Error; err != nil {
+			return err
+		}
 	}
 
-	fmt.Fprintln(w, "Stock actualizado con éxito")
+	for _, t := range taken {
+		if quantity == 0 {
+			break
+		}
+		back := t.Quantity
+		if back > quantity {
+			back = quantity
+		}
+		if err := applyMovement(tx, StockMovement{
+			ProductID:  productID,
+			LocationID: t.LocationID,
+			Quantity:   back,
+			Reason:     movementOrderCancel,
+			Reference:  reference,
+		}); err != nil {
+			return err
+		}
+		quantity -= back
+	}
+	if quantity == 0 || takenOnly {
+		return nil
+	}
+	return applyMovement(tx, StockMovement{
+		ProductID:  productID,
+		LocationID: defaultLocationID,
+		Quantity:   quantity,
+		Reason:     movementOrderCancel,
+		Reference:  reference,
+	})
 }
 
-// 🔧 Adjust stock manually (restocking, theft, loss)
+// 🔧 Adjust stock manually (restocking, theft, loss) at a location, the
+// default one unless location_id is given
 func adjustStock(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		ProductID uint   `json:"product_id"`
-		Change    int    `json:"change"`
-		Reason    string `json:"reason"`
+		ProductID  uint     `json:"product_id"`
+		LocationID uint     `json:"location_id"`
+		LotID      *uint    `json:"lot_id"`
+		Change     int      `json:"change"`
+		Reason     string   `json:"reason"`
+		UnitCost   *float64 `json:"unit_cost"` // restocking
+		Serials    []string `json:"serials"`   // serial-tracked products: one per unit
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, "Invalid request data", http.StatusBadRequest)
 		return
 	}
-
-	// Find the product stock
-	var inventory Inventory
-	if err := db.First(&inventory, "product_id = ?", request.ProductID).Error; err != nil {
-		log.Printf("❌ Product %d not found in inventory", request.ProductID)
-		http.Error(w, "Product not found in inventory", http.StatusNotFound)
-		return
+	if request.LocationID == 0 {
+		request.LocationID = defaultLocationID
 	}
 
-	// Ensure stock does not go negative
-	newStock := inventory.Stock + request.Change
-	if newStock < 0 {
-		log.Printf("❌ Cannot decrease stock of Product %d below zero", request.ProductID)
-		http.Error(w, "Stock insuficiente", http.StatusBadRequest)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Serial-tracked units come and go by serial, so their records keep
+		// up with the stock
+		units := request.Change
+		if units < 0 {
+			units = -units
+		}
+		if err := checkSerials(tx, request.ProductID, units, request.Serials); err != nil {
+			return err
+		}
+		if len(request.Serials) > 0 {
+			var err error
+			if request.Change > 0 {
+				err = receiveSerials(tx, request.ProductID, request.LocationID, request.Serials, "", request.Reason)
+			} else {
+				err = writeOffSerials(tx, request.ProductID, request.LocationID, request.Serials, request.Reason)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return applyMovement(tx, StockMovement{
+			ProductID:  request.ProductID,
+			LocationID: request.LocationID,
+			LotID:      request.LotID,
+			Quantity:   request.Change,
+			Reason:     movementAdjustment,
+			Note:       request.Reason,
+			UnitCost:   request.UnitCost,
+		})
+	})
+	if err != nil {
+		log.Printf("❌ Cannot adjust stock of Product %d: %v", request.ProductID, err)
+		movementError(w, err)
 		return
 	}
 
-	// Update stock in the database
-	db.Model(&inventory).Update("stock", newStock)
-	log.Printf("✅ Stock adjusted for Product %d. Change: %+d. New stock: %d. Reason: %s",
-		request.ProductID, request.Change, newStock, request.Reason)
+	stockChanged()
+	log.Printf("✅ Stock adjusted for Product %d at location %d. Change: %+d. Reason: %s",
+		request.ProductID, request.LocationID, request.Change, request.Reason)
 
 	fmt.Fprintln(w, "Stock updated successfully")
 }
 
 func main() {
+	if internalAPIKey == "" {
+		log.Fatal("❌ INTERNAL_API_KEY is required")
+	}
+	if !validStrategy(allocationStrategy) {
+		log.Fatal("❌ Invalid ALLOCATION_STRATEGY: ", allocationStrategy)
+	}
+	if valuationMethod != valuationFIFO && valuationMethod != valuationAverage {
+		log.Fatal("❌ Invalid VALUATION_METHOD: ", valuationMethod)
+	}
+
 	connectDB()
+	setupDefaultLocation()
+
+	var err error
+	if notifier, err = newNotifier(); err != nil {
+		log.Fatal("❌ Failed to set up alert notifier:", err)
+	}
+	if idempotencyKeys, err = idempotency.New(db, "inventory-service"); err != nil {
+		log.Fatal("❌ Failed to set up idempotency keys:", err)
+	}
+	go runAlertChecker()
+	go runExpiryChecker()
+	go runBackorderWorker()
+	go runStockStream()
+	go idempotencyKeys.RunCleanup()
 
 	r := chi.NewRouter()
 	r.Use(enableCORS) // ✅ Apply CORS middleware globally
 
-	r.Get("/inventory", getStock)            // ✅ Check stock
-	r.Post("/inventory/create", createStock) // ✅ Create stock
-	r.Post("/inventory/update", updateStock) // ✅ Update stock when orders are placed/canceled
-	r.Post("/inventory/adjust", adjustStock) // ✅ Adjust stock manually (loss, replenishment)
+	r.Get("/inventory", getStock)                        // ✅ Check stock
+	r.Post("/inventory/create", idempotent(createStock)) // ✅ Create stock
+	r.Post("/inventory/update", idempotent(updateStock)) // ✅ Update stock when orders are placed/canceled
+	r.Post("/inventory/adjust", idempotent(adjustStock)) // ✅ Adjust stock manually (loss, replenishment)
+	r.Get("/inventory/stream", streamStock)
+	r.Get("/inventory/locations", getLocationStock)
+	r.Post("/inventory/transfer", idempotent(transferStock))
+	r.Get("/inventory/movements", listMovements)
+	r.Get("/inventory/reorder-rules", listReorderRules)
+	r.Put("/inventory/reorder-rules/{productID}", setReorderRule)
+	r.Delete("/inventory/reorder-rules/{productID}", deleteReorderRule)
+	r.Get("/inventory/alerts", listAlerts)
+	r.Post("/inventory/alerts/{id}/acknowledge", acknowledgeAlert)
+	r.Get("/suppliers", listSuppliers)
+	r.Post("/suppliers", createSupplier)
+	r.Get("/purchase-orders", listPurchaseOrders)
+	r.Post("/purchase-orders", idempotent(createPurchaseOrder))
+	r.Get("/purchase-orders/{id}", getPurchaseOrder)
+	r.Put("/purchase-orders/{id}/lines", setPurchaseOrderLines)
+	r.Post("/purchase-orders/{id}/send", sendPurchaseOrder)
+	r.Post("/purchase-orders/{id}/receive", idempotent(receivePurchaseOrder))
+	r.Post("/purchase-orders/{id}/close", closePurchaseOrder)
+	r.Get("/stocktakes", listStocktakes)
+	r.Post("/stocktakes", createStocktake)
+	r.Get("/stocktakes/{id}", getStocktake)
+	r.Post("/stocktakes/{id}/counts", recordCounts)
+	r.Get("/stocktakes/{id}/variances", getVariances)
+	r.Post("/stocktakes/{id}/post", postStocktake)
+	r.Post("/stocktakes/{id}/cancel", cancelStocktake)
+	r.Put("/inventory/lot-tracking/{productID}", enableLotTracking)
+	r.Get("/lots", listLots)
+	r.Get("/lots/expiring", expiringLots)
+	r.Post("/lots/{id}/quarantine", quarantineLotHandler)
+	r.Post("/lots/{id}/release", releaseLot)
+	r.Put("/inventory/serial-tracking/{productID}", enableSerialTracking)
+	r.Get("/serials", listSerials)
+	r.Post("/serials/receive", idempotent(receiveSerialsHandler))
+	r.Post("/serials/assign", idempotent(assignSerials))
+	r.Post("/serials/return", idempotent(returnSerials))
+	r.Get("/serials/{serial}", serialHistory)
+	r.Get("/inventory/backorder-policies", listBackorderPolicies)
+	r.Put("/inventory/backorder-policies/{productID}", setBackorderPolicy)
+	r.Delete("/inventory/backorder-policies/{productID}", deleteBackorderPolicy)
+	r.Get("/backorders", listBackorders)
+	r.Get("/inventory/valuation", valuationReport)
+	r.Get("/inventory/cogs", costOfGoodsSold)
+	r.Get("/locations", listLocations)
+	r.Post("/locations", createLocation)
+	r.Patch("/locations/{id}", updateLocation)
 
 	log.Println("📦 Inventory Service running on :8082")
 	http.ListenAndServe(":8082", r)
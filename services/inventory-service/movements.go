@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Why stock moved
+const (
+	movementInitial     = "initial"
+	movementOrder       = "order"
+	movementOrderCancel = "order_cancelled"
+	movementAdjustment  = "adjustment"
+	movementTransferOut = "transfer_out"
+	movementTransferIn  = "transfer_in"
+)
+
+var (
+	errInsufficientStock = errors.New("stock insuficiente")
+	errProductNotFound   = errors.New("producto no encontrado")
+	errLocationNotFound  = errors.New("location not found")
+)
+
+// StockMovement is one signed change to the stock of a product at a
+// location. Every change goes through applyMovement, so the movements of a
+// product add up to its stock.
+type StockMovement struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	ProductID  uint      `gorm:"index" json:"product_id"`
+	LocationID uint      `gorm:"index" json:"location_id"`
+	LotID      *uint     `gorm:"index" json:"lot_id,omitempty"`
+	Quantity   int       `json:"quantity"`
+	Reason     string    `gorm:"index" json:"reason"`
+	Reference  string    `gorm:"index" json:"reference,omitempty"` // e.g. "order:12", "transfer:3"
+	Note       string    `json:"note,omitempty"`
+	UnitCost   *float64  `json:"unit_cost,omitempty"` // given on receipts, computed otherwise
+	Cost       float64   `json:"cost,omitempty"`      // signed change in stock value
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+}
+
+// Transfer moves stock between two locations. It is recorded as a
+// transfer_out and a transfer_in movement sharing the reference.
+type Transfer struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	ProductID      uint      `gorm:"index" json:"product_id"`
+	FromLocationID uint      `json:"from_location_id"`
+	ToLocationID   uint      `json:"to_location_id"`
+	LotID          *uint     `json:"lot_id,omitempty"` // lot-tracked products: this lot, or FEFO if unset
+	Quantity       int       `json:"quantity"`
+	Note           string    `json:"note,omitempty"`
+	Serials        []string  `gorm:"-" json:"serials,omitempty"` // serial-tracked products: the units moved
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (t Transfer) reference() string {
+	return fmt.Sprintf("transfer:%d", t.ID)
+}
+
+// Apply a movement inside tx: lock the location's stock, refuse to go
+// below zero, record the movement and keep the product total in step.
+// Movements of lot-tracked products are split by lot first.
+func applyMovement(tx *gorm.DB, movement StockMovement) error {
+	var location Location
+	if err := tx.First(&location, movement.LocationID).Error; err != nil {
+		return errLocationNotFound
+	}
+
+	var inventory Inventory
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&inventory, "product_id = ?", movement.ProductID).Error; err != nil {
+		return errProductNotFound
+	}
+
+	if inventory.LotTracked && movement.LotID == nil {
+		return applyLotMovements(tx, movement)
+	}
+	if movement.LotID != nil {
+		if err := moveLot(tx, movement); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&LocationStock{
+		ProductID:  movement.ProductID,
+		LocationID: movement.LocationID,
+	}).Error; err != nil {
+		return err
+	}
+	var stock LocationStock
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&stock, "product_id = ? AND location_id = ?", movement.ProductID, movement.LocationID).Error; err != nil {
+		return err
+	}
+
+	if stock.Quantity+movement.Quantity < 0 {
+		return errInsufficientStock
+	}
+	if err := tx.Model(&stock).Update("quantity", stock.Quantity+movement.Quantity).Error; err != nil {
+		return err
+	}
+	// Update writes the new total back into inventory, so keep the old one
+	before := inventory.Stock
+	if err := tx.Model(&inventory).Update("stock", before+movement.Quantity).Error; err != nil {
+		return err
+	}
+	if err := costMovement(tx, &movement, before); err != nil {
+		return err
+	}
+	if err := tx.Create(&movement).Error; err != nil {
+		return err
+	}
+	if err := checkStockThresholds(tx, movement.ProductID, before, before+movement.Quantity); err != nil {
+		return err
+	}
+	if movement.Quantity > 0 && location.Active {
+		return fillBackorders(tx, movement.ProductID)
+	}
+	return nil
+}
+
+// Map a movement error to a response
+func movementError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInsufficientStock):
+		http.Error(w, "Stock insuficiente", http.StatusBadRequest)
+	case errors.Is(err, errProductNotFound):
+		http.Error(w, "Product not found in inventory", http.StatusNotFound)
+	case errors.Is(err, errLocationNotFound):
+		http.Error(w, "Location not found", http.StatusNotFound)
+	case errors.Is(err, errLotNotFound):
+		http.Error(w, "Lot not found", http.StatusNotFound)
+	case errors.Is(err, errLotQuarantined):
+		http.Error(w, "Lot is quarantined", http.StatusConflict)
+	case errors.Is(err, errSerialUnavailable):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Println("❌ Error applying stock movement:", err)
+		http.Error(w, "Error updating stock", http.StatusInternalServerError)
+	}
+}
+
+// Move stock between two locations
+func transferStock(w http.ResponseWriter, r *http.Request) {
+	var transfer Transfer
+	if err := json.NewDecoder(r.Body).Decode(&transfer); err != nil {
+		http.Error(w, "Invalid transfer data", http.StatusBadRequest)
+		return
+	}
+	transfer.ID = 0
+	if transfer.Quantity <= 0 {
+		http.Error(w, "Quantity must be positive", http.StatusBadRequest)
+		return
+	}
+	if transfer.FromLocationID == transfer.ToLocationID {
+		http.Error(w, "Source and destination must differ", http.StatusBadRequest)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&transfer).Error; err != nil {
+			return err
+		}
+		if err := applyMovement(tx, StockMovement{
+			ProductID:  transfer.ProductID,
+			LocationID: transfer.FromLocationID,
+			LotID:      transfer.LotID,
+			Quantity:   -transfer.Quantity,
+			Reason:     movementTransferOut,
+			Reference:  transfer.reference(),
+			Note:       transfer.Note,
+		}); err != nil {
+			return err
+		}
+
+		// Lots and serials travel with their stock
+		if err := checkSerials(tx, transfer.ProductID, transfer.Quantity, transfer.Serials); err != nil {
+			return err
+		}
+		if len(transfer.Serials) > 0 {
+			if err := transferSerials(tx, transfer.ProductID, transfer.FromLocationID, transfer.ToLocationID,
+				transfer.Serials, transfer.reference(), transfer.Note); err != nil {
+				return err
+			}
+		}
+		var inventory Inventory
+		if err := tx.First(&inventory, "product_id = ?", transfer.ProductID).Error; err != nil {
+			return err
+		}
+		if inventory.LotTracked {
+			return mirrorLots(tx, transfer.ProductID, transfer.FromLocationID, transfer.ToLocationID,
+				transfer.reference(), movementTransferIn, transfer.Note)
+		}
+		return applyMovement(tx, StockMovement{
+			ProductID:  transfer.ProductID,
+			LocationID: transfer.ToLocationID,
+			Quantity:   transfer.Quantity,
+			Reason:     movementTransferIn,
+			Reference:  transfer.reference(),
+			Note:       transfer.Note,
+		})
+	})
+	if err != nil {
+		movementError(w, err)
+		return
+	}
+
+	log.Printf("🚚 Transferred %d of Product %d from location %d to %d",
+		transfer.Quantity, transfer.ProductID, transfer.FromLocationID, transfer.ToLocationID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(transfer)
+}
+
+// Movement history, newest first, filtered by product, location or reference
+func listMovements(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	tx := db.Order("id DESC")
+	if productID := query.Get("product_id"); productID != "" {
+		tx = tx.Where("product_id = ?", productID)
+	}
+	if locationID := query.Get("location_id"); locationID != "" {
+		tx = tx.Where("location_id = ?", locationID)
+	}
+	if reference := query.Get("reference"); reference != "" {
+		tx = tx.Where("reference = ?", reference)
+	}
+
+	limit := 100
+	if raw := query.Get("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	movements := []StockMovement{}
+	if err := tx.Limit(limit).Find(&movements).Error; err != nil {
+		log.Println("❌ Error loading movements:", err)
+		http.Error(w, "Error loading movements", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(movements)
+}
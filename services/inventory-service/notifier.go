@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Notifier tells someone about a stock alert. Returning an error makes the
+// checker retry it later.
+type Notifier interface {
+	Notify(ctx context.Context, alert StockAlert) error
+}
+
+// Build the notifier from ALERT_NOTIFIERS, a comma-separated list of
+// "log", "webhook" and "email"
+func newNotifier() (multiNotifier, error) {
+	var notifiers multiNotifier
+	for _, name := range strings.Split(getEnv("ALERT_NOTIFIERS", "log"), ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case "log":
+			notifiers = append(notifiers, namedNotifier{name, logNotifier{}})
+		case "webhook":
+			url := getEnv("ALERT_WEBHOOK_URL", "")
+			if url == "" {
+				return nil, errors.New("ALERT_WEBHOOK_URL is required for the webhook notifier")
+			}
+			notifiers = append(notifiers, namedNotifier{name, &webhookNotifier{url: url, client: &http.Client{Timeout: 5 * time.Second}}})
+		case "email":
+			notifier := &emailNotifier{
+				addr:     getEnv("SMTP_ADDR", ""),
+				username: getEnv("SMTP_USERNAME", ""),
+				password: getEnv("SMTP_PASSWORD", ""),
+				from:     getEnv("ALERT_EMAIL_FROM", "inventory@localhost"),
+				to:       strings.Split(getEnv("ALERT_EMAIL_TO", ""), ","),
+			}
+			if notifier.addr == "" || notifier.to[0] == "" {
+				return nil, errors.New("SMTP_ADDR and ALERT_EMAIL_TO are required for the email notifier")
+			}
+			notifiers = append(notifiers, namedNotifier{name, notifier})
+		default:
+			return nil, fmt.Errorf("unknown notifier %q", name)
+		}
+	}
+	return notifiers, nil
+}
+
+// A notifier with the name ALERT_NOTIFIERS gives it
+type namedNotifier struct {
+	name string
+	Notifier
+}
+
+// Sends to every notifier that doesn't have the alert yet
+type multiNotifier []namedNotifier
+
+// Notify the notifiers not listed in the alert's NotifiedBy, returning the
+// list with the ones that succeeded added. Fails if any of them fails.
+func (m multiNotifier) Notify(ctx context.Context, alert StockAlert) (string, error) {
+	var notifiedBy []string
+	if alert.NotifiedBy != "" {
+		notifiedBy = strings.Split(alert.NotifiedBy, ",")
+	}
+	var failed []string
+	for _, notifier := range m {
+		if slices.Contains(notifiedBy, notifier.name) {
+			continue
+		}
+		if err := notifier.Notify(ctx, alert); err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		notifiedBy = append(notifiedBy, notifier.name)
+	}
+	if len(failed) > 0 {
+		return strings.Join(notifiedBy, ","), errors.New(strings.Join(failed, "; "))
+	}
+	return strings.Join(notifiedBy, ","), nil
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, alert StockAlert) error {
+	log.Printf("🔔 %s", alert.summary())
+	return nil
+}
+
+// Posts the alert as JSON
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, alert StockAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sends a plain-text email through an SMTP relay
+type emailNotifier struct {
+	addr     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+// Like smtp.SendMail, but gives up when ctx is done rather than waiting on a
+// relay that stops answering
+func (n *emailNotifier) Notify(ctx context.Context, alert StockAlert) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(n.addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("email: %w", err)
+		}
+	}
+	if n.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.username, n.password, host)); err != nil {
+			return fmt.Errorf("email: %w", err)
+		}
+	}
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [Inventory] %s\r\n\r\n%s\r\n",
+		n.from, strings.Join(n.to, ", "), alert.subject(), alert.summary())
+	if err := client.Mail(n.from); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	for _, to := range n.to {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("email: %w", err)
+		}
+	}
+	body, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	if _, err := body.Write([]byte(message)); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	if err := body.Close(); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	return client.Quit()
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Purchase order lifecycle:
+//
+//	draft → sent → partially_received → closed
+//
+// Lines can only be edited while draft. Receiving everything closes the
+// order; an admin can also close it early if the rest will never arrive.
+const (
+	poDraft             = "draft"
+	poSent              = "sent"
+	poPartiallyReceived = "partially_received"
+	poClosed            = "closed"
+)
+
+const movementReceipt = "receipt"
+
+// Supplier we buy stock from
+type Supplier struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	Phone        string    `json:"phone"`
+	LeadTimeDays int       `json:"lead_time_days"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// PurchaseOrder asks a supplier for stock, delivered to LocationID
+type PurchaseOrder struct {
+	ID         uint                `gorm:"primaryKey" json:"id"`
+	SupplierID uint                `gorm:"index" json:"supplier_id"`
+	Supplier   *Supplier           `json:"supplier,omitempty"`
+	LocationID uint                `json:"location_id"`
+	Status     string              `gorm:"index" json:"status"`
+	ExpectedAt *time.Time          `json:"expected_at,omitempty"`
+	Notes      string              `json:"notes,omitempty"`
+	Lines      []PurchaseOrderLine `gorm:"foreignKey:PurchaseOrderID" json:"lines"`
+	SentAt     *time.Time          `json:"sent_at,omitempty"`
+	ClosedAt   *time.Time          `json:"closed_at,omitempty"`
+	CreatedAt  time.Time           `json:"created_at"`
+	UpdatedAt  time.Time           `json:"updated_at"`
+}
+
+func (po PurchaseOrder) reference() string {
+	return fmt.Sprintf("po:%d", po.ID)
+}
+
+// PurchaseOrderLine is one product on a purchase order. ExpectedAt
+// overrides the order's date for lines that arrive separately.
+type PurchaseOrderLine struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	PurchaseOrderID uint       `gorm:"index" json:"purchase_order_id"`
+	ProductID       uint       `json:"product_id"`
+	Quantity        int        `json:"quantity"`
+	Received        int        `json:"received"`
+	UnitCost        float64    `json:"unit_cost"`
+	ExpectedAt      *time.Time `json:"expected_at,omitempty"`
+}
+
+type lineRequest struct {
+	ProductID  uint       `json:"product_id"`
+	Quantity   int        `json:"quantity"`
+	UnitCost   float64    `json:"unit_cost"`
+	ExpectedAt *time.Time `json:"expected_at"`
+}
+
+func validateLines(requested []lineRequest) ([]PurchaseOrderLine, error) {
+	if len(requested) == 0 {
+		return nil, errors.New("a purchase order needs at least one line")
+	}
+	lines := make([]PurchaseOrderLine, 0, len(requested))
+	for _, line := range requested {
+		if line.Quantity <= 0 {
+			return nil, fmt.Errorf("quantity of product %d must be positive", line.ProductID)
+		}
+		if line.UnitCost < 0 {
+			return nil, fmt.Errorf("unit cost of product %d must not be negative", line.ProductID)
+		}
+		var inventory Inventory
+		if err := db.First(&inventory, "product_id = ?", line.ProductID).Error; err != nil {
+			return nil, fmt.Errorf("product %d not found in inventory", line.ProductID)
+		}
+		lines = append(lines, PurchaseOrderLine{
+			ProductID:  line.ProductID,
+			Quantity:   line.Quantity,
+			UnitCost:   line.UnitCost,
+			ExpectedAt: line.ExpectedAt,
+		})
+	}
+	return lines, nil
+}
+
+func loadPurchaseOrder(id interface{}) (PurchaseOrder, error) {
+	var po PurchaseOrder
+	err := db.Preload("Supplier").Preload("Lines", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("id")
+	}).First(&po, id).Error
+	return po, err
+}
+
+func findPurchaseOrder(w http.ResponseWriter, r *http.Request) (PurchaseOrder, bool) {
+	po, err := loadPurchaseOrder(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Purchase order not found", http.StatusNotFound)
+		return po, false
+	}
+	return po, true
+}
+
+// Respond with the purchase order as it is now
+func writePurchaseOrder(w http.ResponseWriter, id uint, status int) {
+	po, err := loadPurchaseOrder(id)
+	if err != nil {
+		log.Println("❌ Error loading purchase order:", err)
+		http.Error(w, "Error loading purchase order", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(po)
+}
+
+func listSuppliers(w http.ResponseWriter, r *http.Request) {
+	suppliers := []Supplier{}
+	db.Order("name").Find(&suppliers)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suppliers)
+}
+
+func createSupplier(w http.ResponseWriter, r *http.Request) {
+	var supplier Supplier
+	if err := json.NewDecoder(r.Body).Decode(&supplier); err != nil {
+		http.Error(w, "Invalid supplier data", http.StatusBadRequest)
+		return
+	}
+	supplier.ID = 0
+	if strings.TrimSpace(supplier.Name) == "" {
+		http.Error(w, "Supplier name is required", http.StatusBadRequest)
+		return
+	}
+	if err := db.Create(&supplier).Error; err != nil {
+		log.Println("❌ Error creating supplier:", err)
+		http.Error(w, "Error creating supplier", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🏷️ Created supplier %s (ID: %d)", supplier.Name, supplier.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(supplier)
+}
+
+// Purchase orders, newest first, optionally by status or supplier
+func listPurchaseOrders(w http.ResponseWriter, r *http.Request) {
+	tx := db.Preload("Lines").Order("id DESC")
+	if status := r.URL.Query().Get("status"); status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	if supplierID := r.URL.Query().Get("supplier_id"); supplierID != "" {
+		tx = tx.Where("supplier_id = ?", supplierID)
+	}
+
+	orders := []PurchaseOrder{}
+	if err := tx.Find(&orders).Error; err != nil {
+		log.Println("❌ Error loading purchase orders:", err)
+		http.Error(w, "Error loading purchase orders", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+func getPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	po, ok := findPurchaseOrder(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(po)
+}
+
+// Create a draft purchase order. Stock is delivered to location_id, or the
+// default location.
+func createPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		SupplierID uint          `json:"supplier_id"`
+		LocationID uint          `json:"location_id"`
+		ExpectedAt *time.Time    `json:"expected_at"`
+		Notes      string        `json:"notes"`
+		Lines      []lineRequest `json:"lines"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid purchase order data", http.StatusBadRequest)
+		return
+	}
+
+	var supplier Supplier
+	if err := db.First(&supplier, request.SupplierID).Error; err != nil {
+		http.Error(w, "Supplier not found", http.StatusBadRequest)
+		return
+	}
+	if request.LocationID == 0 {
+		request.LocationID = defaultLocationID
+	}
+	var location Location
+	if err := db.First(&location, request.LocationID).Error; err != nil {
+		http.Error(w, "Location not found", http.StatusBadRequest)
+		return
+	}
+	lines, err := validateLines(request.Lines)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Default the expected date from the supplier's lead time
+	if request.ExpectedAt == nil && supplier.LeadTimeDays > 0 {
+		expected := time.Now().AddDate(0, 0, supplier.LeadTimeDays)
+		request.ExpectedAt = &expected
+	}
+
+	po := PurchaseOrder{
+		SupplierID: supplier.ID,
+		LocationID: location.ID,
+		Status:     poDraft,
+		ExpectedAt: request.ExpectedAt,
+		Notes:      request.Notes,
+		Lines:      lines,
+	}
+	if err := db.Create(&po).Error; err != nil {
+		log.Println("❌ Error creating purchase order:", err)
+		http.Error(w, "Error creating purchase order", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📝 Created purchase order %d for supplier %s", po.ID, supplier.Name)
+	writePurchaseOrder(w, po.ID, http.StatusCreated)
+}
+
+// Replace the lines of a draft purchase order
+func setPurchaseOrderLines(w http.ResponseWriter, r *http.Request) {
+	po, ok := findPurchaseOrder(w, r)
+	if !ok {
+		return
+	}
+	if po.Status != poDraft {
+		http.Error(w, "Only draft purchase orders can be edited", http.StatusConflict)
+		return
+	}
+
+	var request struct {
+		Lines []lineRequest `json:"lines"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid purchase order data", http.StatusBadRequest)
+		return
+	}
+	lines, err := validateLines(request.Lines)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range lines {
+		lines[i].PurchaseOrderID = po.ID
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("purchase_order_id = ?", po.ID).Delete(&PurchaseOrderLine{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&lines).Error
+	})
+	if err != nil {
+		log.Println("❌ Error saving purchase order lines:", err)
+		http.Error(w, "Error saving purchase order", http.StatusInternalServerError)
+		return
+	}
+	writePurchaseOrder(w, po.ID, http.StatusOK)
+}
+
+// Mark a draft as sent to the supplier
+func sendPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	po, ok := findPurchaseOrder(w, r)
+	if !ok {
+		return
+	}
+	if po.Status != poDraft {
+		http.Error(w, "Only draft purchase orders can be sent", http.StatusConflict)
+		return
+	}
+
+	db.Model(&po).Updates(map[string]interface{}{"status": poSent, "sent_at": time.Now()})
+	log.Printf("📤 Purchase order %d sent", po.ID)
+	writePurchaseOrder(w, po.ID, http.StatusOK)
+}
+
+// Record goods arriving. Each line's quantity is added to stock at the
+// order's location (or location_id) through the movement path; receiving
+// everything outstanding closes the order.
+func receivePurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		LocationID uint   `json:"location_id"`
+		Note       string `json:"note"`
+		Lines      []struct {
+			LineID    uint       `json:"line_id"`
+			Quantity  int        `json:"quantity"`
+			LotNumber string     `json:"lot_number"` // lot-tracked products
+			ExpiresAt *time.Time `json:"expires_at"`
+			Serials   []string   `json:"serials"` // serial-tracked products, one per unit
+		} `json:"lines"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Lines) == 0 {
+		http.Error(w, "Invalid receiving data", http.StatusBadRequest)
+		return
+	}
+
+	var po PurchaseOrder
+	var conflict error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&po, chi.URLParam(r, "id")).Error; err != nil {
+			return err
+		}
+		if po.Status != poSent && po.Status != poPartiallyReceived {
+			conflict = fmt.Errorf("cannot receive a %s purchase order", po.Status)
+			return conflict
+		}
+		locationID := po.LocationID
+		if request.LocationID != 0 {
+			locationID = request.LocationID
+		}
+
+		for _, received := range request.Lines {
+			var line PurchaseOrderLine
+			if err := tx.First(&line, "id = ? AND purchase_order_id = ?", received.LineID, po.ID).Error; err != nil {
+				conflict = fmt.Errorf("line %d is not on this purchase order", received.LineID)
+				return conflict
+			}
+			if received.Quantity <= 0 || line.Received+received.Quantity > line.Quantity {
+				conflict = fmt.Errorf("line %d has %d outstanding", line.ID, line.Quantity-line.Received)
+				return conflict
+			}
+			if err := tx.Model(&line).Update("received", line.Received+received.Quantity).Error; err != nil {
+				return err
+			}
+
+			// Without a lot number, lot-tracked stock goes to the unassigned lot
+			var lotID *uint
+			if received.LotNumber != "" {
+				var inventory Inventory
+				if err := tx.First(&inventory, "product_id = ?", line.ProductID).Error; err != nil {
+					return err
+				}
+				if !inventory.LotTracked {
+					conflict = fmt.Errorf("product %d is not lot-tracked", line.ProductID)
+					return conflict
+				}
+				lot, err := findOrCreateLot(tx, line.ProductID, locationID, received.LotNumber, received.ExpiresAt)
+				if err != nil {
+					return err
+				}
+				lotID = &lot.ID
+			}
+			if err := checkSerials(tx, line.ProductID, received.Quantity, received.Serials); err != nil {
+				return err
+			}
+			if err := receiveSerials(tx, line.ProductID, locationID, received.Serials, po.reference(), request.Note); err != nil {
+				return err
+			}
+			if err := applyMovement(tx, StockMovement{
+				ProductID:  line.ProductID,
+				LocationID: locationID,
+				LotID:      lotID,
+				Quantity:   received.Quantity,
+				Reason:     movementReceipt,
+				Reference:  po.reference(),
+				UnitCost:   &line.UnitCost,
+				Note:       request.Note,
+			}); err != nil {
+				return err
+			}
+		}
+
+		var outstanding int64
+		if err := tx.Model(&PurchaseOrderLine{}).
+			Where("purchase_order_id = ? AND received < quantity", po.ID).
+			Count(&outstanding).Error; err != nil {
+			return err
+		}
+		updates := map[string]interface{}{"status": poPartiallyReceived}
+		if outstanding == 0 {
+			updates = map[string]interface{}{"status": poClosed, "closed_at": time.Now()}
+		}
+		return tx.Model(&po).Updates(updates).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Purchase order not found", http.StatusNotFound)
+		return
+	}
+	if conflict != nil {
+		http.Error(w, conflict.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		movementError(w, err)
+		return
+	}
+
+	log.Printf("📥 Received goods on purchase order %d", po.ID)
+	writePurchaseOrder(w, po.ID, http.StatusOK)
+}
+
+// Close a purchase order without waiting for the rest of the goods
+func closePurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	po, ok := findPurchaseOrder(w, r)
+	if !ok {
+		return
+	}
+	if po.Status == poClosed {
+		http.Error(w, "Purchase order is already closed", http.StatusConflict)
+		return
+	}
+
+	db.Model(&po).Updates(map[string]interface{}{"status": poClosed, "closed_at": time.Now()})
+	log.Printf("🔒 Purchase order %d closed", po.ID)
+	writePurchaseOrder(w, po.ID, http.StatusOK)
+}
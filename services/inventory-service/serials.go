@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const movementReturn = "return"
+
+// Where a serialised unit is
+const (
+	serialInStock    = "in_stock"
+	serialSold       = "sold"
+	serialWrittenOff = "written_off" // taken out of stock by an adjustment
+)
+
+// What happened to a serialised unit
+const (
+	serialEventReceived    = "received"
+	serialEventSold        = "sold"
+	serialEventReturned    = "returned"
+	serialEventWrittenOff  = "written_off"
+	serialEventTransferred = "transferred"
+)
+
+var errSerialUnavailable = errors.New("serial number unavailable")
+
+// SerialNumber is one unit of a serial-tracked product. Serials are unique
+// per product.
+type SerialNumber struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	ProductID   uint      `gorm:"uniqueIndex:idx_serial_numbers_product_serial" json:"product_id"`
+	Serial      string    `gorm:"uniqueIndex:idx_serial_numbers_product_serial" json:"serial"`
+	LocationID  uint      `gorm:"index" json:"location_id"`
+	Status      string    `gorm:"index" json:"status"`
+	OrderItemID *uint     `gorm:"index" json:"order_item_id,omitempty"` // while sold
+	Reference   string    `json:"reference,omitempty"`                  // e.g. "order:12" while sold
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// SerialEvent is one step in a serial's history
+type SerialEvent struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	SerialNumberID uint      `gorm:"index" json:"-"`
+	Event          string    `json:"event"`
+	LocationID     uint      `json:"location_id"`
+	OrderItemID    *uint     `json:"order_item_id,omitempty"`
+	Reference      string    `json:"reference,omitempty"`
+	Note           string    `json:"note,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Trim serials and reject blanks and repeats
+func cleanSerials(serials []string) ([]string, error) {
+	seen := map[string]bool{}
+	cleaned := make([]string, 0, len(serials))
+	for _, serial := range serials {
+		serial = strings.TrimSpace(serial)
+		if serial == "" || seen[serial] {
+			return nil, fmt.Errorf("%w: blank or repeated serial %q", errSerialUnavailable, serial)
+		}
+		seen[serial] = true
+		cleaned = append(cleaned, serial)
+	}
+	return cleaned, nil
+}
+
+// Check serials are given exactly for serial-tracked products
+func checkSerials(tx *gorm.DB, productID uint, quantity int, serials []string) error {
+	var inventory Inventory
+	if err := tx.First(&inventory, "product_id = ?", productID).Error; err != nil {
+		return errProductNotFound
+	}
+	if !inventory.SerialTracked {
+		if len(serials) > 0 {
+			return fmt.Errorf("%w: product %d is not serial-tracked", errSerialUnavailable, productID)
+		}
+		return nil
+	}
+	if len(serials) != quantity {
+		return fmt.Errorf("%w: product %d needs %d serials, got %d", errSerialUnavailable, productID, quantity, len(serials))
+	}
+	return nil
+}
+
+// Put new units into stock at a location. Serials already in stock are
+// refused; ones seen before (sold and since returned) are taken back in.
+func receiveSerials(tx *gorm.DB, productID, locationID uint, serials []string, reference, note string) error {
+	serials, err := cleanSerials(serials)
+	if err != nil {
+		return err
+	}
+	for _, serial := range serials {
+		unit := SerialNumber{ProductID: productID, Serial: serial}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("product_id = ? AND serial = ?", productID, serial).
+			Limit(1).Find(&unit).Error; err != nil {
+			return err
+		}
+		if unit.Status == serialInStock {
+			return fmt.Errorf("%w: %s is already in stock", errSerialUnavailable, serial)
+		}
+
+		unit.LocationID = locationID
+		unit.Status = serialInStock
+		unit.OrderItemID = nil
+		unit.Reference = ""
+		if err := tx.Save(&unit).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&SerialEvent{
+			SerialNumberID: unit.ID,
+			Event:          serialEventReceived,
+			LocationID:     locationID,
+			Reference:      reference,
+			Note:           note,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lock units that are in stock at a location, failing unless every serial
+// is one of them
+func serialsInStockAt(tx *gorm.DB, productID, locationID uint, serials []string) ([]SerialNumber, error) {
+	serials, err := cleanSerials(serials)
+	if err != nil {
+		return nil, err
+	}
+	var units []SerialNumber
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("product_id = ? AND serial IN ? AND status = ? AND location_id = ?", productID, serials, serialInStock, locationID).
+		Find(&units).Error; err != nil {
+		return nil, err
+	}
+	if len(units) != len(serials) {
+		return nil, fmt.Errorf("%w: not every serial is in stock at location %d", errSerialUnavailable, locationID)
+	}
+	return units, nil
+}
+
+// Take units out of stock for a negative adjustment
+func writeOffSerials(tx *gorm.DB, productID, locationID uint, serials []string, note string) error {
+	units, err := serialsInStockAt(tx, productID, locationID, serials)
+	if err != nil {
+		return err
+	}
+	for _, unit := range units {
+		if err := tx.Create(&SerialEvent{
+			SerialNumberID: unit.ID,
+			Event:          serialEventWrittenOff,
+			LocationID:     locationID,
+			Note:           note,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&unit).Update("status", serialWrittenOff).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move units along with a transfer
+func transferSerials(tx *gorm.DB, productID, fromLocationID, toLocationID uint, serials []string, reference, note string) error {
+	units, err := serialsInStockAt(tx, productID, fromLocationID, serials)
+	if err != nil {
+		return err
+	}
+	for _, unit := range units {
+		if err := tx.Create(&SerialEvent{
+			SerialNumberID: unit.ID,
+			Event:          serialEventTransferred,
+			LocationID:     toLocationID,
+			Reference:      reference,
+			Note:           note,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&unit).Update("location_id", toLocationID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Called when an order gives stock back: units it was sold go back in stock
+// where they were
+func releaseSerials(tx *gorm.DB, productID uint, reference string) error {
+	if reference == "" {
+		return nil
+	}
+	var units []SerialNumber
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("product_id = ? AND status = ? AND reference = ?", productID, serialSold, reference).
+		Find(&units).Error; err != nil {
+		return err
+	}
+	for _, unit := range units {
+		if err := tx.Create(&SerialEvent{
+			SerialNumberID: unit.ID,
+			Event:          serialEventReturned,
+			LocationID:     unit.LocationID,
+			OrderItemID:    unit.OrderItemID,
+			Reference:      reference,
+			Note:           "order cancelled",
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&unit).Updates(map[string]interface{}{
+			"status": serialInStock, "order_item_id": nil, "reference": "",
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Turn on serial tracking for a product. Stock already on hand has no
+// serials and can't be assigned until it is received again with them.
+func enableSerialTracking(w http.ResponseWriter, r *http.Request) {
+	result := db.Model(&Inventory{}).Where("product_id = ?", chi.URLParam(r, "productID")).Update("serial_tracked", true)
+	if result.Error != nil {
+		log.Println("❌ Error enabling serial tracking:", result.Error)
+		http.Error(w, "Error enabling serial tracking", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Product not found in inventory", http.StatusNotFound)
+		return
+	}
+	log.Printf("🔢 Serial tracking enabled for Product %s", chi.URLParam(r, "productID"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Restock serialised units outside a purchase order
+func receiveSerialsHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ProductID  uint     `json:"product_id"`
+		LocationID uint     `json:"location_id"`
+		Serials    []string `json:"serials"`
+		Reference  string   `json:"reference"`
+		Note       string   `json:"note"`
+		UnitCost   *float64 `json:"unit_cost"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Serials) == 0 {
+		http.Error(w, "Invalid serial data", http.StatusBadRequest)
+		return
+	}
+	if request.LocationID == 0 {
+		request.LocationID = defaultLocationID
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := checkSerials(tx, request.ProductID, len(request.Serials), request.Serials); err != nil {
+			return err
+		}
+		if err := receiveSerials(tx, request.ProductID, request.LocationID, request.Serials, request.Reference, request.Note); err != nil {
+			return err
+		}
+		return applyMovement(tx, StockMovement{
+			ProductID:  request.ProductID,
+			LocationID: request.LocationID,
+			Quantity:   len(request.Serials),
+			Reason:     movementReceipt,
+			Reference:  request.Reference,
+			Note:       request.Note,
+			UnitCost:   request.UnitCost,
+		})
+	})
+	if err != nil {
+		movementError(w, err)
+		return
+	}
+
+	log.Printf("📥 Received %d serialised units of Product %d", len(request.Serials), request.ProductID)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, "Serials received")
+}
+
+// Take back units a customer returned after they were sold
+func returnSerials(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ProductID  uint     `json:"product_id"`
+		LocationID uint     `json:"location_id"`
+		Serials    []string `json:"serials"`
+		Note       string   `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Serials) == 0 {
+		http.Error(w, "Invalid serial data", http.StatusBadRequest)
+		return
+	}
+	if request.LocationID == 0 {
+		request.LocationID = defaultLocationID
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		serials, err := cleanSerials(request.Serials)
+		if err != nil {
+			return err
+		}
+		for _, serial := range serials {
+			var unit SerialNumber
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				First(&unit, "product_id = ? AND serial = ?", request.ProductID, serial).Error; err != nil {
+				return fmt.Errorf("%w: %s is unknown", errSerialUnavailable, serial)
+			}
+			if unit.Status != serialSold {
+				return fmt.Errorf("%w: %s was not sold", errSerialUnavailable, serial)
+			}
+			if err := tx.Create(&SerialEvent{
+				SerialNumberID: unit.ID,
+				Event:          serialEventReturned,
+				LocationID:     request.LocationID,
+				OrderItemID:    unit.OrderItemID,
+				Reference:      unit.Reference,
+				Note:           request.Note,
+			}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&unit).Updates(map[string]interface{}{
+				"status": serialInStock, "location_id": request.LocationID, "order_item_id": nil, "reference": "",
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return applyMovement(tx, StockMovement{
+			ProductID:  request.ProductID,
+			LocationID: request.LocationID,
+			Quantity:   len(serials),
+			Reason:     movementReturn,
+			Note:       request.Note,
+		})
+	})
+	if err != nil {
+		movementError(w, err)
+		return
+	}
+
+	log.Printf("↩️ %d serialised units of Product %d returned", len(request.Serials), request.ProductID)
+	fmt.Fprintln(w, "Serials returned")
+}
+
+// Fulfilment: record which units went to which order items. The stock
+// itself was taken when the order was placed. Items of serial-tracked
+// products need a serial for every unit. Assigning the same serials to the
+// same item again is a no-op.
+func assignSerials(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Reference string `json:"reference"` // e.g. "order:12"
+		Items     []struct {
+			OrderItemID uint     `json:"order_item_id"`
+			ProductID   uint     `json:"product_id"`
+			Quantity    int      `json:"quantity"`
+			Serials     []string `json:"serials"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Items) == 0 {
+		http.Error(w, "Invalid assignment data", http.StatusBadRequest)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, item := range request.Items {
+			serials, err := cleanSerials(item.Serials)
+			if err != nil {
+				return err
+			}
+			if err := checkSerials(tx, item.ProductID, item.Quantity, serials); err != nil {
+				return err
+			}
+			for _, serial := range serials {
+				var unit SerialNumber
+				if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+					First(&unit, "product_id = ? AND serial = ?", item.ProductID, serial).Error; err != nil {
+					return fmt.Errorf("%w: %s is unknown", errSerialUnavailable, serial)
+				}
+				if unit.Status == serialSold && unit.OrderItemID != nil && *unit.OrderItemID == item.OrderItemID {
+					continue
+				}
+				if unit.Status != serialInStock {
+					return fmt.Errorf("%w: %s is not in stock", errSerialUnavailable, serial)
+				}
+
+				orderItemID := item.OrderItemID
+				if err := tx.Model(&unit).Updates(map[string]interface{}{
+					"status": serialSold, "order_item_id": orderItemID, "reference": request.Reference,
+				}).Error; err != nil {
+					return err
+				}
+				if err := tx.Create(&SerialEvent{
+					SerialNumberID: unit.ID,
+					Event:          serialEventSold,
+					LocationID:     unit.LocationID,
+					OrderItemID:    &orderItemID,
+					Reference:      request.Reference,
+				}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		movementError(w, err)
+		return
+	}
+
+	log.Printf("🔢 Serials assigned for %s", request.Reference)
+	fmt.Fprintln(w, "Serials assigned")
+}
+
+// Serial numbers filtered by product, status or order item
+func listSerials(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	tx := db.Order("product_id, serial")
+	if productID := query.Get("product_id"); productID != "" {
+		tx = tx.Where("product_id = ?", productID)
+	}
+	if status := query.Get("status"); status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	if orderItemID := query.Get("order_item_id"); orderItemID != "" {
+		tx = tx.Where("order_item_id = ?", orderItemID)
+	}
+
+	units := []SerialNumber{}
+	if err := tx.Limit(1000).Find(&units).Error; err != nil {
+		log.Println("❌ Error loading serials:", err)
+		http.Error(w, "Error loading serials", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(units)
+}
+
+// A serial's full history. Serials are only unique per product, so this
+// returns every product's unit with that serial unless ?product_id= is given.
+func serialHistory(w http.ResponseWriter, r *http.Request) {
+	tx := db.Where("serial = ?", chi.URLParam(r, "serial"))
+	if productID := r.URL.Query().Get("product_id"); productID != "" {
+		tx = tx.Where("product_id = ?", productID)
+	}
+	var units []SerialNumber
+	if err := tx.Find(&units).Error; err != nil || len(units) == 0 {
+		http.Error(w, "Serial not found", http.StatusNotFound)
+		return
+	}
+
+	type history struct {
+		SerialNumber
+		Events []SerialEvent `json:"events"`
+	}
+	histories := make([]history, 0, len(units))
+	for _, unit := range units {
+		events := []SerialEvent{}
+		db.Where("serial_number_id = ?", unit.ID).Order("id").Find(&events)
+		histories = append(histories, history{SerialNumber: unit, Events: events})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(histories)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Stocktake statuses. Counts are accepted while counting; posting applies
+// the approved variances and ends the stocktake.
+const (
+	stocktakeCounting  = "counting"
+	stocktakePosted    = "posted"
+	stocktakeCancelled = "cancelled"
+)
+
+const movementStocktake = "stocktake"
+
+// Stocktake is a count of the stock at one location
+type Stocktake struct {
+	ID         uint            `gorm:"primaryKey" json:"id"`
+	LocationID uint            `gorm:"index" json:"location_id"`
+	Status     string          `gorm:"index" json:"status"`
+	Note       string          `json:"note,omitempty"`
+	Lines      []StocktakeLine `gorm:"foreignKey:StocktakeID" json:"lines,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	PostedAt   *time.Time      `json:"posted_at,omitempty"`
+}
+
+func (s Stocktake) reference() string {
+	return fmt.Sprintf("stocktake:%d", s.ID)
+}
+
+// StocktakeLine compares what the system expected with what was counted.
+// Expected starts as the quantity when the stocktake started and is moved to
+// the quantity at CountedAt when the count is recorded, so stock sold or
+// received between the two isn't mistaken for a variance. Movements after
+// the count don't skew it either, because the variance is posted as a
+// change, not an absolute value. Counts should be recorded as they're made.
+type StocktakeLine struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	StocktakeID uint       `gorm:"uniqueIndex:idx_stocktake_product" json:"stocktake_id"`
+	ProductID   uint       `gorm:"uniqueIndex:idx_stocktake_product" json:"product_id"`
+	Expected    int        `json:"expected"`
+	Counted     *int       `json:"counted"`
+	CountedAt   *time.Time `json:"counted_at,omitempty"`
+	Posted      bool       `json:"posted"`
+}
+
+func (l StocktakeLine) variance() int {
+	if l.Counted == nil {
+		return 0
+	}
+	return *l.Counted - l.Expected
+}
+
+type productCount struct {
+	ProductID uint `json:"product_id"`
+	Counted   int  `json:"counted"`
+}
+
+func findStocktake(w http.ResponseWriter, r *http.Request) (Stocktake, bool) {
+	var stocktake Stocktake
+	err := db.Preload("Lines", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("product_id")
+	}).First(&stocktake, chi.URLParam(r, "id")).Error
+	if err != nil {
+		http.Error(w, "Stocktake not found", http.StatusNotFound)
+		return stocktake, false
+	}
+	return stocktake, true
+}
+
+func listStocktakes(w http.ResponseWriter, r *http.Request) {
+	tx := db.Order("id DESC")
+	if status := r.URL.Query().Get("status"); status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	stocktakes := []Stocktake{}
+	tx.Find(&stocktakes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stocktakes)
+}
+
+func getStocktake(w http.ResponseWriter, r *http.Request) {
+	stocktake, ok := findStocktake(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stocktake)
+}
+
+// Start a stocktake at a location, snapshotting the expected quantity of
+// product_ids (or of everything stocked there)
+func createStocktake(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		LocationID uint   `json:"location_id"`
+		ProductIDs []uint `json:"product_ids"`
+		Note       string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid stocktake data", http.StatusBadRequest)
+		return
+	}
+	if request.LocationID == 0 {
+		request.LocationID = defaultLocationID
+	}
+	var location Location
+	if err := db.First(&location, request.LocationID).Error; err != nil {
+		http.Error(w, "Location not found", http.StatusNotFound)
+		return
+	}
+
+	stocktake := Stocktake{LocationID: location.ID, Status: stocktakeCounting, Note: request.Note}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&stocktake).Error; err != nil {
+			return err
+		}
+
+		var stocks []LocationStock
+		query := tx.Where("location_id = ?", location.ID)
+		if len(request.ProductIDs) > 0 {
+			query = query.Where("product_id IN ?", request.ProductIDs)
+		}
+		if err := query.Find(&stocks).Error; err != nil {
+			return err
+		}
+		expected := map[uint]int{}
+		for _, stock := range stocks {
+			expected[stock.ProductID] = stock.Quantity
+		}
+		// Products asked for but never stocked here are expected to be zero
+		for _, productID := range request.ProductIDs {
+			if _, ok := expected[productID]; !ok {
+				expected[productID] = 0
+			}
+		}
+
+		lines := make([]StocktakeLine, 0, len(expected))
+		for productID, quantity := range expected {
+			lines = append(lines, StocktakeLine{StocktakeID: stocktake.ID, ProductID: productID, Expected: quantity})
+		}
+		if len(lines) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(lines, 500).Error
+	})
+	if err != nil {
+		log.Println("❌ Error creating stocktake:", err)
+		http.Error(w, "Error creating stocktake", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📋 Started stocktake %d at location %s", stocktake.ID, location.Code)
+	db.Preload("Lines").First(&stocktake, stocktake.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(stocktake)
+}
+
+// Read counts from a CSV with product_id and counted columns
+func readCountsCSV(body io.Reader) ([]productCount, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	productColumn, ok1 := columns["product_id"]
+	countedColumn, ok2 := columns["counted"]
+	if !ok1 || !ok2 {
+		return nil, errors.New("header must include product_id and counted")
+	}
+
+	var counts []productCount
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		productID, err := strconv.ParseUint(strings.TrimSpace(record[productColumn]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid product_id", line)
+		}
+		counted, err := strconv.Atoi(strings.TrimSpace(record[countedColumn]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid counted", line)
+		}
+		counts = append(counts, productCount{ProductID: uint(productID), Counted: counted})
+	}
+	return counts, nil
+}
+
+// Record counted quantities, as JSON {"counts": [...]} or a CSV upload.
+// Counting a product again replaces the earlier count. Each line's expected
+// quantity becomes the quantity now, when it was counted; products found
+// that weren't in the snapshot are added.
+func recordCounts(w http.ResponseWriter, r *http.Request) {
+	stocktake, ok := findStocktake(w, r)
+	if !ok {
+		return
+	}
+	if stocktake.Status != stocktakeCounting {
+		http.Error(w, "Stocktake is no longer accepting counts", http.StatusConflict)
+		return
+	}
+
+	var counts []productCount
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		var err error
+		if counts, err = readCountsCSV(http.MaxBytesReader(w, r.Body, 10<<20)); err != nil {
+			http.Error(w, "Invalid CSV: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		var request struct {
+			Counts []productCount `json:"counts"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid count data", http.StatusBadRequest)
+			return
+		}
+		counts = request.Counts
+	}
+	for _, count := range counts {
+		if count.Counted < 0 {
+			http.Error(w, fmt.Sprintf("Count for product %d must not be negative", count.ProductID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, count := range counts {
+			var inventory Inventory
+			if err := tx.First(&inventory, "product_id = ?", count.ProductID).Error; err != nil {
+				return fmt.Errorf("%w: product %d", errProductNotFound, count.ProductID)
+			}
+
+			var current LocationStock
+			if err := tx.Where("product_id = ? AND location_id = ?", count.ProductID, stocktake.LocationID).
+				Limit(1).Find(&current).Error; err != nil {
+				return err
+			}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&StocktakeLine{
+				StocktakeID: stocktake.ID,
+				ProductID:   count.ProductID,
+				Expected:    current.Quantity,
+			}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&StocktakeLine{}).
+				Where("stocktake_id = ? AND product_id = ?", stocktake.ID, count.ProductID).
+				Updates(map[string]interface{}{"expected": current.Quantity, "counted": count.Counted, "counted_at": now}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errProductNotFound) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("❌ Error recording counts:", err)
+		http.Error(w, "Error recording counts", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔢 Recorded %d count(s) on stocktake %d", len(counts), stocktake.ID)
+	writeVariances(w, stocktake.ID, false)
+}
+
+type variance struct {
+	ProductID uint `json:"product_id"`
+	Expected  int  `json:"expected"`
+	Counted   *int `json:"counted"`
+	Variance  int  `json:"variance"`
+	Posted    bool `json:"posted"`
+}
+
+func writeVariances(w http.ResponseWriter, stocktakeID uint, onlyDifferences bool) {
+	var lines []StocktakeLine
+	if err := db.Where("stocktake_id = ?", stocktakeID).Order("product_id").Find(&lines).Error; err != nil {
+		log.Println("❌ Error loading stocktake lines:", err)
+		http.Error(w, "Error loading variances", http.StatusInternalServerError)
+		return
+	}
+
+	report := struct {
+		StocktakeID uint       `json:"stocktake_id"`
+		Counted     int        `json:"counted"`
+		Uncounted   int        `json:"uncounted"`
+		Variances   []variance `json:"variances"`
+	}{StocktakeID: stocktakeID, Variances: []variance{}}
+	for _, line := range lines {
+		if line.Counted == nil {
+			report.Uncounted++
+		} else {
+			report.Counted++
+		}
+		if onlyDifferences && line.variance() == 0 {
+			continue
+		}
+		report.Variances = append(report.Variances, variance{
+			ProductID: line.ProductID,
+			Expected:  line.Expected,
+			Counted:   line.Counted,
+			Variance:  line.variance(),
+			Posted:    line.Posted,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Variances for review; ?differences=true hides lines that match
+func getVariances(w http.ResponseWriter, r *http.Request) {
+	stocktake, ok := findStocktake(w, r)
+	if !ok {
+		return
+	}
+	onlyDifferences, _ := strconv.ParseBool(r.URL.Query().Get("differences"))
+	writeVariances(w, stocktake.ID, onlyDifferences)
+}
+
+// Post approved variances as stocktake adjustments, all in one transaction,
+// and close the stocktake. Approve with {"product_ids": [...]} or
+// {"all": true}. Variances that aren't approved are not posted.
+func postStocktake(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		All        bool   `json:"all"`
+		ProductIDs []uint `json:"product_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid approval data", http.StatusBadRequest)
+		return
+	}
+
+	var stocktake Stocktake
+	var conflict error
+	posted := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&stocktake, chi.URLParam(r, "id")).Error; err != nil {
+			return err
+		}
+		if stocktake.Status != stocktakeCounting {
+			conflict = fmt.Errorf("stocktake is %s", stocktake.Status)
+			return conflict
+		}
+
+		query := tx.Where("stocktake_id = ? AND counted IS NOT NULL", stocktake.ID)
+		if !request.All {
+			query = query.Where("product_id IN ?", request.ProductIDs)
+		}
+		var lines []StocktakeLine
+		if err := query.Order("product_id").Find(&lines).Error; err != nil {
+			return err
+		}
+
+		for _, line := range lines {
+			if line.variance() != 0 {
+				if err := applyMovement(tx, StockMovement{
+					ProductID:  line.ProductID,
+					LocationID: stocktake.LocationID,
+					Quantity:   line.variance(),
+					Reason:     movementStocktake,
+					Reference:  stocktake.reference(),
+				}); err != nil {
+					return fmt.Errorf("product %d: %w", line.ProductID, err)
+				}
+				posted++
+			}
+			if err := tx.Model(&line).Update("posted", true).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&stocktake).Updates(map[string]interface{}{"status": stocktakePosted, "posted_at": time.Now()}).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		http.Error(w, "Stocktake not found", http.StatusNotFound)
+		return
+	case conflict != nil:
+		http.Error(w, conflict.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errInsufficientStock):
+		// Stock moved out since the count, more than the variance allows
+		http.Error(w, "Stocktake can't be posted: "+err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		movementError(w, err)
+		return
+	}
+
+	log.Printf("✅ Posted stocktake %d with %d adjustment(s)", stocktake.ID, posted)
+	writeVariances(w, stocktake.ID, false)
+}
+
+// Abandon a stocktake without changing stock
+func cancelStocktake(w http.ResponseWriter, r *http.Request) {
+	stocktake, ok := findStocktake(w, r)
+	if !ok {
+		return
+	}
+	if stocktake.Status != stocktakeCounting {
+		http.Error(w, "Stocktake is already "+stocktake.Status, http.StatusConflict)
+		return
+	}
+	db.Model(&stocktake).Update("status", stocktakeCancelled)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamPollInterval      = time.Second
+	streamKeepAliveInterval = 15 * time.Second
+	streamMaxProducts       = 100
+
+	// Every so often movements are re-read this far back, in case a
+	// transaction that took an earlier ID committed late
+	streamRescanInterval = 30 * time.Second
+	streamRescanWindow   = 200
+
+	// Products whose last sent availability is remembered; past this the
+	// memory starts afresh, at worst resending an unchanged value once
+	streamSentLimit = 10000
+)
+
+// stockEvent tells subscribers a product's availability changed. ID is the
+// latest stock movement behind it, so clients can resume from it.
+type stockEvent struct {
+	ID        uint `json:"-"`
+	ProductID uint `json:"product_id"`
+	Available int  `json:"available"`
+	InStock   bool `json:"in_stock"`
+}
+
+// stockHub fans movements out to SSE subscribers. It tails the movement
+// ledger, so every committed change is seen whichever path made it;
+// handlers call stockChanged to have it look straight away.
+type stockHub struct {
+	mu          sync.Mutex
+	subscribers map[chan stockEvent]map[uint]bool
+	lastID      uint
+	wake        chan struct{}
+}
+
+var hub = &stockHub{
+	subscribers: map[chan stockEvent]map[uint]bool{},
+	wake:        make(chan struct{}, 1),
+}
+
+// Called after a stock change commits
+func stockChanged() {
+	select {
+	case hub.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (h *stockHub) subscribe(productIDs map[uint]bool) chan stockEvent {
+	events := make(chan stockEvent, 64)
+	h.mu.Lock()
+	h.subscribers[events] = productIDs
+	h.mu.Unlock()
+	return events
+}
+
+func (h *stockHub) unsubscribe(events chan stockEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[events]; ok {
+		delete(h.subscribers, events)
+		close(events)
+	}
+}
+
+// Send to interested subscribers. One that can't keep up is dropped; its
+// client reconnects with Last-Event-ID and catches up.
+func (h *stockHub) broadcast(event stockEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for events, productIDs := range h.subscribers {
+		if !productIDs[event.ProductID] {
+			continue
+		}
+		select {
+		case events <- event:
+		default:
+			delete(h.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// What a storefront can sell now: bundles by their components, other
+// products by stock at active locations
+func productAvailability(productID uint) (int, error) {
+	if stock, isBundle, err := bundleStock(productID); err != nil || isBundle {
+		return stock, err
+	}
+	return availableStock(db, productID)
+}
+
+// Products whose availability moved after movement afterID, with the
+// latest movement for each. Bundles move with their components.
+func changedProducts(afterID uint, productIDs []uint) (map[uint]uint, error) {
+	var moved []struct {
+		ProductID uint
+		ID        uint
+	}
+	tx := db.Model(&StockMovement{}).
+		Select("product_id, MAX(id) AS id").
+		Where("id > ?", afterID).
+		Group("product_id")
+	if productIDs != nil {
+		tx = tx.Where(`product_id IN ? OR product_id IN (
+			SELECT component_id FROM bundle_components WHERE bundle_id IN ?)`, productIDs, productIDs)
+	}
+	if err := tx.Scan(&moved).Error; err != nil {
+		return nil, err
+	}
+
+	changed := map[uint]uint{}
+	if len(moved) == 0 {
+		return changed, nil
+	}
+	componentIDs := make([]uint, len(moved))
+	for i, m := range moved {
+		changed[m.ProductID] = max(changed[m.ProductID], m.ID)
+		componentIDs[i] = m.ProductID
+	}
+
+	var bundles []struct {
+		BundleID    uint
+		ComponentID uint
+	}
+	if err := db.Raw("SELECT bundle_id, component_id FROM bundle_components WHERE component_id IN ?", componentIDs).
+		Scan(&bundles).Error; err != nil {
+		return nil, err
+	}
+	for _, bundle := range bundles {
+		changed[bundle.BundleID] = max(changed[bundle.BundleID], changed[bundle.ComponentID])
+	}
+	return changed, nil
+}
+
+func availabilityEvent(productID, movementID uint) (stockEvent, error) {
+	available, err := productAvailability(productID)
+	if err != nil {
+		return stockEvent{}, err
+	}
+	return stockEvent{ID: movementID, ProductID: productID, Available: available, InStock: available > 0}, nil
+}
+
+// Background tailer feeding the hub. Only real changes in availability
+// are sent.
+func runStockStream() {
+	db.Model(&StockMovement{}).Select("COALESCE(MAX(id), 0)").Scan(&hub.lastID)
+	sent := map[uint]int{}
+	lastRescan := time.Now()
+
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-hub.wake:
+		}
+
+		afterID := hub.lastID
+		if time.Since(lastRescan) >= streamRescanInterval {
+			afterID -= min(afterID, streamRescanWindow)
+			lastRescan = time.Now()
+		}
+		changed, err := changedProducts(afterID, nil)
+		if err != nil {
+			log.Println("❌ Error reading stock movements for stream:", err)
+			continue
+		}
+		if len(sent)+len(changed) > streamSentLimit {
+			sent = map[uint]int{}
+		}
+		for productID, movementID := range changed {
+			event, err := availabilityEvent(productID, movementID)
+			if err != nil {
+				log.Printf("❌ Error computing availability of Product %d: %v", productID, err)
+				continue
+			}
+			hub.lastID = max(hub.lastID, movementID)
+			if previous, ok := sent[productID]; ok && previous == event.Available {
+				continue
+			}
+			sent[productID] = event.Available
+			hub.broadcast(event)
+		}
+	}
+}
+
+func writeStockEvent(w http.ResponseWriter, event stockEvent) error {
+	data, _ := json.Marshal(event)
+	_, err := fmt.Fprintf(w, "id: %d\nevent: stock\ndata: %s\n\n", event.ID, data)
+	return err
+}
+
+// Server-Sent Events stream of availability for ?product_ids=1,2,3.
+// A new client gets the current availability of each product; one
+// resuming with Last-Event-ID (header or ?last_event_id=) gets only the
+// products that changed since.
+func streamStock(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	wanted := map[uint]bool{}
+	var productIDs []uint
+	for _, raw := range strings.Split(r.URL.Query().Get("product_ids"), ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(raw), 10, 64)
+		if err != nil || id == 0 {
+			http.Error(w, "Invalid product_ids", http.StatusBadRequest)
+			return
+		}
+		if !wanted[uint(id)] {
+			wanted[uint(id)] = true
+			productIDs = append(productIDs, uint(id))
+		}
+	}
+	if len(productIDs) > streamMaxProducts {
+		http.Error(w, "Too many products", http.StatusBadRequest)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var resumeFrom uint64
+	if lastEventID != "" {
+		var err error
+		if resumeFrom, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before catching up so nothing falls in between
+	events := hub.subscribe(wanted)
+	defer hub.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	var catchUp map[uint]uint
+	if lastEventID != "" {
+		var err error
+		if catchUp, err = changedProducts(uint(resumeFrom), productIDs); err != nil {
+			log.Println("❌ Error replaying stock events:", err)
+			return
+		}
+	} else {
+		var latest uint
+		db.Model(&StockMovement{}).Select("COALESCE(MAX(id), 0)").Scan(&latest)
+		catchUp = map[uint]uint{}
+		for _, productID := range productIDs {
+			catchUp[productID] = latest
+		}
+	}
+	for productID, movementID := range catchUp {
+		if !wanted[productID] {
+			continue
+		}
+		event, err := availabilityEvent(productID, movementID)
+		if err != nil {
+			log.Printf("❌ Error computing availability of Product %d: %v", productID, err)
+			continue
+		}
+		if err := writeStockEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			if err := writeStockEvent(w, event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Valuation methods: what outgoing stock costs
+const (
+	// Oldest receipts are used up first
+	valuationFIFO = "fifo"
+	// Every unit costs the running average
+	valuationAverage = "average"
+)
+
+// Method in use, checked in main
+var valuationMethod = getEnv("VALUATION_METHOD", valuationFIFO)
+
+// Movements within the business don't change what stock is worth
+var costNeutralReasons = map[string]bool{
+	movementTransferOut: true,
+	movementTransferIn:  true,
+	movementQuarantine:  true,
+	movementRelease:     true,
+}
+
+// Movements that count towards cost of goods sold
+var cogsReasons = []string{movementOrder, movementBackorder, movementOrderCancel}
+
+// ProductCost is a product's running stock value across locations.
+// Stock on hand before costing started is valued at zero.
+type ProductCost struct {
+	ProductID    uint      `gorm:"primaryKey" json:"product_id"`
+	Quantity     int       `json:"quantity"`
+	Value        float64   `json:"value"`
+	LastUnitCost float64   `json:"last_unit_cost"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func (c ProductCost) averageCost() float64 {
+	if c.Quantity <= 0 {
+		return c.LastUnitCost
+	}
+	return c.Value / float64(c.Quantity)
+}
+
+// CostLayer is what's left of one receipt, used up oldest first
+type CostLayer struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ProductID uint      `gorm:"index" json:"product_id"`
+	UnitCost  float64   `json:"unit_cost"`
+	Quantity  int       `json:"quantity"`
+	Remaining int       `json:"remaining"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func roundCost(amount float64) float64 {
+	return math.Round(amount*10000) / 10000
+}
+
+// Called by applyMovement before recording a movement: sets its unit cost
+// and signed cost, and keeps the product's value and cost layers in step.
+// stock is the product's stock before the movement.
+func costMovement(tx *gorm.DB, movement *StockMovement, stock int) error {
+	if costNeutralReasons[movement.Reason] || movement.Quantity == 0 {
+		return nil
+	}
+
+	// First costed movement: stock already on hand becomes the oldest layer
+	created := tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&ProductCost{ProductID: movement.ProductID, Quantity: max(stock, 0)})
+	if created.Error != nil {
+		return created.Error
+	}
+	if created.RowsAffected == 1 && stock > 0 {
+		if err := tx.Create(&CostLayer{ProductID: movement.ProductID, Quantity: stock, Remaining: stock}).Error; err != nil {
+			return err
+		}
+	}
+	var cost ProductCost
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&cost, "product_id = ?", movement.ProductID).Error; err != nil {
+		return err
+	}
+
+	quantity := movement.Quantity
+	if quantity > 0 {
+		var unitCost float64
+		switch {
+		case movement.UnitCost != nil:
+			unitCost = *movement.UnitCost
+			cost.LastUnitCost = unitCost
+		default:
+			returned, ok, err := referenceUnitCost(tx, movement.ProductID, movement.Reference)
+			if err != nil {
+				return err
+			}
+			unitCost = cost.averageCost()
+			if ok {
+				unitCost = returned
+			}
+		}
+		unitCost = roundCost(unitCost)
+		movement.UnitCost = &unitCost
+		movement.Cost = roundCost(unitCost * float64(quantity))
+
+		if err := tx.Create(&CostLayer{
+			ProductID: movement.ProductID,
+			UnitCost:  unitCost,
+			Quantity:  quantity,
+			Remaining: quantity,
+		}).Error; err != nil {
+			return err
+		}
+		cost.Quantity += quantity
+		cost.Value += movement.Cost
+	} else {
+		fifoCost, err := consumeLayers(tx, movement.ProductID, -quantity, cost.averageCost())
+		if err != nil {
+			return err
+		}
+		total := fifoCost
+		if valuationMethod == valuationAverage {
+			total = cost.averageCost() * float64(-quantity)
+		}
+		unitCost := roundCost(total / float64(-quantity))
+		movement.UnitCost = &unitCost
+		movement.Cost = -roundCost(total)
+
+		cost.Quantity += quantity
+		cost.Value += movement.Cost
+		if cost.Quantity <= 0 {
+			cost.Value = 0
+		}
+	}
+
+	cost.Value = roundCost(cost.Value)
+	return tx.Model(&cost).Updates(map[string]interface{}{
+		"quantity": cost.Quantity, "value": cost.Value, "last_unit_cost": cost.LastUnitCost,
+	}).Error
+}
+
+// What a reference's outgoing stock cost per unit, so stock coming back
+// (e.g. a cancelled order) goes back in at the same cost
+func referenceUnitCost(tx *gorm.DB, productID uint, reference string) (float64, bool, error) {
+	if reference == "" {
+		return 0, false, nil
+	}
+	var out struct {
+		Quantity int
+		Cost     float64
+	}
+	if err := tx.Model(&StockMovement{}).
+		Select("COALESCE(-SUM(quantity), 0) AS quantity, COALESCE(-SUM(cost), 0) AS cost").
+		Where("product_id = ? AND reference = ? AND quantity < 0 AND unit_cost IS NOT NULL", productID, reference).
+		Scan(&out).Error; err != nil {
+		return 0, false, err
+	}
+	if out.Quantity <= 0 {
+		return 0, false, nil
+	}
+	return out.Cost / float64(out.Quantity), true, nil
+}
+
+// Use up quantity from the oldest layers and return their cost. Units with
+// no layer left (stock from before costing) cost fallback.
+func consumeLayers(tx *gorm.DB, productID uint, quantity int, fallback float64) (float64, error) {
+	var layers []CostLayer
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("product_id = ? AND remaining > 0", productID).
+		Order("id").
+		Find(&layers).Error; err != nil {
+		return 0, err
+	}
+
+	total := 0.0
+	for _, layer := range layers {
+		if quantity == 0 {
+			break
+		}
+		take := min(layer.Remaining, quantity)
+		if err := tx.Model(&layer).Update("remaining", layer.Remaining-take).Error; err != nil {
+			return 0, err
+		}
+		total += layer.UnitCost * float64(take)
+		quantity -= take
+	}
+	return total + fallback*float64(quantity), nil
+}
+
+// Parse a date or timestamp query parameter
+func parseTime(raw string, fallback time.Time) (time.Time, bool) {
+	if raw == "" {
+		return fallback, true
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, true
+	}
+	// A bare date means the end of that day
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), true
+	}
+	return time.Time{}, false
+}
+
+// Stock value per product as of ?as_of= (a date or RFC 3339 time, default
+// now), from the costed movement ledger
+func valuationReport(w http.ResponseWriter, r *http.Request) {
+	asOf, ok := parseTime(r.URL.Query().Get("as_of"), time.Now())
+	if !ok {
+		http.Error(w, "Invalid as_of", http.StatusBadRequest)
+		return
+	}
+
+	neutral := make([]string, 0, len(costNeutralReasons))
+	for reason := range costNeutralReasons {
+		neutral = append(neutral, reason)
+	}
+
+	type row struct {
+		ProductID uint    `json:"product_id"`
+		Quantity  int     `json:"quantity"`
+		Value     float64 `json:"value"`
+		UnitCost  float64 `json:"unit_cost"`
+	}
+	rows := []row{}
+	tx := db.Model(&StockMovement{}).
+		Select("product_id, SUM(quantity) AS quantity, COALESCE(SUM(cost), 0) AS value").
+		Where("created_at <= ? AND reason NOT IN ?", asOf, neutral).
+		Group("product_id").
+		Having("SUM(quantity) <> 0 OR COALESCE(SUM(cost), 0) <> 0").
+		Order("product_id")
+	if productID := r.URL.Query().Get("product_id"); productID != "" {
+		tx = tx.Where("product_id = ?", productID)
+	}
+	if err := tx.Scan(&rows).Error; err != nil {
+		log.Println("❌ Error computing valuation:", err)
+		http.Error(w, "Error computing valuation", http.StatusInternalServerError)
+		return
+	}
+
+	total := 0.0
+	for i := range rows {
+		rows[i].Value = roundCost(rows[i].Value)
+		if rows[i].Quantity > 0 {
+			rows[i].UnitCost = roundCost(rows[i].Value / float64(rows[i].Quantity))
+		}
+		total += rows[i].Value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"as_of":       asOf,
+		"method":      valuationMethod,
+		"total_value": roundCost(total),
+		"products":    rows,
+	})
+}
+
+// Cost of goods sold: what order stock cost, net of cancellations, for a
+// ?reference= or between ?from= and ?to=
+func costOfGoodsSold(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, okFrom := parseTime(query.Get("from"), time.Time{})
+	to, okTo := parseTime(query.Get("to"), time.Now())
+	if !okFrom || !okTo {
+		http.Error(w, "Invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	tx := db.Model(&StockMovement{}).
+		Select("product_id, -SUM(quantity) AS quantity, -COALESCE(SUM(cost), 0) AS cost").
+		Where("reason IN ? AND created_at BETWEEN ? AND ?", cogsReasons, from, to).
+		Group("product_id").
+		Order("product_id")
+	if reference := query.Get("reference"); reference != "" {
+		tx = tx.Where("reference = ?", reference)
+	}
+
+	type row struct {
+		ProductID uint    `json:"product_id"`
+		Quantity  int     `json:"quantity"`
+		Cost      float64 `json:"cost"`
+	}
+	rows := []row{}
+	if err := tx.Scan(&rows).Error; err != nil {
+		log.Println("❌ Error computing COGS:", err)
+		http.Error(w, "Error computing cost of goods sold", http.StatusInternalServerError)
+		return
+	}
+	total := 0.0
+	for i := range rows {
+		rows[i].Cost = roundCost(rows[i].Cost)
+		total += rows[i].Cost
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"method":   valuationMethod,
+		"total":    roundCost(total),
+		"products": rows,
+	})
+}
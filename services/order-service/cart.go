@@ -0,0 +1,456 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ecommerce/pkg/money"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// Cart is a shopper's cart. Signed-in customers have one cart by email;
+// guests are identified by the token they get back when their cart is
+// created, sent as X-Cart-Token.
+type Cart struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Email     string     `gorm:"index" json:"-"`
+	Token     string     `gorm:"uniqueIndex" json:"token,omitempty"`
+	Currency  string     `gorm:"size:3" json:"currency"`
+	Items     []CartItem `gorm:"foreignKey:CartID;constraint:OnDelete:CASCADE" json:"items"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// CartItem remembers the price the shopper saw, so checkout can tell them
+// when it changed
+type CartItem struct {
+	ID        uint    `gorm:"primaryKey" json:"-"`
+	CartID    uint    `gorm:"uniqueIndex:idx_cart_items_cart_product" json:"-"`
+	ProductID uint    `gorm:"uniqueIndex:idx_cart_items_cart_product" json:"product_id"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+}
+
+// Address to ship an order to
+type Address struct {
+	Name       string `gorm:"size:128" json:"name"`
+	Line1      string `gorm:"size:256" json:"line1"`
+	Line2      string `gorm:"size:256" json:"line2,omitempty"`
+	City       string `gorm:"size:128" json:"city"`
+	Region     string `gorm:"size:128" json:"region,omitempty"`
+	PostalCode string `gorm:"size:32" json:"postal_code"`
+	Country    string `gorm:"size:2" json:"country"` // ISO 3166-1 alpha-2
+}
+
+func (a Address) valid() bool {
+	return strings.TrimSpace(a.Name) != "" && strings.TrimSpace(a.Line1) != "" &&
+		strings.TrimSpace(a.City) != "" && strings.TrimSpace(a.PostalCode) != "" && len(a.Country) == 2
+}
+
+// Shipping methods and what they cost per currency. A method without a
+// price in the order's currency can't be used for it; nil means free.
+var shippingMethods = map[string]map[string]float64{
+	"standard": {"USD": 5, "EUR": 5, "GBP": 4},
+	"express":  {"USD": 15, "EUR": 14, "GBP": 12},
+	"pickup":   nil,
+}
+
+func shippingCost(method, currency string) (float64, bool) {
+	prices, ok := shippingMethods[method]
+	if !ok {
+		return 0, false
+	}
+	if prices == nil {
+		return 0, true
+	}
+	price, ok := prices[currency]
+	return price, ok
+}
+
+// Problems found when validating a cart
+const (
+	cartIssueUnavailable       = "unavailable"
+	cartIssuePriceChanged      = "price_changed"
+	cartIssueInsufficientStock = "insufficient_stock"
+)
+
+type cartIssue struct {
+	ProductID uint   `json:"product_id"`
+	Type      string `json:"type"`
+	Message   string `json:"message"`
+}
+
+type cartLineView struct {
+	ProductID uint    `json:"product_id"`
+	Name      string  `json:"name"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+	LineTotal float64 `json:"line_total"`
+	Available *int    `json:"available,omitempty"` // physical products only
+}
+
+// cartView is a cart priced and checked against the catalog and inventory
+type cartView struct {
+	ID       uint           `json:"id,omitempty"`
+	Token    string         `json:"token,omitempty"`
+	Currency string         `json:"currency"`
+	Items    []cartLineView `json:"items"`
+	Subtotal float64        `json:"subtotal"`
+	Issues   []cartIssue    `json:"issues"`
+}
+
+func newCartToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// The caller's cart: by email when signed in, otherwise by X-Cart-Token.
+// With create, a missing cart is made. Returns nil if there is none.
+func loadCart(r *http.Request, create bool) (*Cart, error) {
+	var cart Cart
+	email := optionalEmail(r)
+	token := r.Header.Get("X-Cart-Token")
+
+	tx := db.Preload("Items", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") })
+	var err error
+	switch {
+	case email != "":
+		err = tx.Where("email = ?", email).First(&cart).Error
+	case token != "":
+		err = tx.Where("token = ? AND email = ''", token).First(&cart).Error
+	default:
+		err = gorm.ErrRecordNotFound
+	}
+	if err == nil {
+		return &cart, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if !create {
+		return nil, nil
+	}
+
+	cart = Cart{Email: email, Token: newCartToken()}
+	if err := db.Create(&cart).Error; err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// Price a cart at current prices and check availability
+func validateCart(cart *Cart, customerGroup string) cartView {
+	view := cartView{Items: []cartLineView{}, Issues: []cartIssue{}}
+	if cart == nil {
+		return view
+	}
+	view.ID = cart.ID
+	view.Currency = cart.Currency
+	if cart.Email == "" {
+		view.Token = cart.Token
+	}
+
+	var subtotal float64
+	for _, item := range cart.Items {
+		line := cartLineView{ProductID: item.ProductID, Quantity: item.Quantity, UnitPrice: item.UnitPrice}
+		product, err := fetchProduct(item.ProductID, cart.Currency, customerGroup)
+		if err != nil {
+			view.Issues = append(view.Issues, cartIssue{item.ProductID, cartIssueUnavailable, "Product is no longer available"})
+			view.Items = append(view.Items, line)
+			continue
+		}
+		line.Name = product.Name
+		line.UnitPrice = product.EffectivePrice
+		if product.EffectivePrice != item.UnitPrice {
+			view.Issues = append(view.Issues, cartIssue{item.ProductID, cartIssuePriceChanged, "Price has changed since the product was added"})
+		}
+
+		if product.Type != "digital" {
+			available, err := fetchAvailability(item.ProductID)
+			if err != nil {
+				log.Printf("⚠️ Could not check stock of product %d: %v", item.ProductID, err)
+			} else {
+				line.Available = &available
+				if available < item.Quantity {
+					view.Issues = append(view.Issues, cartIssue{item.ProductID, cartIssueInsufficientStock, "Not enough stock; the item may be backordered"})
+				}
+			}
+		}
+
+		line.LineTotal = money.Round(line.UnitPrice*float64(item.Quantity), cart.Currency)
+		subtotal += line.LineTotal
+		view.Items = append(view.Items, line)
+	}
+	view.Subtotal = money.Round(subtotal, cart.Currency)
+	return view
+}
+
+func writeCart(w http.ResponseWriter, r *http.Request, status int, cart *Cart) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(validateCart(cart, customerGroup(r)))
+}
+
+func getCart(w http.ResponseWriter, r *http.Request) {
+	cart, err := loadCart(r, false)
+	if err != nil {
+		log.Println("❌ Error loading cart:", err)
+		http.Error(w, "Error loading cart", http.StatusInternalServerError)
+		return
+	}
+	writeCart(w, r, http.StatusOK, cart)
+}
+
+// Add a product to the cart, creating the cart if needed. The response
+// carries the guest token for new guest carts.
+func addCartItem(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		orderLine
+		Currency string `json:"currency,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Quantity <= 0 {
+		http.Error(w, "Invalid cart item", http.StatusBadRequest)
+		return
+	}
+
+	cart, err := loadCart(r, true)
+	if err != nil {
+		log.Println("❌ Error loading cart:", err)
+		http.Error(w, "Error loading cart", http.StatusInternalServerError)
+		return
+	}
+
+	currency := cart.Currency
+	if currency == "" {
+		currency = strings.ToUpper(request.Currency)
+	}
+	product, err := fetchProduct(request.ProductID, currency, customerGroup(r))
+	if err != nil {
+		http.Error(w, "Product unavailable", http.StatusBadRequest)
+		return
+	}
+	if cart.Currency == "" {
+		cart.Currency = product.Currency
+		db.Model(cart).Update("currency", cart.Currency)
+	}
+
+	item := CartItem{CartID: cart.ID, ProductID: request.ProductID}
+	db.Where(item).FirstOrInit(&item)
+	item.Quantity += request.Quantity
+	item.UnitPrice = product.EffectivePrice
+	if err := db.Save(&item).Error; err != nil {
+		log.Println("❌ Error saving cart item:", err)
+		http.Error(w, "Error saving cart", http.StatusInternalServerError)
+		return
+	}
+
+	cart, _ = loadCart(withCartToken(r, cart), false)
+	writeCart(w, r, http.StatusOK, cart)
+}
+
+// Requests after a cart was just created need its token to find it again
+func withCartToken(r *http.Request, cart *Cart) *http.Request {
+	if cart.Email == "" {
+		r.Header.Set("X-Cart-Token", cart.Token)
+	}
+	return r
+}
+
+// Set an item's quantity; 0 removes it
+func updateCartItem(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(chi.URLParam(r, "productID"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	var request struct {
+		Quantity int `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Quantity < 0 {
+		http.Error(w, "Invalid quantity", http.StatusBadRequest)
+		return
+	}
+
+	cart, err := loadCart(r, false)
+	if err != nil || cart == nil {
+		http.Error(w, "Cart not found", http.StatusNotFound)
+		return
+	}
+
+	var item CartItem
+	if err := db.Where("cart_id = ? AND product_id = ?", cart.ID, productID).First(&item).Error; err != nil {
+		http.Error(w, "Item not in cart", http.StatusNotFound)
+		return
+	}
+	if request.Quantity == 0 {
+		db.Delete(&item)
+	} else {
+		db.Model(&item).Update("quantity", request.Quantity)
+	}
+
+	cart, _ = loadCart(r, false)
+	writeCart(w, r, http.StatusOK, cart)
+}
+
+func removeCartItem(w http.ResponseWriter, r *http.Request) {
+	cart, err := loadCart(r, false)
+	if err != nil || cart == nil {
+		http.Error(w, "Cart not found", http.StatusNotFound)
+		return
+	}
+	db.Where("cart_id = ? AND product_id = ?", cart.ID, chi.URLParam(r, "productID")).Delete(&CartItem{})
+
+	cart, _ = loadCart(r, false)
+	writeCart(w, r, http.StatusOK, cart)
+}
+
+// Customer: after signing in, move the guest cart (X-Cart-Token) into the
+// customer's cart, adding up quantities
+func mergeCart(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("X-Cart-Token")
+	var guest Cart
+	if token == "" || db.Preload("Items").Where("token = ? AND email = ''", token).First(&guest).Error != nil {
+		cart, _ := loadCart(r, false)
+		writeCart(w, r, http.StatusOK, cart)
+		return
+	}
+
+	cart, err := loadCart(r, true)
+	if err != nil {
+		log.Println("❌ Error loading cart:", err)
+		http.Error(w, "Error loading cart", http.StatusInternalServerError)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if cart.Currency == "" && guest.Currency != "" {
+			cart.Currency = guest.Currency
+			if err := tx.Model(cart).Update("currency", cart.Currency).Error; err != nil {
+				return err
+			}
+		}
+		for _, guestItem := range guest.Items {
+			item := CartItem{CartID: cart.ID, ProductID: guestItem.ProductID}
+			if err := tx.Where(item).FirstOrInit(&item).Error; err != nil {
+				return err
+			}
+			if item.ID == 0 {
+				item.UnitPrice = guestItem.UnitPrice
+			}
+			item.Quantity += guestItem.Quantity
+			if err := tx.Save(&item).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("cart_id = ?", guest.ID).Delete(&CartItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&guest).Error
+	})
+	if err != nil {
+		log.Println("❌ Error merging carts:", err)
+		http.Error(w, "Error merging carts", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🛒 Guest cart %d merged into %s's cart", guest.ID, cart.Email)
+	cart, _ = loadCart(r, false)
+	writeCart(w, r, http.StatusOK, cart)
+}
+
+// Turn the cart into an order. If a product became unavailable or its
+// price changed, nothing is ordered: the cart is returned with its issues
+// (409) and the new prices are remembered, so checking out again accepts
+// them.
+func checkout(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email           string  `json:"email,omitempty"` // guests
+		ShippingMethod  string  `json:"shipping_method"`
+		ShippingAddress Address `json:"shipping_address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid checkout data", http.StatusBadRequest)
+		return
+	}
+	request.ShippingAddress.Country = strings.ToUpper(request.ShippingAddress.Country)
+	if _, ok := shippingMethods[request.ShippingMethod]; !ok {
+		http.Error(w, "Unknown shipping method", http.StatusBadRequest)
+		return
+	}
+	if request.ShippingMethod != "pickup" && !request.ShippingAddress.valid() {
+		http.Error(w, "A complete shipping address is required", http.StatusBadRequest)
+		return
+	}
+
+	email := optionalEmail(r)
+	if email == "" {
+		if request.Email == "" {
+			http.Error(w, "Guest users must provide an email", http.StatusBadRequest)
+			return
+		}
+		email = request.Email
+	}
+
+	cart, err := loadCart(r, false)
+	if err != nil || cart == nil || len(cart.Items) == 0 {
+		http.Error(w, "Cart is empty", http.StatusBadRequest)
+		return
+	}
+
+	// Show the shopper the cart as it now stands, accepting its prices
+	conflict := func(view cartView) {
+		for _, line := range view.Items {
+			db.Model(&CartItem{}).Where("cart_id = ? AND product_id = ?", cart.ID, line.ProductID).Update("unit_price", line.UnitPrice)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(view)
+	}
+
+	view := validateCart(cart, customerGroup(r))
+	for _, issue := range view.Issues {
+		if issue.Type != cartIssueInsufficientStock {
+			conflict(view)
+			return
+		}
+	}
+
+	// The order is priced afresh; it must come to what the cart showed
+	lines := make([]orderLine, len(cart.Items))
+	for i, item := range cart.Items {
+		lines[i] = orderLine{ProductID: item.ProductID, Quantity: item.Quantity, ShownPrice: &cart.Items[i].UnitPrice}
+	}
+	order, err := placeOrder(Order{
+		Email:           email,
+		Currency:        cart.Currency,
+		ShippingMethod:  request.ShippingMethod,
+		ShippingAddress: request.ShippingAddress,
+	}, lines, customerGroup(r))
+	if errors.Is(err, errPriceChanged) {
+		// The fresh price is in the product cache now, so validating again
+		// reports it
+		conflict(validateCart(cart, customerGroup(r)))
+		return
+	}
+	if err != nil {
+		placeOrderError(w, err)
+		return
+	}
+
+	db.Where("cart_id = ?", cart.ID).Delete(&CartItem{})
+	db.Delete(cart)
+	log.Printf("🛒 Checked out cart %d as order %d", cart.ID, order.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(order)
+}
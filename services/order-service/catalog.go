@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Base URL of Product Service
+const productServiceURL = "http://product-service:8083"
+
+// HTTP client for calls to other services
+var httpClient = &http.Client{Timeout: 5 * time.Second}
+
+// The parts of a Product Service product that orders care about
+type catalogProduct struct {
+	ID             uint    `json:"id"`
+	Name           string  `json:"name"`
+	Type           string  `json:"type"`
+	Currency       string  `json:"currency"`
+	EffectivePrice float64 `json:"effective_price"`
+	PriceSource    string  `json:"price_source"`
+
+	Components []struct {
+		ProductID uint `json:"product_id"`
+		Quantity  int  `json:"quantity"`
+	} `json:"components"` // bundles only
+}
+
+// Catalog change events published by Product Service
+const (
+	catalogStream        = "catalog.events"
+	catalogSchemaVersion = 1
+)
+
+// Products fetched recently, keyed by product, currency and customer group.
+// Entries are dropped when Product Service announces a change, and expire
+// regardless because effective prices move with sale windows.
+const productCacheTTL = 30 * time.Second
+
+type cachedProduct struct {
+	product   catalogProduct
+	fetchedAt time.Time
+}
+
+var productCache = struct {
+	sync.Mutex
+	entries map[uint]map[string]cachedProduct
+}{entries: map[uint]map[string]cachedProduct{}}
+
+// Fetch a product with the price it sells for right now to customerGroup,
+// in currency (or the catalog's base currency when empty). Good enough for
+// showing carts; orders are priced with fetchFreshProduct.
+func fetchProduct(productID uint, currency, customerGroup string) (catalogProduct, error) {
+	cacheKey := currency + "|" + customerGroup
+	productCache.Lock()
+	entry, ok := productCache.entries[productID][cacheKey]
+	productCache.Unlock()
+	if ok && time.Since(entry.fetchedAt) < productCacheTTL {
+		return entry.product, nil
+	}
+
+	product, err := fetchProductFromService(productID, currency, customerGroup, false)
+	if err != nil {
+		return product, err
+	}
+	cacheProduct(productID, cacheKey, product)
+	return product, nil
+}
+
+// Like fetchProduct, but past both our cache and Product Service's, so an
+// order never goes out at a price that has just changed
+func fetchFreshProduct(productID uint, currency, customerGroup string) (catalogProduct, error) {
+	product, err := fetchProductFromService(productID, currency, customerGroup, true)
+	if err != nil {
+		return product, err
+	}
+	cacheProduct(productID, currency+"|"+customerGroup, product)
+	return product, nil
+}
+
+func cacheProduct(productID uint, cacheKey string, product catalogProduct) {
+	productCache.Lock()
+	if productCache.entries[productID] == nil {
+		productCache.entries[productID] = map[string]cachedProduct{}
+	}
+	productCache.entries[productID][cacheKey] = cachedProduct{product: product, fetchedAt: time.Now()}
+	productCache.Unlock()
+}
+
+func fetchProductFromService(productID uint, currency, customerGroup string, fresh bool) (catalogProduct, error) {
+	var product catalogProduct
+
+	endpoint := fmt.Sprintf("%s/products/%d", productServiceURL, productID)
+	if currency != "" {
+		endpoint += "?" + url.Values{"currency": {currency}}.Encode()
+	}
+
+	// Product Service only takes the group, and skips its cache, for callers
+	// it trusts
+	req, err := newInternalRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return product, err
+	}
+	if customerGroup != "" {
+		req.Header.Set(customerGroupHeader, customerGroup)
+	}
+	if fresh {
+		req.Header.Set("Cache-Control", "no-cache")
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return product, fmt.Errorf("contacting Product Service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return product, fmt.Errorf("product %d not found", productID)
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		return product, fmt.Errorf("product %d can't be priced in %s", productID, currency)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return product, fmt.Errorf("product service returned %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&product); err != nil {
+		return product, fmt.Errorf("decoding product %d: %w", productID, err)
+	}
+	return product, nil
+}
+
+// Forget cached products as catalog events arrive. Every replica keeps its
+// own cache, so each one reads the whole stream rather than joining a group.
+func watchCatalogEvents() {
+	ctx := context.Background()
+	position := "$"
+	for {
+		streams, err := rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{catalogStream, position},
+			Count:   100,
+			Block:   5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Println("❌ Error reading catalog events:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, message := range stream.Messages {
+				position = message.ID
+				version, _ := strconv.Atoi(fmt.Sprint(message.Values["schema_version"]))
+				if version != catalogSchemaVersion {
+					continue
+				}
+
+				productCache.Lock()
+				if message.Values["type"] == "catalog.invalidated" {
+					productCache.entries = map[uint]map[string]cachedProduct{}
+				} else if id, err := strconv.ParseUint(fmt.Sprint(message.Values["product_id"]), 10, 64); err == nil {
+					delete(productCache.entries, uint(id))
+				}
+				productCache.Unlock()
+			}
+		}
+	}
+}
+
+// License keys and download links Product Service handed over for one
+// order item
+type digitalDelivery struct {
+	OrderItemID       uint       `json:"order_item_id"`
+	ProductID         uint       `json:"product_id"`
+	LicenseKeys       []string   `json:"license_keys"`
+	PendingKeys       int        `json:"pending_keys,omitempty"`
+	Downloads         []download `json:"downloads"`
+	DownloadsExpireAt *time.Time `json:"downloads_expire_at,omitempty"`
+}
+
+type download struct {
+	FileID   uint   `json:"file_id"`
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
+}
+
+// Ask Product Service to deliver the digital items of a paid order.
+// Product Service ignores items it has already delivered.
+func deliverDigitalItems(orderID uint, items []OrderItem) ([]digitalDelivery, error) {
+	type deliveryItem struct {
+		OrderItemID uint `json:"order_item_id"`
+		ProductID   uint `json:"product_id"`
+		Quantity    int  `json:"quantity"`
+	}
+	var digital []deliveryItem
+	for _, item := range items {
+		if item.isDigital() {
+			digital = append(digital, deliveryItem{OrderItemID: item.ID, ProductID: item.ProductID, Quantity: item.Quantity})
+		}
+	}
+	if len(digital) == 0 {
+		return nil, nil
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"order_id": orderID, "items": digital})
+	req, err := newInternalRequest(http.MethodPost, productServiceURL+"/digital/deliveries", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("contacting Product Service: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("product service returned %d", resp.StatusCode)
+	}
+
+	var deliveries []digitalDelivery
+	if err := json.NewDecoder(resp.Body).Decode(&deliveries); err != nil {
+		return nil, fmt.Errorf("decoding deliveries: %w", err)
+	}
+	log.Printf("📬 Delivered %d digital item(s) for order %d", len(deliveries), orderID)
+	return deliveries, nil
+}
+
+// Current keys and freshly signed download links, by order item ID
+func fetchDeliveries(orderItemIDs []uint) (map[uint]digitalDelivery, error) {
+	byItem := map[uint]digitalDelivery{}
+	if len(orderItemIDs) == 0 {
+		return byItem, nil
+	}
+
+	ids := make([]string, len(orderItemIDs))
+	for i, id := range orderItemIDs {
+		ids[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	endpoint := productServiceURL + "/digital/deliveries?" + url.Values{"order_item_ids": {strings.Join(ids, ",")}}.Encode()
+	req, err := newInternalRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return byItem, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return byItem, fmt.Errorf("contacting Product Service: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return byItem, fmt.Errorf("product service returned %d", resp.StatusCode)
+	}
+
+	var deliveries []digitalDelivery
+	if err := json.NewDecoder(resp.Body).Decode(&deliveries); err != nil {
+		return byItem, fmt.Errorf("decoding deliveries: %w", err)
+	}
+	for _, delivery := range deliveries {
+		byItem[delivery.OrderItemID] = delivery
+	}
+	return byItem, nil
+}
+
+// Hand over the digital items of a paid order and remember that it's done.
+// Orders that aren't paid for get nothing.
+func deliverPaidOrder(orderID uint) error {
+	var order Order
+	if err := db.Select("status").First(&order, "id = ?", orderID).Error; err != nil {
+		return err
+	}
+	if !isPurchased(order.Status) {
+		return nil
+	}
+	var items []OrderItem
+	if err := db.Where("order_id = ?", orderID).Find(&items).Error; err != nil {
+		return err
+	}
+	if _, err := deliverDigitalItems(orderID, items); err != nil {
+		log.Printf("❌ Error delivering digital items for order %d: %v", orderID, err)
+		return err
+	}
+	return db.Model(&Order{}).Where("id = ?", orderID).Update("digital_delivered", true).Error
+}
+
+const (
+	deliveryPollInterval = time.Minute
+	deliveryBatchSize    = 50
+)
+
+var deliveryWake = make(chan struct{}, 1)
+
+func wakeDeliveryWorker() {
+	select {
+	case deliveryWake <- struct{}{}:
+	default:
+	}
+}
+
+// Background worker for paid orders whose digital items haven't gone out,
+// either because they were paid by webhook or a delivery failed
+func runDeliveryWorker() {
+	ticker := time.NewTicker(deliveryPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-deliveryWake:
+		}
+		var orderIDs []uint
+		err := db.Model(&Order{}).
+			Where("status IN ? AND NOT digital_delivered", purchasedStatuses).
+			Where("EXISTS (SELECT 1 FROM order_items WHERE order_items.order_id = orders.id AND order_items.product_type = ?)", "digital").
+			Order("id").
+			Limit(deliveryBatchSize).
+			Pluck("id", &orderIDs).Error
+		if err != nil {
+			log.Println("❌ Error finding orders to deliver:", err)
+			continue
+		}
+		for _, orderID := range orderIDs {
+			deliverPaidOrder(orderID)
+		}
+	}
+}
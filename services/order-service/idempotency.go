@@ -0,0 +1,14 @@
+package main
+
+import (
+	"net/http"
+
+	"ecommerce/pkg/idempotency"
+)
+
+// Requests sent with an Idempotency-Key header, answered once. Set up in main.
+var idempotencyKeys *idempotency.Store
+
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return idempotencyKeys.Middleware(next)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+)
+
+// Header services authenticate internal calls with
+const internalKeyHeader = "X-Internal-Key"
+
+// Customer group an internal caller is asking prices for
+const customerGroupHeader = "X-Customer-Group"
+
+// Shared secret for service-to-service calls
+var internalAPIKey = getEnv("INTERNAL_API_KEY", "")
+
+// Build a request to another service's internal endpoint
+func newInternalRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(internalKeyHeader, internalAPIKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// Middleware: only other services, which send the internal key
+func internalOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(internalKeyHeader)), []byte(internalAPIKey)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Base URL of Inventory Service
+const inventoryServiceURL = "http://inventory-service:8082"
+
+var errOutOfStock = errors.New("out of stock")
+
+type stockChange struct {
+	ProductID uint `json:"product_id"`
+	Change    int  `json:"change"`
+}
+
+// Stock reference for an order; Inventory Service uses it to put stock
+// back where it was taken from
+func orderReference(orderID uint) string {
+	return fmt.Sprintf("order:%d", orderID)
+}
+
+// Stock an order takes: physical items, and the components of bundles.
+// Digital items have none.
+func orderStockChanges(items []OrderItem) []stockChange {
+	var changes []stockChange
+	for _, item := range items {
+		switch {
+		case item.isBundle():
+			var components []OrderItemComponent
+			db.Where("order_item_id = ?", item.ID).Find(&components)
+			for _, component := range components {
+				changes = append(changes, stockChange{ProductID: component.ProductID, Change: -component.Quantity})
+			}
+		case !item.isDigital():
+			changes = append(changes, stockChange{ProductID: item.ProductID, Change: -item.Quantity})
+		}
+	}
+	return changes
+}
+
+// A stock update Inventory Service may or may not have applied: it couldn't
+// be reached or it failed, even after retrying
+var errStockUnknown = errors.New("stock update outcome unknown")
+
+const stockUpdateAttempts = 3
+
+type stockUpdate struct {
+	Reference      string        `json:"reference"`
+	Items          []stockChange `json:"items"`
+	AllowBackorder bool          `json:"allow_backorder"`
+	TakenOnly      bool          `json:"taken_only"`
+}
+
+// Update stock in Inventory Service, which picks the locations. Either every
+// change is applied or none is. With AllowBackorder, products whose policy
+// allows it may be short; reports whether anything was backordered.
+// idempotencyKey makes a retried call apply only once, so transport errors
+// and server errors are retried; a conflict on a retry is the first attempt
+// still running. Once out of attempts the error wraps errStockUnknown.
+func updateStock(idempotencyKey string, update stockUpdate) (bool, error) {
+	if len(update.Items) == 0 {
+		return false, nil
+	}
+
+	body, _ := json.Marshal(update)
+	var lastErr error
+	for attempt := 0; attempt < stockUpdateAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<uint(attempt-1)) * 250 * time.Millisecond)
+		}
+		req, _ := http.NewRequest(http.MethodPost, inventoryServiceURL+"/inventory/update", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			lastErr = fmt.Errorf("contacting Inventory Service: %w", err)
+			continue
+		}
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return false, nil
+		case resp.StatusCode == http.StatusAccepted:
+			return true, nil
+		case resp.StatusCode == http.StatusBadRequest:
+			return false, errOutOfStock
+		case resp.StatusCode >= 500 || (resp.StatusCode == http.StatusConflict && attempt > 0):
+			lastErr = fmt.Errorf("inventory service returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+			continue
+		}
+		return false, fmt.Errorf("inventory service returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return false, fmt.Errorf("%w: %v", errStockUnknown, lastErr)
+}
+
+// Take stock for a new order; reports whether part of it is backordered
+func reserveStock(orderID uint, items []OrderItem) (bool, error) {
+	reference := orderReference(orderID)
+	return updateStock(reference+":reserve", stockUpdate{Reference: reference, Items: orderStockChanges(items), AllowBackorder: true})
+}
+
+// Give back the stock an order took, and no more, so it's also safe when
+// the reservation may not have happened. Inventory Service drops whatever
+// was still backordered.
+func restoreStock(orderID uint, items []OrderItem) error {
+	changes := orderStockChanges(items)
+	for i := range changes {
+		changes[i].Change = -changes[i].Change
+	}
+	reference := orderReference(orderID)
+	_, err := updateStock(reference+":restore", stockUpdate{Reference: reference, Items: changes, TakenOnly: true})
+	return err
+}
+
+// Serials fulfilled for one order item, none for untracked products
+type itemSerials struct {
+	OrderItemID uint     `json:"order_item_id"`
+	ProductID   uint     `json:"product_id"`
+	Quantity    int      `json:"quantity"`
+	Serials     []string `json:"serials"`
+}
+
+// Serials Inventory Service refused, with its reason
+type serialsRejectedError struct{ message string }
+
+func (e serialsRejectedError) Error() string { return e.message }
+
+// Record in Inventory Service which units went to which order items
+func assignSerials(orderID uint, items []itemSerials) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"reference": orderReference(orderID), "items": items})
+	resp, err := httpClient.Post(inventoryServiceURL+"/serials/assign", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("contacting Inventory Service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode == http.StatusConflict {
+		return serialsRejectedError{strings.TrimSpace(string(message))}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("inventory service returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// Units of a product Inventory Service can sell now
+func fetchAvailability(productID uint) (int, error) {
+	resp, err := httpClient.Get(fmt.Sprintf("%s/inventory?product_id=%d", inventoryServiceURL, productID))
+	if err != nil {
+		return 0, fmt.Errorf("contacting Inventory Service: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("inventory service returned %d", resp.StatusCode)
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	var available int
+	if _, err := fmt.Sscanf(string(body), "Stock disponible: %d", &available); err != nil {
+		return 0, fmt.Errorf("unexpected stock response %q", body)
+	}
+	return available, nil
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 
+	"ecommerce/pkg/idempotency"
+	"ecommerce/pkg/money"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors" // ✅ Import cors middleware
 	"github.com/go-redis/redis/v8"
@@ -24,29 +30,73 @@ var (
 // JWT Secret Key
 var jwtSecret = []byte("your_secret_key")
 
-// Order Model
+// Order Model. Total is Subtotal plus ShippingCost; orders placed directly
+// rather than through checkout have no shipping.
 type Order struct {
-	ID       uint        `gorm:"primaryKey"`
-	Email    string      `json:"email"`
-	Products []OrderItem `gorm:"foreignKey:OrderID"`
-	Status   string      `gorm:"index"`
+	ID              uint        `gorm:"primaryKey"`
+	Email           string      `json:"email"`
+	Products        []OrderItem `gorm:"foreignKey:OrderID"`
+	Status          string      `gorm:"index"`
+	Subtotal        float64
+	ShippingCost    float64
+	Total           float64
+	Currency        string  `gorm:"size:3"`
+	ShippingMethod  string  `gorm:"size:32"`
+	ShippingAddress Address `gorm:"embedded;embeddedPrefix:shipping_"`
+	// Set once its digital items have been handed over
+	DigitalDelivered bool `gorm:"not null;default:false"`
 }
 
-// OrderItem Model
+// OrderItem Model. UnitPrice and ProductType are snapshots from when the
+// order was placed.
 type OrderItem struct {
-	ID        uint `gorm:"primaryKey"`
-	OrderID   uint
-	ProductID uint
-	Quantity  int
+	ID          uint `gorm:"primaryKey"`
+	OrderID     uint
+	ProductID   uint
+	Quantity    int
+	UnitPrice   float64
+	ProductType string `gorm:"size:16;not null;default:physical"`
 }
 
+// Digital items have no stock to reserve or restore
+func (item OrderItem) isDigital() bool {
+	return item.ProductType == "digital"
+}
+
+// Bundle items take their stock from the components
+func (item OrderItem) isBundle() bool {
+	return item.ProductType == "bundle"
+}
+
+// OrderItemComponent is a snapshot of one component of a bundle item, so
+// cancelling restores what was taken even if the bundle changed since.
+// Quantity is the total for the item (component quantity × item quantity).
+type OrderItemComponent struct {
+	ID          uint `gorm:"primaryKey"`
+	OrderItemID uint `gorm:"index"`
+	ProductID   uint
+	Quantity    int
+}
+
+// Order statuses that count as a completed purchase
+var purchasedStatuses = []string{"PAID", "CONFIRMED", "FULFILLED"}
+
 // JWT Claims
 type Claims struct {
-	Email string `json:"email"`
-	Role  string `json:"role"`
+	Email         string `json:"email"`
+	Role          string `json:"role"`
+	CustomerGroup string `json:"customer_group,omitempty"` // picks a price list
 	jwt.RegisteredClaims
 }
 
+// Read an environment variable with a default
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
 // Connect to PostgreSQL
 func connectDB() {
 	dsn := "host=postgres user=postgres dbname=ecommerce password=password sslmode=disable"
@@ -55,7 +105,7 @@ func connectDB() {
 	if err != nil {
 		log.Fatal("❌ Failed to connect to database:", err)
 	}
-	if err := db.AutoMigrate(&Order{}, &OrderItem{}); err != nil {
+	if err := db.AutoMigrate(&Order{}, &OrderItem{}, &OrderItemComponent{}, &idempotency.Key{}, &Cart{}, &CartItem{}, &PaymentIntent{}, &WebhookEvent{}); err != nil {
 		log.Fatal("❌ Failed to migrate Order and OrderItem tables:", err)
 	}
 	log.Println("✅ Connected to PostgreSQL and migrated Order + OrderItem tables")
@@ -75,8 +125,9 @@ func connectRedis() {
 func setupCORS() func(http.Handler) http.Handler {
 	return cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"}, // Allow all origins, change to specific domains in production
-		AllowedMethods:   []string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "Idempotency-Key", "X-Cart-Token"},
+		ExposedHeaders:   []string{"Idempotent-Replayed"},
 		AllowCredentials: true,
 	})
 }
@@ -120,14 +171,175 @@ func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// Claims of the signed-in caller, if any. Routes open to guests use this
+// instead of authMiddleware.
+func optionalClaims(r *http.Request) *Claims {
+	tokenStr := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if tokenStr == "" {
+		return nil
+	}
+	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return nil
+	}
+	claims, _ := token.Claims.(*Claims)
+	return claims
+}
+
+// Email of the signed-in caller, if any
+func optionalEmail(r *http.Request) string {
+	if claims := optionalClaims(r); claims != nil {
+		return claims.Email
+	}
+	return ""
+}
+
+// Customer group of the signed-in caller, if any. Guests get list prices.
+func customerGroup(r *http.Request) string {
+	if claims := optionalClaims(r); claims != nil {
+		return claims.CustomerGroup
+	}
+	return ""
+}
+
+var (
+	errInvalidQuantity     = errors.New("quantity must be positive")
+	errProductUnavailable  = errors.New("product unavailable")
+	errShippingUnavailable = errors.New("shipping method unavailable")
+	errSavingOrder         = errors.New("error saving order")
+	errPriceChanged        = errors.New("price changed")
+)
+
+// orderLine is a product and quantity to order
+type orderLine struct {
+	ProductID uint `json:"product_id"`
+	Quantity  int  `json:"quantity"`
+
+	// Price the shopper was shown, if any; placing the order fails with
+	// errPriceChanged when the product no longer sells for it
+	ShownPrice *float64 `json:"-"`
+}
+
+// Price lines at current prices, save the order and reserve its stock.
+// order carries the email, currency and shipping choices; customerGroup
+// picks the buyer's price list. If stock can't be reserved the order is
+// saved as CANCELLED and the error returned.
+func placeOrder(order Order, lines []orderLine, customerGroup string) (Order, error) {
+	// Snapshot current prices so later price changes don't alter the order
+	var items []OrderItem
+	var components [][]OrderItemComponent // per item; nil unless a bundle
+	var subtotal float64
+	currency := strings.ToUpper(order.Currency)
+	for _, line := range lines {
+		if line.Quantity <= 0 {
+			return order, errInvalidQuantity
+		}
+		product, err := fetchFreshProduct(line.ProductID, currency, customerGroup)
+		if err != nil {
+			log.Printf("❌ Error pricing product %d: %v", line.ProductID, err)
+			return order, fmt.Errorf("%w: %d", errProductUnavailable, line.ProductID)
+		}
+		if line.ShownPrice != nil && money.Round(*line.ShownPrice, product.Currency) != money.Round(product.EffectivePrice, product.Currency) {
+			return order, fmt.Errorf("%w: %d", errPriceChanged, line.ProductID)
+		}
+		currency = product.Currency
+		items = append(items, OrderItem{ProductID: line.ProductID, Quantity: line.Quantity, UnitPrice: product.EffectivePrice, ProductType: product.Type})
+		var parts []OrderItemComponent
+		for _, component := range product.Components {
+			parts = append(parts, OrderItemComponent{ProductID: component.ProductID, Quantity: component.Quantity * line.Quantity})
+		}
+		components = append(components, parts)
+		subtotal += product.EffectivePrice * float64(line.Quantity)
+	}
+
+	order.Currency = currency
+	order.Subtotal = money.Round(subtotal, currency)
+	if order.ShippingMethod != "" {
+		cost, ok := shippingCost(order.ShippingMethod, currency)
+		if !ok {
+			return order, errShippingUnavailable
+		}
+		order.ShippingCost = cost
+	}
+	order.Total = money.Round(order.Subtotal+order.ShippingCost, currency)
+	order.Status = "PENDING"
+	// Stock is only reserved once the whole order is saved
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&order).Error; err != nil {
+			return err
+		}
+		for i := range items {
+			items[i].OrderID = order.ID
+			if err := tx.Create(&items[i]).Error; err != nil {
+				return err
+			}
+			for _, component := range components[i] {
+				component.OrderItemID = items[i].ID
+				if err := tx.Create(&component).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("❌ Error saving order:", err)
+		return order, fmt.Errorf("%w: %v", errSavingOrder, err)
+	}
+	order.Products = items
+
+	backordered, err := reserveStock(order.ID, items)
+	if err != nil {
+		log.Printf("❌ Could not reserve stock for order %d: %v", order.ID, err)
+		// The stock may have been taken without us hearing back
+		if errors.Is(err, errStockUnknown) {
+			if err := restoreStock(order.ID, items); err != nil {
+				log.Printf("❌ Could not release stock for order %d, release %s by hand: %v", order.ID, orderReference(order.ID), err)
+			}
+		}
+		order.Status = "CANCELLED"
+		db.Model(&order).Update("status", order.Status)
+		return order, err
+	}
+	if backordered {
+		order.Status = "BACKORDERED"
+		db.Model(&order).Update("status", order.Status)
+		log.Printf("⏳ Order %d created for %s, waiting for stock", order.ID, order.Email)
+		return order, nil
+	}
+
+	log.Printf("✅ Order %d created for %s", order.ID, order.Email)
+	return order, nil
+}
+
+// Map an order placement error to a response
+func placeOrderError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidQuantity):
+		http.Error(w, "Quantity must be positive", http.StatusBadRequest)
+	case errors.Is(err, errProductUnavailable):
+		http.Error(w, "Product unavailable", http.StatusBadRequest)
+	case errors.Is(err, errShippingUnavailable):
+		http.Error(w, "Shipping method unavailable for this currency", http.StatusBadRequest)
+	case errors.Is(err, errOutOfStock):
+		http.Error(w, "Stock insuficiente", http.StatusConflict)
+	case errors.Is(err, errPriceChanged):
+		http.Error(w, "Price has changed", http.StatusConflict)
+	case errors.Is(err, errSavingOrder):
+		http.Error(w, "Error saving order", http.StatusInternalServerError)
+	default:
+		http.Error(w, "Inventory unavailable", http.StatusBadGateway)
+	}
+}
+
 // Create an Order (Guest & Customers)
 func createOrder(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		Email    string `json:"email,omitempty"`
-		Products []struct {
-			ProductID uint `json:"product_id"`
-			Quantity  int  `json:"quantity"`
-		} `json:"products"`
+		Email    string      `json:"email,omitempty"`
+		Currency string      `json:"currency,omitempty"`
+		Products []orderLine `json:"products"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -135,21 +347,7 @@ func createOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tokenStr := r.Header.Get("Authorization")
-	tokenStr = strings.TrimPrefix(tokenStr, "Bearer ")
-
-	var email string
-	if tokenStr != "" {
-		token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
-		if err == nil {
-			if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-				email = claims.Email
-			}
-		}
-	}
-
+	email := optionalEmail(r)
 	if email == "" {
 		if request.Email == "" {
 			http.Error(w, "Guest users must provide an email", http.StatusBadRequest)
@@ -158,23 +356,52 @@ func createOrder(w http.ResponseWriter, r *http.Request) {
 		email = request.Email
 	}
 
-	order := Order{Email: email, Status: "PENDING"}
-	db.Create(&order)
-
-	for _, item := range request.Products {
-		orderItem := OrderItem{OrderID: order.ID, ProductID: item.ProductID, Quantity: item.Quantity}
-		db.Create(&orderItem)
-		updateStock(item.ProductID, -item.Quantity)
+	order, err := placeOrder(Order{Email: email, Currency: request.Currency}, request.Products, customerGroup(r))
+	if err != nil {
+		placeOrderError(w, err)
+		return
 	}
 
-	log.Printf("✅ Order %d created for %s", order.ID, email)
 	w.WriteHeader(http.StatusCreated)
+	if order.Status == "BACKORDERED" {
+		fmt.Fprintln(w, "Order created successfully, some items are backordered")
+		return
+	}
 	fmt.Fprintln(w, "Order created successfully")
 }
 
-// Update stock in Inventory Service
-func updateStock(productID uint, quantity int) {
-	db.Exec("UPDATE inventories SET stock = stock + ? WHERE product_id = ?", quantity, productID)
+// Inventory Service: a backordered order now has all its stock
+func backordersAllocated(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Reference string `json:"reference"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+	var orderID uint
+	if _, err := fmt.Sscanf(data.Reference, "order:%d", &orderID); err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	// Orders paid while waiting go straight to PAID
+	status := "PENDING"
+	if orderPaid(orderID) {
+		status = "PAID"
+	}
+	result := db.Model(&Order{}).Where("id = ? AND status = ?", orderID, "BACKORDERED").Update("status", status)
+	if result.Error != nil {
+		http.Error(w, "Error updating order", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("📦 Backordered order %d now has its stock", orderID)
+		if status == "PAID" {
+			deliverPaidOrder(orderID)
+		}
+	}
+	fmt.Fprintln(w, "OK")
 }
 
 // Admin: View All Orders
@@ -185,10 +412,12 @@ func getAllOrders(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(orders)
 }
 
-// Admin: Confirm an Order
+// Admin: Confirm an Order. Only paid orders can be confirmed, or pending
+// ones the admin says were paid offline.
 func confirmOrder(w http.ResponseWriter, r *http.Request) {
 	var data struct {
-		OrderID uint `json:"order_id"`
+		OrderID        uint `json:"order_id"`
+		OfflinePayment bool `json:"offline_payment"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		http.Error(w, "Invalid request data", http.StatusBadRequest)
@@ -200,12 +429,106 @@ func confirmOrder(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Order not found", http.StatusNotFound)
 		return
 	}
+	if order.Status != "PAID" && (order.Status != "PENDING" || !data.OfflinePayment) {
+		http.Error(w, "Order can't be confirmed in status "+order.Status, http.StatusConflict)
+		return
+	}
+	if order.Status == "PENDING" {
+		var open int64
+		db.Model(&PaymentIntent{}).Where("order_id = ? AND status IN ?", order.ID, openPaymentStatuses).Count(&open)
+		if open > 0 {
+			http.Error(w, "Order already has a payment in progress", http.StatusConflict)
+			return
+		}
+	}
 
-	db.Model(&order).Update("status", "CONFIRMED")
+	// Only from the status we checked, in case a payment event got there first
+	result := db.Model(&Order{}).Where("id = ? AND status = ?", order.ID, order.Status).Update("status", "CONFIRMED")
+	if result.Error != nil {
+		http.Error(w, "Error confirming order", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Order changed, try again", http.StatusConflict)
+		return
+	}
 	log.Printf("✅ Order %d confirmed", order.ID)
+
+	// Digital goods normally go out when the payment is captured; orders paid
+	// offline get them here. A failed delivery is retried by the delivery
+	// worker.
+	deliverPaidOrder(order.ID)
 	fmt.Fprintln(w, "Order confirmed successfully")
 }
 
+// Admin: Fulfil a confirmed order, recording the serial numbers shipped.
+// Inventory Service refuses it unless every serial-tracked item has one per
+// unit.
+func fulfilOrder(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		OrderID uint `json:"order_id"`
+		Items   []struct {
+			OrderItemID uint     `json:"order_item_id"`
+			Serials     []string `json:"serials"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+
+	var order Order
+	if err := db.Preload("Products").First(&order, "id = ?", data.OrderID).Error; err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if order.Status != "CONFIRMED" && order.Status != "FULFILLED" {
+		http.Error(w, "Only confirmed orders can be fulfilled", http.StatusConflict)
+		return
+	}
+
+	orderItems := map[uint]OrderItem{}
+	for _, item := range order.Products {
+		orderItems[item.ID] = item
+	}
+	serials := map[uint][]string{}
+	for _, fulfilled := range data.Items {
+		item, ok := orderItems[fulfilled.OrderItemID]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Item %d is not on this order", fulfilled.OrderItemID), http.StatusBadRequest)
+			return
+		}
+		if len(fulfilled.Serials) != item.Quantity {
+			http.Error(w, fmt.Sprintf("Item %d needs %d serials", item.ID, item.Quantity), http.StatusBadRequest)
+			return
+		}
+		serials[item.ID] = fulfilled.Serials
+	}
+	// Every physical item goes, with or without serials, so Inventory
+	// Service can tell when a serial-tracked one is missing them
+	var assignments []itemSerials
+	for _, item := range order.Products {
+		if !item.isDigital() && !item.isBundle() {
+			assignments = append(assignments, itemSerials{OrderItemID: item.ID, ProductID: item.ProductID, Quantity: item.Quantity, Serials: serials[item.ID]})
+		}
+	}
+
+	if err := assignSerials(order.ID, assignments); err != nil {
+		var rejected serialsRejectedError
+		if errors.As(err, &rejected) {
+			http.Error(w, rejected.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("❌ Error assigning serials for order %d: %v", order.ID, err)
+		http.Error(w, "Inventory unavailable", http.StatusBadGateway)
+		return
+	}
+
+	db.Model(&order).Update("status", "FULFILLED")
+	log.Printf("🚚 Order %d fulfilled", order.ID)
+	fmt.Fprintln(w, "Order fulfilled successfully")
+}
+
 // Admin: Cancel an Order (Restores Stock)
 func cancelOrderAdmin(w http.ResponseWriter, r *http.Request) {
 	var data struct {
@@ -222,11 +545,37 @@ func cancelOrderAdmin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The goods have gone; they come back through /serials/return and a refund
+	if order.Status == "FULFILLED" {
+		http.Error(w, "Fulfilled orders can't be cancelled", http.StatusConflict)
+		return
+	}
+
 	var orderItems []OrderItem
 	db.Where("order_id = ?", order.ID).Find(&orderItems)
 
-	for _, item := range orderItems {
-		updateStock(item.ProductID, item.Quantity)
+	if order.Status != "CANCELLED" {
+		// Payments first: if a void fails the order is left as it was, and
+		// cancelling again retries it
+		ctx, cancel := context.WithTimeout(r.Context(), paymentTimeout)
+		defer cancel()
+		if err := voidOrderPayments(ctx, order.ID); err != nil {
+			switch {
+			case errors.Is(err, errPaymentInProgress):
+				http.Error(w, "Order has a payment in progress", http.StatusConflict)
+			case errors.Is(err, errPaymentTaken):
+				http.Error(w, "Refund the order's payments before cancelling it", http.StatusConflict)
+			default:
+				log.Printf("❌ Could not void payments for order %d: %v", order.ID, err)
+				http.Error(w, "Could not void the order's payments", http.StatusBadGateway)
+			}
+			return
+		}
+		if err := restoreStock(order.ID, orderItems); err != nil {
+			log.Printf("❌ Could not restore stock for order %d: %v", order.ID, err)
+			http.Error(w, "Inventory unavailable", http.StatusBadGateway)
+			return
+		}
 	}
 
 	db.Model(&order).Update("status", "CANCELLED")
@@ -234,19 +583,137 @@ func cancelOrderAdmin(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "Order cancelled successfully")
 }
 
+// Customer: has the caller bought this product? Used for verified-purchase badges
+func purchasedProduct(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(chi.URLParam(r, "productID"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	var count int64
+	if err := db.Model(&OrderItem{}).
+		Joins("JOIN orders ON orders.id = order_items.order_id").
+		Where("orders.email = ? AND orders.status IN ? AND order_items.product_id = ?",
+			r.Header.Get("User-Email"), purchasedStatuses, productID).
+		Count(&count).Error; err != nil {
+		log.Println("❌ Error checking purchase:", err)
+		http.Error(w, "Error checking purchase", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"purchased": count > 0})
+}
+
+// Customer: order history, with license keys and download links for
+// digital items that have been delivered
+func myOrders(w http.ResponseWriter, r *http.Request) {
+	var orders []Order
+	if err := db.Preload("Products").Where("email = ?", r.Header.Get("User-Email")).Order("id DESC").Find(&orders).Error; err != nil {
+		log.Println("❌ Error loading orders:", err)
+		http.Error(w, "Error loading orders", http.StatusInternalServerError)
+		return
+	}
+
+	var digitalItemIDs []uint
+	for _, order := range orders {
+		if !isPurchased(order.Status) {
+			continue
+		}
+		for _, item := range order.Products {
+			if item.isDigital() {
+				digitalItemIDs = append(digitalItemIDs, item.ID)
+			}
+		}
+	}
+	deliveries, err := fetchDeliveries(digitalItemIDs)
+	if err != nil {
+		// Still show the orders; links can be fetched again later
+		log.Println("⚠️ Could not load digital deliveries:", err)
+	}
+
+	type orderItemView struct {
+		OrderItem
+		Delivery *digitalDelivery `json:"Delivery,omitempty"`
+	}
+	type orderView struct {
+		Order
+		Products []orderItemView
+	}
+	views := make([]orderView, len(orders))
+	for i, order := range orders {
+		views[i] = orderView{Order: order, Products: make([]orderItemView, len(order.Products))}
+		for j, item := range order.Products {
+			views[i].Products[j] = orderItemView{OrderItem: item}
+			if delivery, ok := deliveries[item.ID]; ok {
+				views[i].Products[j].Delivery = &delivery
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func isPurchased(status string) bool {
+	for _, purchased := range purchasedStatuses {
+		if status == purchased {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
+	if internalAPIKey == "" {
+		log.Fatal("❌ INTERNAL_API_KEY is required")
+	}
+
 	connectDB()
 	connectRedis()
 
+	var err error
+	if paymentProvider, err = newPaymentProvider(); err != nil {
+		log.Fatal("❌ Invalid payment provider:", err)
+	}
+	log.Println("💳 Payment provider:", paymentProvider.Name())
+	if idempotencyKeys, err = idempotency.New(db, "order-service"); err != nil {
+		log.Fatal("❌ Failed to set up idempotency keys:", err)
+	}
+
+	go watchCatalogEvents()
+	go idempotencyKeys.RunCleanup()
+	go runWebhookWorker()
+	go runDeliveryWorker()
+
 	r := chi.NewRouter()
 
 	// ✅ Apply CORS middleware to all routes
 	r.Use(setupCORS())
 
-	r.Post("/orders", createOrder)
+	r.Post("/orders", idempotent(createOrder))
 	r.Get("/orders", authMiddleware(adminMiddleware(getAllOrders)))
-	r.Patch("/orders/confirm", authMiddleware(adminMiddleware(confirmOrder)))
-	r.Patch("/orders/cancel", authMiddleware(adminMiddleware(cancelOrderAdmin)))
+	r.Get("/orders/mine", authMiddleware(myOrders))
+	r.Post("/orders/backorders/allocated", internalOnly(backordersAllocated))
+	r.Get("/cart", getCart)
+	r.Post("/cart/items", addCartItem)
+	r.Put("/cart/items/{productID}", updateCartItem)
+	r.Delete("/cart/items/{productID}", removeCartItem)
+	r.Post("/cart/merge", authMiddleware(mergeCart))
+	r.Post("/cart/checkout", idempotent(checkout))
+	r.Get("/orders/purchased/{productID}", authMiddleware(purchasedProduct))
+	r.Patch("/orders/confirm", authMiddleware(adminMiddleware(idempotent(confirmOrder))))
+	r.Patch("/orders/fulfil", authMiddleware(adminMiddleware(idempotent(fulfilOrder))))
+	r.Patch("/orders/cancel", authMiddleware(adminMiddleware(idempotent(cancelOrderAdmin))))
+	r.Post("/orders/{id}/payments", idempotent(payOrder))
+	r.Get("/orders/{id}/payments", authMiddleware(listOrderPayments))
+	r.Post("/payments/{id}/capture", authMiddleware(adminMiddleware(idempotent(capturePayment))))
+	r.Post("/payments/{id}/void", authMiddleware(adminMiddleware(idempotent(voidPayment))))
+	r.Post("/payments/{id}/refund", authMiddleware(adminMiddleware(idempotent(refundPayment))))
+	r.Post("/payments/webhook", receiveWebhook)
+	r.Get("/payments/webhooks", authMiddleware(adminMiddleware(listWebhookEvents)))
+	r.Post("/payments/webhooks/{id}/retry", authMiddleware(adminMiddleware(retryWebhookEvent)))
 
 	log.Println("📦 Order Service running on :8081")
 	http.ListenAndServe(":8081", r)
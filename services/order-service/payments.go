@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ecommerce/pkg/money"
+	"github.com/go-chi/chi/v5"
+)
+
+// Payment provider in use, chosen at startup
+var paymentProvider PaymentProvider
+
+const paymentTimeout = 20 * time.Second
+
+// PaymentIntent records an attempt to pay for an order with a provider.
+// Amounts are in the currency's minor unit.
+type PaymentIntent struct {
+	ID                  uint      `gorm:"primaryKey" json:"id"`
+	OrderID             uint      `gorm:"index" json:"order_id"`
+	Provider            string    `gorm:"size:32" json:"provider"`
+	ProviderID          string    `gorm:"index" json:"provider_id"`
+	Amount              int64     `json:"amount"`
+	Currency            string    `gorm:"size:3" json:"currency"`
+	Status              string    `gorm:"size:32;index" json:"status"`
+	Captured            int64     `json:"captured"`
+	Refunded            int64     `json:"refunded"`
+	FailureReason       string    `json:"failure_reason,omitempty"`
+	DisputedOrderStatus string    `gorm:"size:32" json:"-"`                 // to go back to if a dispute is won
+	ClientSecret        string    `gorm:"-" json:"client_secret,omitempty"` // only returned when created
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+// Statuses of a payment that still holds or has taken the customer's money
+var openPaymentStatuses = []string{paymentPending, paymentRequiresAction, paymentAuthorized, paymentCaptured, paymentPartiallyRefunded, paymentDisputed}
+
+// Respond to a provider error: refusals are the caller's problem, the rest
+// are ours
+func paymentError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPaymentDeclined) {
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+		return
+	}
+	log.Println("❌ Payment provider error:", err)
+	http.Error(w, "Payment provider unavailable", http.StatusBadGateway)
+}
+
+func writePayment(w http.ResponseWriter, status int, intent PaymentIntent) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(intent)
+}
+
+// Has the order a captured payment?
+func orderPaid(orderID uint) bool {
+	var count int64
+	db.Model(&PaymentIntent{}).
+		Where("order_id = ? AND status IN ?", orderID, []string{paymentCaptured, paymentPartiallyRefunded}).
+		Count(&count)
+	return count > 0
+}
+
+func capturePaymentIntent(ctx context.Context, intent *PaymentIntent, amount int64) error {
+	result, err := paymentProvider.Capture(ctx, intent.ProviderID, amount, fmt.Sprintf("payment:%d:capture", intent.ID))
+	if err != nil {
+		return err
+	}
+	intent.Status = result.Status
+	if result.Status == paymentCaptured {
+		intent.Captured = amount
+	}
+	if err := db.Save(intent).Error; err != nil {
+		return err
+	}
+	// Backordered orders stay put; they become PAID when their stock arrives
+	if intent.Status == paymentCaptured {
+		paid, err := moveOrder(db, intent.OrderID, "PAID")
+		if err != nil {
+			return err
+		}
+		// A failed delivery is retried by the delivery worker
+		if paid {
+			deliverPaidOrder(intent.OrderID)
+		}
+	}
+	return nil
+}
+
+// Customer: pay for an order. Guests give the order's email. With capture
+// the money is taken straight away; otherwise it's only authorized and an
+// admin captures it later.
+func payOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	var request struct {
+		PaymentMethod string `json:"payment_method"`
+		Email         string `json:"email"`
+		Capture       bool   `json:"capture"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.PaymentMethod == "" {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+
+	email := optionalEmail(r)
+	if email == "" {
+		email = request.Email
+	}
+	var order Order
+	if err := db.First(&order, "id = ?", orderID).Error; err != nil || email == "" || order.Email != email {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if order.Status != "PENDING" && order.Status != "BACKORDERED" && order.Status != orderPaymentFailed {
+		http.Error(w, "Order can't be paid in status "+order.Status, http.StatusConflict)
+		return
+	}
+	var open int64
+	db.Model(&PaymentIntent{}).Where("order_id = ? AND status IN ?", order.ID, openPaymentStatuses).Count(&open)
+	if open > 0 {
+		http.Error(w, "Order already has a payment in progress", http.StatusConflict)
+		return
+	}
+
+	intent := PaymentIntent{
+		OrderID:  order.ID,
+		Provider: paymentProvider.Name(),
+		Amount:   money.ToMinorUnits(order.Total, order.Currency),
+		Currency: order.Currency,
+		Status:   paymentPending,
+	}
+	if err := db.Create(&intent).Error; err != nil {
+		http.Error(w, "Error creating payment", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), paymentTimeout)
+	defer cancel()
+	result, err := paymentProvider.Authorize(ctx, PaymentRequest{
+		OrderID:        order.ID,
+		Email:          order.Email,
+		Amount:         intent.Amount,
+		Currency:       intent.Currency,
+		PaymentMethod:  request.PaymentMethod,
+		IdempotencyKey: fmt.Sprintf("order:%d:payment:%d", order.ID, intent.ID),
+	})
+	intent.ProviderID = result.ID
+	if err != nil {
+		intent.Status = paymentFailed
+		intent.FailureReason = err.Error()
+		db.Save(&intent)
+		paymentError(w, err)
+		return
+	}
+	intent.Status = result.Status
+	db.Save(&intent)
+	log.Printf("💳 Payment %d for order %d %s", intent.ID, order.ID, intent.Status)
+
+	if request.Capture && intent.Status == paymentAuthorized {
+		if err := capturePaymentIntent(ctx, &intent, intent.Amount); err != nil {
+			paymentError(w, err)
+			return
+		}
+	}
+
+	intent.ClientSecret = result.ClientSecret
+	writePayment(w, http.StatusCreated, intent)
+}
+
+// Customer or admin: payments made for an order
+func listOrderPayments(w http.ResponseWriter, r *http.Request) {
+	var order Order
+	if err := db.First(&order, "id = ?", chi.URLParam(r, "id")).Error; err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("User-Role") != "admin" && r.Header.Get("User-Email") != order.Email {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	var intents []PaymentIntent
+	db.Where("order_id = ?", order.ID).Order("id").Find(&intents)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(intents)
+}
+
+func loadPayment(w http.ResponseWriter, r *http.Request) (*PaymentIntent, bool) {
+	var intent PaymentIntent
+	if err := db.First(&intent, "id = ?", chi.URLParam(r, "id")).Error; err != nil {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return nil, false
+	}
+	return &intent, true
+}
+
+// Optional amount in minor units from the request body; missing means all
+func decodePaymentAmount(r *http.Request) (int64, bool) {
+	var data struct {
+		Amount int64 `json:"amount"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Amount < 0 {
+			return 0, false
+		}
+	}
+	return data.Amount, true
+}
+
+// Admin: capture an authorized payment, all of it unless an amount is given
+func capturePayment(w http.ResponseWriter, r *http.Request) {
+	intent, ok := loadPayment(w, r)
+	if !ok {
+		return
+	}
+	amount, ok := decodePaymentAmount(r)
+	if !ok || amount > intent.Amount {
+		http.Error(w, "Invalid amount", http.StatusBadRequest)
+		return
+	}
+	if amount == 0 {
+		amount = intent.Amount
+	}
+	if intent.Status != paymentAuthorized {
+		http.Error(w, "Payment is "+intent.Status, http.StatusConflict)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), paymentTimeout)
+	defer cancel()
+	if err := capturePaymentIntent(ctx, intent, amount); err != nil {
+		paymentError(w, err)
+		return
+	}
+	log.Printf("💰 Captured payment %d for order %d", intent.ID, intent.OrderID)
+	writePayment(w, http.StatusOK, *intent)
+}
+
+// Release an authorization without taking the money
+func voidPaymentIntent(ctx context.Context, intent *PaymentIntent) error {
+	result, err := paymentProvider.Void(ctx, intent.ProviderID, fmt.Sprintf("payment:%d:void", intent.ID))
+	if err != nil {
+		return err
+	}
+	intent.Status = result.Status
+	return db.Save(intent).Error
+}
+
+// Admin: void an authorized payment
+func voidPayment(w http.ResponseWriter, r *http.Request) {
+	intent, ok := loadPayment(w, r)
+	if !ok {
+		return
+	}
+	if intent.Status != paymentAuthorized && intent.Status != paymentRequiresAction {
+		http.Error(w, "Payment is "+intent.Status, http.StatusConflict)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), paymentTimeout)
+	defer cancel()
+	if err := voidPaymentIntent(ctx, intent); err != nil {
+		paymentError(w, err)
+		return
+	}
+	log.Printf("↩️ Voided payment %d for order %d", intent.ID, intent.OrderID)
+	writePayment(w, http.StatusOK, *intent)
+}
+
+// Admin: refund a captured payment, whatever is left unless an amount is
+// given
+func refundPayment(w http.ResponseWriter, r *http.Request) {
+	intent, ok := loadPayment(w, r)
+	if !ok {
+		return
+	}
+	amount, ok := decodePaymentAmount(r)
+	remaining := intent.Captured - intent.Refunded
+	if !ok || amount > remaining {
+		http.Error(w, "Invalid amount", http.StatusBadRequest)
+		return
+	}
+	if amount == 0 {
+		amount = remaining
+	}
+	if (intent.Status != paymentCaptured && intent.Status != paymentPartiallyRefunded) || amount == 0 {
+		http.Error(w, "Nothing to refund", http.StatusConflict)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), paymentTimeout)
+	defer cancel()
+	// Keyed on what was refunded before, so a retry of this refund is
+	// recognised but a later one isn't
+	refundKey := fmt.Sprintf("payment:%d:refund:%d", intent.ID, intent.Refunded)
+	if _, err := paymentProvider.Refund(ctx, intent.ProviderID, amount, refundKey); err != nil {
+		paymentError(w, err)
+		return
+	}
+	intent.Refunded += amount
+	intent.Status = paymentPartiallyRefunded
+	if intent.Refunded == intent.Captured {
+		intent.Status = paymentRefunded
+	}
+	if err := db.Save(intent).Error; err != nil {
+		http.Error(w, "Error saving payment", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("💸 Refunded %d of payment %d for order %d", amount, intent.ID, intent.OrderID)
+	writePayment(w, http.StatusOK, *intent)
+}
+
+// Reasons an order's payments stop it being cancelled
+var (
+	errPaymentInProgress = errors.New("payment in progress")
+	errPaymentTaken      = errors.New("payment captured")
+)
+
+// Get an order's payments out of the way before it is cancelled: open
+// authorizations are voided. A payment still on its way to the provider,
+// or one that has taken the customer's money, stops the cancellation; the
+// money is for an admin to refund first.
+func voidOrderPayments(ctx context.Context, orderID uint) error {
+	var intents []PaymentIntent
+	if err := db.Where("order_id = ? AND status IN ?", orderID, openPaymentStatuses).Find(&intents).Error; err != nil {
+		return err
+	}
+	for _, intent := range intents {
+		switch intent.Status {
+		case paymentPending:
+			return errPaymentInProgress
+		case paymentCaptured, paymentPartiallyRefunded, paymentDisputed:
+			return errPaymentTaken
+		}
+	}
+	for i := range intents {
+		if err := voidPaymentIntent(ctx, &intents[i]); err != nil {
+			return fmt.Errorf("voiding payment %d: %w", intents[i].ID, err)
+		}
+	}
+	return nil
+}
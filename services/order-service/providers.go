@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payment statuses, as reported by providers and stored on payments
+const (
+	paymentPending           = "pending"         // not yet sent to the provider
+	paymentRequiresAction    = "requires_action" // e.g. 3-D Secure; the client finishes it
+	paymentAuthorized        = "authorized"
+	paymentCaptured          = "captured"
+	paymentPartiallyRefunded = "partially_refunded"
+	paymentRefunded          = "refunded"
+	paymentVoided            = "voided"
+	paymentFailed            = "failed"
+	paymentDisputed          = "disputed" // the customer's bank is clawing it back
+)
+
+// The provider refused the payment (declined card, nothing left to
+// refund, ...), as opposed to being unreachable
+var errPaymentDeclined = errors.New("payment declined")
+
+// PaymentRequest asks a provider to authorize an amount in minor units
+type PaymentRequest struct {
+	OrderID        uint
+	Email          string
+	Amount         int64
+	Currency       string
+	PaymentMethod  string // provider token for the card or wallet
+	IdempotencyKey string
+}
+
+// ProviderResult is a provider's view of a payment after an operation.
+// Refunds leave Status empty; the caller knows the amounts.
+type ProviderResult struct {
+	ID           string
+	Status       string
+	ClientSecret string // for requires_action
+}
+
+// PaymentProvider moves money. Amounts are in minor units. Operations
+// return an error wrapping errPaymentDeclined when the provider refuses.
+// Repeating an operation with the same idempotency key (after a timeout,
+// say) doesn't move the money twice.
+type PaymentProvider interface {
+	Name() string
+	Authorize(ctx context.Context, request PaymentRequest) (ProviderResult, error)
+	Capture(ctx context.Context, providerID string, amount int64, idempotencyKey string) (ProviderResult, error)
+	Void(ctx context.Context, providerID, idempotencyKey string) (ProviderResult, error)
+	Refund(ctx context.Context, providerID string, amount int64, idempotencyKey string) (ProviderResult, error)
+}
+
+// Build the provider from PAYMENT_PROVIDER: "fake" (default) or "stripe"
+func newPaymentProvider() (PaymentProvider, error) {
+	switch name := getEnv("PAYMENT_PROVIDER", "fake"); name {
+	case "fake":
+		return newFakeProvider(), nil
+	case "stripe":
+		key := getEnv("STRIPE_SECRET_KEY", "")
+		if key == "" {
+			return nil, errors.New("STRIPE_SECRET_KEY is required for the stripe provider")
+		}
+		return &stripeProvider{
+			baseURL:   getEnv("STRIPE_API_URL", "https://api.stripe.com"),
+			secretKey: key,
+			client:    &http.Client{Timeout: 15 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", name)
+	}
+}
+
+// Fake payment methods for local use and testing. Anything else succeeds.
+const (
+	fakeMethodDecline = "fake_decline"
+	fakeMethodAction  = "fake_requires_action"
+)
+
+// fakeProvider keeps payments in memory. Payments are lost on restart.
+type fakeProvider struct {
+	mu       sync.Mutex
+	payments map[string]*fakePayment
+	byKey    map[string]string
+}
+
+type fakePayment struct {
+	amount, captured, refunded int64
+	status                     string
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{payments: map[string]*fakePayment{}, byKey: map[string]string{}}
+}
+
+func (p *fakeProvider) Name() string { return "fake" }
+
+func (p *fakeProvider) Authorize(ctx context.Context, request PaymentRequest) (ProviderResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.byKey[request.IdempotencyKey]; ok && request.IdempotencyKey != "" {
+		return ProviderResult{ID: id, Status: p.payments[id].status}, nil
+	}
+
+	b := make([]byte, 12)
+	rand.Read(b)
+	id := "fake_pi_" + hex.EncodeToString(b)
+	payment := &fakePayment{amount: request.Amount, status: paymentAuthorized}
+	switch request.PaymentMethod {
+	case fakeMethodDecline:
+		payment.status = paymentFailed
+	case fakeMethodAction:
+		payment.status = paymentRequiresAction
+	}
+	p.payments[id] = payment
+	if request.IdempotencyKey != "" {
+		p.byKey[request.IdempotencyKey] = id
+	}
+
+	if payment.status == paymentFailed {
+		return ProviderResult{ID: id, Status: paymentFailed}, fmt.Errorf("%w: card declined", errPaymentDeclined)
+	}
+	result := ProviderResult{ID: id, Status: payment.status}
+	if payment.status == paymentRequiresAction {
+		result.ClientSecret = id + "_secret"
+	}
+	log.Printf("💳 [fake] Authorized %d %s for order %d", request.Amount, request.Currency, request.OrderID)
+	return result, nil
+}
+
+// Has an operation with this key succeeded already?
+func (p *fakeProvider) done(idempotencyKey string) bool {
+	_, ok := p.byKey[idempotencyKey]
+	return ok && idempotencyKey != ""
+}
+
+// Remember a successful operation so a repeat of it does nothing
+func (p *fakeProvider) remember(idempotencyKey, providerID string) {
+	if idempotencyKey != "" {
+		p.byKey[idempotencyKey] = providerID
+	}
+}
+
+func (p *fakeProvider) find(providerID string) (*fakePayment, error) {
+	payment, ok := p.payments[providerID]
+	if !ok {
+		return nil, fmt.Errorf("%w: no such payment", errPaymentDeclined)
+	}
+	return payment, nil
+}
+
+func (p *fakeProvider) Capture(ctx context.Context, providerID string, amount int64, idempotencyKey string) (ProviderResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payment, err := p.find(providerID)
+	if err != nil {
+		return ProviderResult{}, err
+	}
+	if p.done(idempotencyKey) {
+		return ProviderResult{ID: providerID, Status: payment.status}, nil
+	}
+	if payment.status != paymentAuthorized {
+		return ProviderResult{ID: providerID, Status: payment.status}, fmt.Errorf("%w: payment is %s", errPaymentDeclined, payment.status)
+	}
+	if amount > payment.amount {
+		return ProviderResult{ID: providerID, Status: payment.status}, fmt.Errorf("%w: amount exceeds authorization", errPaymentDeclined)
+	}
+	payment.captured = amount
+	payment.status = paymentCaptured
+	p.remember(idempotencyKey, providerID)
+	return ProviderResult{ID: providerID, Status: payment.status}, nil
+}
+
+func (p *fakeProvider) Void(ctx context.Context, providerID, idempotencyKey string) (ProviderResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payment, err := p.find(providerID)
+	if err != nil {
+		return ProviderResult{}, err
+	}
+	if p.done(idempotencyKey) {
+		return ProviderResult{ID: providerID, Status: payment.status}, nil
+	}
+	if payment.status != paymentAuthorized && payment.status != paymentRequiresAction {
+		return ProviderResult{ID: providerID, Status: payment.status}, fmt.Errorf("%w: payment is %s", errPaymentDeclined, payment.status)
+	}
+	payment.status = paymentVoided
+	p.remember(idempotencyKey, providerID)
+	return ProviderResult{ID: providerID, Status: payment.status}, nil
+}
+
+func (p *fakeProvider) Refund(ctx context.Context, providerID string, amount int64, idempotencyKey string) (ProviderResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payment, err := p.find(providerID)
+	if err != nil {
+		return ProviderResult{}, err
+	}
+	if p.done(idempotencyKey) {
+		return ProviderResult{ID: providerID}, nil
+	}
+	if payment.captured == 0 || payment.refunded+amount > payment.captured {
+		return ProviderResult{ID: providerID, Status: payment.status}, fmt.Errorf("%w: refund exceeds captured amount", errPaymentDeclined)
+	}
+	payment.refunded += amount
+	p.remember(idempotencyKey, providerID)
+	return ProviderResult{ID: providerID}, nil
+}
+
+// stripeProvider uses Stripe PaymentIntents with manual capture
+type stripeProvider struct {
+	baseURL   string
+	secretKey string
+	client    *http.Client
+}
+
+func (p *stripeProvider) Name() string { return "stripe" }
+
+// The fields we use of a PaymentIntent or Refund
+type stripeObject struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	ClientSecret string `json:"client_secret"`
+	Error        *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Map a PaymentIntent status to ours
+func stripeStatus(status string) string {
+	switch status {
+	case "requires_capture":
+		return paymentAuthorized
+	case "succeeded":
+		return paymentCaptured
+	case "canceled":
+		return paymentVoided
+	case "requires_action", "requires_confirmation", "processing":
+		return paymentRequiresAction
+	default: // requires_payment_method: the attempt failed
+		return paymentFailed
+	}
+}
+
+func (p *stripeProvider) post(ctx context.Context, path string, form url.Values, idempotencyKey string) (stripeObject, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return stripeObject{}, err
+	}
+	req.SetBasicAuth(p.secretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return stripeObject{}, fmt.Errorf("contacting Stripe: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var object stripeObject
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err := json.Unmarshal(body, &object); err != nil {
+		return stripeObject{}, fmt.Errorf("stripe returned %d: unreadable response", resp.StatusCode)
+	}
+	if object.Error != nil {
+		// Card errors and invalid requests are refusals; the rest are outages
+		if object.Error.Type == "card_error" || object.Error.Type == "invalid_request_error" {
+			return object, fmt.Errorf("%w: %s", errPaymentDeclined, object.Error.Message)
+		}
+		return object, fmt.Errorf("stripe error (%s): %s", object.Error.Type, object.Error.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return object, fmt.Errorf("stripe returned %d", resp.StatusCode)
+	}
+	return object, nil
+}
+
+func (p *stripeProvider) Authorize(ctx context.Context, request PaymentRequest) (ProviderResult, error) {
+	form := url.Values{
+		"amount":                 {strconv.FormatInt(request.Amount, 10)},
+		"currency":               {strings.ToLower(request.Currency)},
+		"capture_method":         {"manual"},
+		"confirm":                {"true"},
+		"payment_method":         {request.PaymentMethod},
+		"receipt_email":          {request.Email},
+		"metadata[order_id]":     {strconv.FormatUint(uint64(request.OrderID), 10)},
+		"payment_method_types[]": {"card"},
+	}
+	intent, err := p.post(ctx, "/v1/payment_intents", form, request.IdempotencyKey)
+	if err != nil {
+		return ProviderResult{ID: intent.ID, Status: paymentFailed}, err
+	}
+	result := ProviderResult{ID: intent.ID, Status: stripeStatus(intent.Status)}
+	if result.Status == paymentRequiresAction {
+		result.ClientSecret = intent.ClientSecret
+	}
+	if result.Status == paymentFailed {
+		return result, fmt.Errorf("%w: %s", errPaymentDeclined, intent.Status)
+	}
+	return result, nil
+}
+
+func (p *stripeProvider) Capture(ctx context.Context, providerID string, amount int64, idempotencyKey string) (ProviderResult, error) {
+	form := url.Values{"amount_to_capture": {strconv.FormatInt(amount, 10)}}
+	intent, err := p.post(ctx, "/v1/payment_intents/"+url.PathEscape(providerID)+"/capture", form, idempotencyKey)
+	if err != nil {
+		return ProviderResult{}, err
+	}
+	return ProviderResult{ID: intent.ID, Status: stripeStatus(intent.Status)}, nil
+}
+
+func (p *stripeProvider) Void(ctx context.Context, providerID, idempotencyKey string) (ProviderResult, error) {
+	intent, err := p.post(ctx, "/v1/payment_intents/"+url.PathEscape(providerID)+"/cancel", url.Values{}, idempotencyKey)
+	if err != nil {
+		return ProviderResult{}, err
+	}
+	return ProviderResult{ID: intent.ID, Status: stripeStatus(intent.Status)}, nil
+}
+
+// Stripe refunds are separate objects; the payment's own refund status is
+// worked out by the caller from the amounts
+func (p *stripeProvider) Refund(ctx context.Context, providerID string, amount int64, idempotencyKey string) (ProviderResult, error) {
+	form := url.Values{"payment_intent": {providerID}, "amount": {strconv.FormatInt(amount, 10)}}
+	refund, err := p.post(ctx, "/v1/refunds", form, idempotencyKey)
+	if err != nil {
+		return ProviderResult{}, err
+	}
+	if refund.Status == "failed" || refund.Status == "canceled" {
+		return ProviderResult{ID: providerID}, fmt.Errorf("%w: refund %s", errPaymentDeclined, refund.Status)
+	}
+	return ProviderResult{ID: providerID}, nil
+}
@@ -0,0 +1,30 @@
+#!/bin/sh
+# Send a signed fixture webhook to a running order-service.
+#
+#   PAYMENT_WEBHOOK_SECRET=whsec_local scripts/send-webhook.sh \
+#     testdata/webhooks/payment_intent.succeeded.json fake_pi_0123 2599
+#
+# The payment ID is a payment's provider_id (GET /orders/{id}/payments) and
+# the amount is in minor units. Sending the same fixture twice shows the
+# duplicate being dropped; set EVENT_ID to send it as a new event. Set
+# TIMESTAMP to an old Unix time to see the replay check reject it.
+set -eu
+
+fixture=${1:?usage: send-webhook.sh FIXTURE PAYMENT_ID [AMOUNT]}
+payment_id=${2:?usage: send-webhook.sh FIXTURE PAYMENT_ID [AMOUNT]}
+amount=${3:-0}
+secret=${PAYMENT_WEBHOOK_SECRET:?PAYMENT_WEBHOOK_SECRET must be set}
+url=${ORDER_SERVICE_URL:-http://localhost:8081}/payments/webhook
+timestamp=${TIMESTAMP:-$(date +%s)}
+
+body=$(sed -e "s/{{PAYMENT_ID}}/$payment_id/g" -e "s/{{AMOUNT}}/$amount/g" "$fixture")
+if [ -n "${EVENT_ID:-}" ]; then
+	body=$(printf '%s' "$body" | sed "0,/\"id\": \"[^\"]*\"/s//\"id\": \"$EVENT_ID\"/")
+fi
+
+signature=$(printf '%s.%s' "$timestamp" "$body" | openssl dgst -sha256 -hmac "$secret" | sed 's/^.* //')
+
+curl -sS -w '\n%{http_code}\n' -X POST "$url" \
+	-H "Content-Type: application/json" \
+	-H "Stripe-Signature: t=$timestamp,v1=$signature" \
+	--data-binary "$body"
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	webhookSignatureHeader = "Stripe-Signature"
+	// Signed timestamps further off than this are rejected as replays
+	webhookTolerance    = 5 * time.Minute
+	webhookMaxBodySize  = 1 << 20
+	webhookPollInterval = 5 * time.Second
+	webhookBatchSize    = 20
+	webhookMaxAttempts  = 8
+	webhookMaxBackoff   = time.Hour
+)
+
+// Webhook event statuses
+const (
+	webhookPending   = "pending"
+	webhookProcessed = "processed"
+	webhookFailed    = "failed" // gave up after webhookMaxAttempts
+)
+
+// Order statuses only payment events lead to
+const (
+	orderPaymentFailed = "PAYMENT_FAILED"
+	orderDisputed      = "DISPUTED"
+)
+
+// Shared secret the provider signs webhooks with
+var webhookSecret = []byte(getEnv("PAYMENT_WEBHOOK_SECRET", ""))
+
+var errBadSignature = errors.New("invalid webhook signature")
+
+// WebhookEvent is a provider callback, stored as received and processed in
+// the background. EventID is the provider's, so redeliveries are dropped.
+type WebhookEvent struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	EventID       string     `gorm:"uniqueIndex" json:"event_id"`
+	Type          string     `json:"type"`
+	Payload       []byte     `json:"-"`
+	Status        string     `gorm:"size:16;index" json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"index" json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	ProcessedAt   *time.Time `json:"processed_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// The parts of a provider event we use. Object is a PaymentIntent for
+// payment_intent.* events, a Charge for charge.refunded and a Dispute for
+// charge.dispute.*.
+type webhookPayload struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object struct {
+			ID               string `json:"id"`
+			PaymentIntent    string `json:"payment_intent"`
+			Status           string `json:"status"`
+			AmountReceived   int64  `json:"amount_received"`
+			AmountRefunded   int64  `json:"amount_refunded"`
+			LastPaymentError *struct {
+				Message string `json:"message"`
+			} `json:"last_payment_error"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+// Check a "t=<unix>,v1=<hex>" signature header: an HMAC-SHA256 of
+// "<t>.<body>" with the webhook secret, signed recently. Any of several v1
+// values may match, so the secret can be rolled.
+func verifyWebhookSignature(header string, body []byte, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return errBadSignature
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > webhookTolerance || age < -webhookTolerance {
+		return fmt.Errorf("%w: timestamp outside tolerance", errBadSignature)
+	}
+
+	mac := hmac.New(sha256.New, webhookSecret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(expected), []byte(signature)) {
+			return nil
+		}
+	}
+	return errBadSignature
+}
+
+// Provider: receive a webhook. It's acknowledged once stored; processing
+// happens in the background so the provider isn't kept waiting.
+func receiveWebhook(w http.ResponseWriter, r *http.Request) {
+	if len(webhookSecret) == 0 {
+		http.Error(w, "Webhooks not configured", http.StatusServiceUnavailable)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, webhookMaxBodySize))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := verifyWebhookSignature(r.Header.Get(webhookSignatureHeader), body, time.Now()); err != nil {
+		log.Println("⚠️ Rejected payment webhook:", err)
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.ID == "" || payload.Type == "" {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+
+	event := WebhookEvent{
+		EventID:       payload.ID,
+		Type:          payload.Type,
+		Payload:       body,
+		Status:        webhookPending,
+		NextAttemptAt: time.Now(),
+	}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&event)
+	if result.Error != nil {
+		log.Println("❌ Error storing webhook event:", result.Error)
+		http.Error(w, "Error storing event", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		log.Printf("🔁 Duplicate webhook event %s ignored", payload.ID)
+		fmt.Fprintln(w, "Duplicate event")
+		return
+	}
+
+	log.Printf("📨 Webhook event %s (%s) received", payload.ID, payload.Type)
+	wakeWebhookWorker()
+	fmt.Fprintln(w, "Event received")
+}
+
+// Payment status moves webhooks may make. Anything else is a stale or
+// out-of-order event and is ignored.
+var paymentTransitions = map[string][]string{
+	paymentPending:           {paymentRequiresAction, paymentAuthorized, paymentCaptured, paymentFailed, paymentVoided},
+	paymentRequiresAction:    {paymentAuthorized, paymentCaptured, paymentFailed, paymentVoided},
+	paymentAuthorized:        {paymentCaptured, paymentFailed, paymentVoided},
+	paymentFailed:            {paymentRequiresAction, paymentAuthorized, paymentCaptured},
+	paymentCaptured:          {paymentPartiallyRefunded, paymentRefunded, paymentDisputed},
+	paymentPartiallyRefunded: {paymentPartiallyRefunded, paymentRefunded, paymentDisputed},
+	paymentDisputed:          {paymentCaptured, paymentRefunded},
+}
+
+// Order status moves that follow from payment events
+var orderTransitions = map[string][]string{
+	"PAID":             {"PENDING", orderPaymentFailed},
+	orderPaymentFailed: {"PENDING"},
+	orderDisputed:      {"PAID", "CONFIRMED", "FULFILLED"},
+}
+
+func canMovePayment(from, to string) bool {
+	for _, allowed := range paymentTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Move an order to status if the state machine allows it from where it
+// is, reporting whether it moved
+func moveOrder(tx *gorm.DB, orderID uint, status string) (bool, error) {
+	result := tx.Model(&Order{}).Where("id = ? AND status IN ?", orderID, orderTransitions[status]).Update("status", status)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("🔀 Order %d is now %s", orderID, status)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// Apply one event to its payment and order. An error means try again later.
+func processWebhookEvent(tx *gorm.DB, event WebhookEvent) error {
+	var payload webhookPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+	object := payload.Data.Object
+	providerID := object.ID
+	if strings.HasPrefix(payload.Type, "charge.") {
+		providerID = object.PaymentIntent
+	}
+
+	var status string
+	switch payload.Type {
+	case "payment_intent.amount_capturable_updated":
+		status = paymentAuthorized
+	case "payment_intent.requires_action":
+		status = paymentRequiresAction
+	case "payment_intent.succeeded":
+		status = paymentCaptured
+	case "payment_intent.payment_failed":
+		status = paymentFailed
+	case "payment_intent.canceled":
+		status = paymentVoided
+	case "charge.refunded":
+		status = paymentPartiallyRefunded
+	case "charge.dispute.created":
+		status = paymentDisputed
+	case "charge.dispute.closed":
+		// Only a lost dispute takes the money for good; won ones and closed
+		// inquiries (warning_closed) leave it with us
+		status = paymentCaptured
+		if object.Status == "lost" {
+			status = paymentRefunded
+		}
+	default:
+		log.Printf("ℹ️ Ignoring webhook event type %s", payload.Type)
+		return nil
+	}
+
+	// The webhook can beat our own record of the provider ID, so a payment
+	// we don't know yet is retried rather than dropped
+	var intent PaymentIntent
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("provider_id = ?", providerID).First(&intent).Error; err != nil {
+		return fmt.Errorf("payment %q: %w", providerID, err)
+	}
+
+	if status == paymentPartiallyRefunded {
+		intent.Refunded = max(intent.Refunded, object.AmountRefunded)
+		if intent.Refunded >= intent.Captured {
+			status = paymentRefunded
+		}
+	}
+	if !canMovePayment(intent.Status, status) {
+		log.Printf("ℹ️ Event %s ignored: payment %d is %s, not moving to %s", event.EventID, intent.ID, intent.Status, status)
+		return nil
+	}
+
+	previous := intent.Status
+	intent.Status = status
+	switch status {
+	case paymentDisputed:
+		var order Order
+		if err := tx.First(&order, intent.OrderID).Error; err != nil {
+			return err
+		}
+		intent.DisputedOrderStatus = order.Status
+	case paymentCaptured:
+		if object.AmountReceived > 0 {
+			intent.Captured = object.AmountReceived
+		} else if intent.Captured == 0 {
+			intent.Captured = intent.Amount
+		}
+		intent.FailureReason = ""
+	case paymentFailed:
+		intent.FailureReason = "payment failed"
+		if object.LastPaymentError != nil {
+			intent.FailureReason = object.LastPaymentError.Message
+		}
+	}
+	if err := tx.Save(&intent).Error; err != nil {
+		return err
+	}
+	log.Printf("💳 Payment %d for order %d: %s → %s", intent.ID, intent.OrderID, previous, status)
+
+	var err error
+	switch {
+	case status == paymentCaptured && previous != paymentDisputed:
+		// Digital goods go out from the delivery worker once this commits
+		var paid bool
+		paid, err = moveOrder(tx, intent.OrderID, "PAID")
+		if err == nil && !paid {
+			err = checkCapturedOrder(tx, intent)
+		}
+	case status == paymentFailed:
+		_, err = moveOrder(tx, intent.OrderID, orderPaymentFailed)
+	case status == paymentDisputed:
+		_, err = moveOrder(tx, intent.OrderID, orderDisputed)
+	case previous == paymentDisputed && status == paymentCaptured && intent.DisputedOrderStatus != "":
+		// Won: the order goes back to where it was
+		err = tx.Model(&Order{}).Where("id = ? AND status = ?", intent.OrderID, orderDisputed).Update("status", intent.DisputedOrderStatus).Error
+	}
+	return err
+}
+
+// Money taken for an order that was cancelled in the meantime has to go
+// back, so make sure an admin hears about it
+func checkCapturedOrder(tx *gorm.DB, intent PaymentIntent) error {
+	var order Order
+	if err := tx.Select("status").First(&order, intent.OrderID).Error; err != nil {
+		return err
+	}
+	if order.Status == "CANCELLED" {
+		log.Printf("⚠️ Payment %d captured %d %s for cancelled order %d; refund it", intent.ID, intent.Captured, intent.Currency, intent.OrderID)
+	}
+	return nil
+}
+
+// Process due events, backing off on failure
+func processPendingWebhooks() error {
+	processed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var events []WebhookEvent
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", webhookPending, time.Now()).
+			Order("id").
+			Limit(webhookBatchSize).
+			Find(&events).Error; err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			updates := map[string]interface{}{"attempts": event.Attempts + 1}
+			// Each event in its own savepoint so one failing doesn't undo the rest
+			if err := tx.Transaction(func(tx *gorm.DB) error { return processWebhookEvent(tx, event) }); err != nil {
+				updates["last_error"] = err.Error()
+				if event.Attempts+1 >= webhookMaxAttempts {
+					updates["status"] = webhookFailed
+					log.Printf("❌ Giving up on webhook event %s after %d attempts: %v", event.EventID, event.Attempts+1, err)
+				} else {
+					backoff := min(time.Duration(1<<uint(event.Attempts))*10*time.Second, webhookMaxBackoff)
+					updates["next_attempt_at"] = time.Now().Add(backoff)
+					log.Printf("⏳ Webhook event %s failed on attempt %d: %v", event.EventID, event.Attempts+1, err)
+				}
+			} else {
+				now := time.Now()
+				updates["status"] = webhookProcessed
+				updates["processed_at"] = &now
+				updates["last_error"] = ""
+				processed = true
+			}
+			if err := tx.Model(&WebhookEvent{}).Where("id = ?", event.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// Orders the events paid for are only visible now
+	if err == nil && processed {
+		wakeDeliveryWorker()
+	}
+	return err
+}
+
+var webhookWake = make(chan struct{}, 1)
+
+func wakeWebhookWorker() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// Background worker for received webhooks
+func runWebhookWorker() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+		if err := processPendingWebhooks(); err != nil {
+			log.Println("❌ Error processing webhook events:", err)
+		}
+	}
+}
+
+// Admin: webhook events, optionally by ?status=
+func listWebhookEvents(w http.ResponseWriter, r *http.Request) {
+	events := []WebhookEvent{}
+	tx := db.Order("id DESC").Limit(100)
+	if status := r.URL.Query().Get("status"); status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	tx.Find(&events)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// Admin: retry an event that was given up on
+func retryWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	result := db.Model(&WebhookEvent{}).
+		Where("id = ? AND status = ?", chi.URLParam(r, "id"), webhookFailed).
+		Updates(map[string]interface{}{"status": webhookPending, "attempts": 0, "next_attempt_at": time.Now()})
+	if result.Error != nil {
+		http.Error(w, "Error updating event", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "No failed event with that ID", http.StatusNotFound)
+		return
+	}
+	wakeWebhookWorker()
+	fmt.Fprintln(w, "Event queued for retry")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// A fixture from testdata/webhooks with its placeholders filled in, as
+// scripts/send-webhook.sh does
+func webhookFixture(t *testing.T, name, paymentID string, amount int64) []byte {
+	data, err := os.ReadFile("testdata/webhooks/" + name + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.ReplaceAll(string(data), "{{PAYMENT_ID}}", paymentID)
+	body = strings.ReplaceAll(body, "{{AMOUNT}}", strconv.FormatInt(amount, 10))
+	return []byte(body)
+}
+
+func webhookSignature(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func useWebhookSecret(t *testing.T, secret string) {
+	previous := webhookSecret
+	webhookSecret = []byte(secret)
+	t.Cleanup(func() { webhookSecret = previous })
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	useWebhookSecret(t, "whsec_current")
+	body := webhookFixture(t, "payment_intent.succeeded", "pi_fixture", 1999)
+	now := time.Now()
+	signed := func(secret string, at time.Time) string {
+		return fmt.Sprintf("t=%d,v1=%s", at.Unix(), webhookSignature(secret, at, body))
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		body   []byte
+		valid  bool
+	}{
+		{"valid", signed("whsec_current", now), body, true},
+		{"tampered body", signed("whsec_current", now), []byte(strings.Replace(string(body), "1999", "1", 1)), false},
+		{"stale timestamp", signed("whsec_current", now.Add(-webhookTolerance-time.Minute)), body, false},
+		{"future timestamp", signed("whsec_current", now.Add(webhookTolerance+time.Minute)), body, false},
+		{"wrong secret", signed("whsec_other", now), body, false},
+		{"rotated secret, new one first", fmt.Sprintf("t=%d,v1=%s,v1=%s", now.Unix(),
+			webhookSignature("whsec_current", now, body), webhookSignature("whsec_previous", now, body)), body, true},
+		{"rotated secret, new one last", fmt.Sprintf("t=%d,v1=%s,v1=%s", now.Unix(),
+			webhookSignature("whsec_previous", now, body), webhookSignature("whsec_current", now, body)), body, true},
+		{"only old secrets", fmt.Sprintf("t=%d,v1=%s,v1=%s", now.Unix(),
+			webhookSignature("whsec_previous", now, body), webhookSignature("whsec_older", now, body)), body, false},
+		{"no v1", fmt.Sprintf("t=%d,v0=%s", now.Unix(), webhookSignature("whsec_current", now, body)), body, false},
+		{"no timestamp", "v1=" + webhookSignature("whsec_current", now, body), body, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifyWebhookSignature(test.header, test.body, now)
+			if test.valid && err != nil {
+				t.Fatalf("got %v, want valid", err)
+			}
+			if !test.valid && !errors.Is(err, errBadSignature) {
+				t.Fatalf("got %v, want errBadSignature", err)
+			}
+		})
+	}
+}
+
+// Point db at a fresh in-memory database for the test
+func useTestDB(t *testing.T) {
+	testDB, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to ":memory:" is a database of its own
+	sqlDB, err := testDB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	if err := testDB.AutoMigrate(&Order{}, &OrderItem{}, &PaymentIntent{}, &WebhookEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		db = previous
+		sqlDB.Close()
+	})
+}
+
+// Send a signed fixture to the webhook endpoint and process what's pending
+func deliverWebhook(t *testing.T, fixture, paymentID string, amount int64) string {
+	body := webhookFixture(t, fixture, paymentID, amount)
+	r := httptest.NewRequest(http.MethodPost, "/payments/webhook", strings.NewReader(string(body)))
+	now := time.Now()
+	r.Header.Set(webhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", now.Unix(), webhookSignature("whsec_test", now, body)))
+	w := httptest.NewRecorder()
+	receiveWebhook(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: got %d %q", fixture, w.Code, w.Body.String())
+	}
+	if err := processPendingWebhooks(); err != nil {
+		t.Fatalf("%s: processing: %v", fixture, err)
+	}
+	return strings.TrimSpace(w.Body.String())
+}
+
+// An order awaiting payment with an authorized payment for it
+func pendingPayment(t *testing.T, providerID string, amount int64) (Order, PaymentIntent) {
+	order := Order{Email: "customer@example.com", Status: "PENDING", Currency: "USD"}
+	if err := db.Create(&order).Error; err != nil {
+		t.Fatal(err)
+	}
+	intent := PaymentIntent{OrderID: order.ID, Provider: "stripe", ProviderID: providerID, Amount: amount, Currency: "USD", Status: paymentAuthorized}
+	if err := db.Create(&intent).Error; err != nil {
+		t.Fatal(err)
+	}
+	return order, intent
+}
+
+func checkStatuses(t *testing.T, step string, order Order, intent PaymentIntent, orderStatus, paymentStatus string) {
+	t.Helper()
+	db.First(&order, order.ID)
+	db.First(&intent, intent.ID)
+	if order.Status != orderStatus || intent.Status != paymentStatus {
+		t.Fatalf("after %s: order %s and payment %s, want %s and %s", step, order.Status, intent.Status, orderStatus, paymentStatus)
+	}
+}
+
+func TestWebhookTransitions(t *testing.T) {
+	useWebhookSecret(t, "whsec_test")
+	useTestDB(t)
+	order, intent := pendingPayment(t, "pi_succeeds", 1999)
+
+	deliverWebhook(t, "payment_intent.succeeded", "pi_succeeds", 1999)
+	checkStatuses(t, "success", order, intent, "PAID", paymentCaptured)
+
+	// The provider redelivers: stored once, applied once
+	if got := deliverWebhook(t, "payment_intent.succeeded", "pi_succeeds", 1999); got != "Duplicate event" {
+		t.Fatalf("redelivery answered %q, want it recognised as a duplicate", got)
+	}
+	var stored int64
+	db.Model(&WebhookEvent{}).Where("event_id = ?", "evt_fixture_succeeded").Count(&stored)
+	if stored != 1 {
+		t.Fatalf("event stored %d times", stored)
+	}
+
+	deliverWebhook(t, "charge.dispute.created", "pi_succeeds", 0)
+	checkStatuses(t, "dispute", order, intent, orderDisputed, paymentDisputed)
+
+	deliverWebhook(t, "charge.dispute.closed", "pi_succeeds", 0)
+	checkStatuses(t, "won dispute", order, intent, "PAID", paymentCaptured)
+
+	deliverWebhook(t, "charge.refunded", "pi_succeeds", 500)
+	checkStatuses(t, "partial refund", order, intent, "PAID", paymentPartiallyRefunded)
+
+	var events []WebhookEvent
+	db.Order("id").Find(&events)
+	for _, event := range events {
+		if event.Status != webhookProcessed {
+			t.Errorf("event %s is %s: %s", event.EventID, event.Status, event.LastError)
+		}
+	}
+}
+
+func TestWebhookDisputeOutcomes(t *testing.T) {
+	useWebhookSecret(t, "whsec_test")
+	tests := []struct {
+		fixture       string
+		orderStatus   string
+		paymentStatus string
+	}{
+		{"charge.dispute.closed", "PAID", paymentCaptured},
+		{"charge.dispute.closed.warning_closed", "PAID", paymentCaptured},
+		{"charge.dispute.closed.lost", orderDisputed, paymentRefunded},
+	}
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			useTestDB(t)
+			order, intent := pendingPayment(t, "pi_disputed", 1999)
+			deliverWebhook(t, "payment_intent.succeeded", "pi_disputed", 1999)
+			deliverWebhook(t, "charge.dispute.created", "pi_disputed", 0)
+			deliverWebhook(t, test.fixture, "pi_disputed", 0)
+			checkStatuses(t, test.fixture, order, intent, test.orderStatus, test.paymentStatus)
+		})
+	}
+}
+
+func TestWebhookPaymentFailed(t *testing.T) {
+	useWebhookSecret(t, "whsec_test")
+	useTestDB(t)
+	order, intent := pendingPayment(t, "pi_fails", 1999)
+
+	deliverWebhook(t, "payment_intent.payment_failed", "pi_fails", 0)
+	checkStatuses(t, "failure", order, intent, orderPaymentFailed, paymentFailed)
+	db.First(&intent, intent.ID)
+	if intent.FailureReason != "Your card has insufficient funds." {
+		t.Fatalf("failure reason %q", intent.FailureReason)
+	}
+
+	// A late failure can't undo a payment that went through
+	succeeded, paid := pendingPayment(t, "pi_paid", 1999)
+	deliverWebhook(t, "payment_intent.succeeded", "pi_paid", 1999)
+	// The fixture's event ID was used above; forget it so this isn't a duplicate
+	db.Model(&WebhookEvent{}).Where("event_id = ?", "evt_fixture_failed").Delete(&WebhookEvent{})
+	deliverWebhook(t, "payment_intent.payment_failed", "pi_paid", 0)
+	checkStatuses(t, "late failure", succeeded, paid, "PAID", paymentCaptured)
+}
+
+func TestWebhookForUnknownPaymentIsRetried(t *testing.T) {
+	useWebhookSecret(t, "whsec_test")
+	useTestDB(t)
+
+	deliverWebhook(t, "payment_intent.succeeded", "pi_not_recorded_yet", 1999)
+	var event WebhookEvent
+	db.First(&event, "event_id = ?", "evt_fixture_succeeded")
+	if event.Status != webhookPending || event.Attempts != 1 || event.LastError == "" {
+		t.Fatalf("got %+v, want it pending a retry", event)
+	}
+}
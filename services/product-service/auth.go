@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWT Secret Key, shared with Auth Service
+var jwtSecret = []byte("your_secret_key")
+
+// The parts of an Auth Service token this service needs
+type Claims struct {
+	Role          string `json:"role"`
+	CustomerGroup string `json:"customer_group"`
+	jwt.RegisteredClaims
+}
+
+// Claims of the caller's token, or nil without a valid one
+func tokenClaims(r *http.Request) *Claims {
+	tokenStr := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if tokenStr == "" {
+		return nil
+	}
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return nil
+	}
+	return claims
+}
+
+// Middleware: Admin Access Only
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := tokenClaims(r)
+		if claims == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if claims.Role != "admin" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
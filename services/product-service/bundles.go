@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+// Bundles are sold as one product but ship as their components. They have
+// no stock of their own; Inventory Service derives it from the components.
+const productTypeBundle = "bundle"
+
+// BundleComponent says a bundle contains Quantity units of a component
+type BundleComponent struct {
+	BundleID    uint     `gorm:"primaryKey" json:"-"`
+	ComponentID uint     `gorm:"primaryKey" json:"product_id"`
+	Quantity    int      `json:"quantity"`
+	Component   *Product `gorm:"foreignKey:ComponentID" json:"product,omitempty"`
+}
+
+type componentRequest struct {
+	ProductID uint `json:"product_id"`
+	Quantity  int  `json:"quantity"`
+}
+
+// Check a bundle's components: at least one, each a distinct physical
+// product in a positive quantity
+func validateComponents(bundleID uint, requested []componentRequest) ([]BundleComponent, error) {
+	if len(requested) == 0 {
+		return nil, errors.New("a bundle needs at least one component")
+	}
+
+	components := make([]BundleComponent, 0, len(requested))
+	seen := map[uint]bool{}
+	for _, c := range requested {
+		if c.Quantity <= 0 {
+			return nil, fmt.Errorf("quantity of product %d must be positive", c.ProductID)
+		}
+		if c.ProductID == bundleID || seen[c.ProductID] {
+			return nil, fmt.Errorf("product %d is listed twice", c.ProductID)
+		}
+		seen[c.ProductID] = true
+
+		var component Product
+		if err := db.First(&component, c.ProductID).Error; err != nil {
+			return nil, fmt.Errorf("product %d not found", c.ProductID)
+		}
+		// Only physical products have stock to build a bundle from
+		if component.Type != productTypePhysical {
+			return nil, fmt.Errorf("product %d is %s; only physical products can be components", c.ProductID, component.Type)
+		}
+		components = append(components, BundleComponent{BundleID: bundleID, ComponentID: c.ProductID, Quantity: c.Quantity})
+	}
+	return components, nil
+}
+
+func bundleComponents(bundleID uint) ([]BundleComponent, error) {
+	components := []BundleComponent{}
+	err := db.Preload("Component").Where("bundle_id = ?", bundleID).Order("component_id").Find(&components).Error
+	return components, err
+}
+
+// Like findProduct, but only for bundles
+func findBundle(w http.ResponseWriter, r *http.Request) (Product, bool) {
+	product, ok := findProduct(w, r)
+	if ok && product.Type != productTypeBundle {
+		http.Error(w, "Product is not a bundle", http.StatusBadRequest)
+		return product, false
+	}
+	return product, ok
+}
+
+func getBundleComponents(w http.ResponseWriter, r *http.Request) {
+	bundle, ok := findBundle(w, r)
+	if !ok {
+		return
+	}
+
+	components, err := bundleComponents(bundle.ID)
+	if err != nil {
+		log.Println("❌ Error loading bundle components:", err)
+		http.Error(w, "Error loading components", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(components)
+}
+
+// Admin: replace a bundle's components. Orders already placed keep the
+// composition they were placed with.
+func setBundleComponents(w http.ResponseWriter, r *http.Request) {
+	bundle, ok := findBundle(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Components []componentRequest `json:"components"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid component data", http.StatusBadRequest)
+		return
+	}
+	components, err := validateComponents(bundle.ID, request.Components)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("bundle_id = ?", bundle.ID).Delete(&BundleComponent{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&components).Error; err != nil {
+			return err
+		}
+		return enqueueCatalogEvent(tx, eventProductUpdated, bundle.ID, "components")
+	})
+	if err != nil {
+		log.Println("❌ Error saving bundle components:", err)
+		http.Error(w, "Error saving components", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🎁 Bundle %d now has %d component(s)", bundle.ID, len(components))
+	components, _ = bundleComponents(bundle.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(components)
+}
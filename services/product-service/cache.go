@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-redis/redis/v8"
+)
+
+// Cached reads expire on their own after this long even without an event,
+// which bounds staleness for things that change with time (sale windows)
+// or outside this service (ratings).
+const cacheTTL = time.Minute
+
+// Cache keys embed generation counters. Invalidating means bumping a
+// counter, which orphans every key built from the old value.
+const (
+	catalogGenerationKey = "catalog:gen"
+	listGenerationKey    = "catalog:gen:lists"
+)
+
+func productGenerationKey(productID string) string {
+	return "catalog:gen:product:" + productID
+}
+
+// What we keep for a cached response
+type cachedResponse struct {
+	Header map[string]string `json:"header"`
+	Body   []byte            `json:"body"`
+}
+
+// Headers worth replaying from a cached response
+var cachedHeaders = []string{"Content-Type", "ETag", "Cache-Control", "Link", "X-Total-Count"}
+
+// Records a handler's response so it can be stored
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Canonical form of the query string so ?a=1&b=2 and ?b=2&a=1 share a key
+func canonicalQuery(r *http.Request) string {
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		fmt.Fprintf(&b, "%s=%s&", key, strings.Join(values, ","))
+	}
+	return b.String()
+}
+
+// Build the cache key for a read. Product reads depend on that product's
+// generation, listings on the list generation; both on the catalog one.
+func cacheKey(ctx context.Context, r *http.Request, productID string) (string, error) {
+	generationKey := listGenerationKey
+	if productID != "" {
+		generationKey = productGenerationKey(productID)
+	}
+
+	generations, err := rdb.MGet(ctx, catalogGenerationKey, generationKey).Result()
+	if err != nil {
+		return "", err
+	}
+	// Prices depend on the caller's customer group, so entries do too
+	return fmt.Sprintf("catalog:cache:%v:%v:%s:%s?%s", generations[0], generations[1], customerGroup(r), r.URL.Path, canonicalQuery(r)), nil
+}
+
+// Read-through cache for GET handlers. With perProduct, entries are keyed
+// on the {id} URL parameter so a product event only drops that product.
+func cached(perProduct bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		productID := ""
+		if perProduct {
+			productID = chi.URLParam(r, "id")
+		}
+		key, err := cacheKey(ctx, r, productID)
+		if err != nil {
+			log.Println("⚠️ Cache unavailable:", err)
+			next(w, r)
+			return
+		}
+
+		// Internal callers pricing an order can insist on a fresh response,
+		// which then replaces the cached one
+		var stored []byte
+		err = redis.Nil
+		if !isInternal(r) || !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+			stored, err = rdb.Get(ctx, key).Bytes()
+		}
+		if err == nil {
+			var entry cachedResponse
+			if json.Unmarshal(stored, &entry) == nil {
+				for name, value := range entry.Header {
+					w.Header().Set(name, value)
+				}
+				w.Header().Set("X-Cache", "HIT")
+				if etag := entry.Header["ETag"]; etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Write(entry.Body)
+				return
+			}
+		} else if err != redis.Nil {
+			log.Println("⚠️ Cache read failed:", err)
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		recorder := &responseRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		// Only full successful responses are worth keeping; a 304 has no body
+		if recorder.status != http.StatusOK {
+			return
+		}
+		entry := cachedResponse{Header: map[string]string{}, Body: recorder.body.Bytes()}
+		for _, name := range cachedHeaders {
+			if value := w.Header().Get(name); value != "" {
+				entry.Header[name] = value
+			}
+		}
+		data, _ := json.Marshal(entry)
+		if err := rdb.Set(ctx, key, data, cacheTTL).Err(); err != nil {
+			log.Println("⚠️ Cache write failed:", err)
+		}
+	}
+}
+
+// Drop cached reads of one product and every listing
+func invalidateProduct(ctx context.Context, productID uint) error {
+	pipe := rdb.TxPipeline()
+	pipe.Incr(ctx, productGenerationKey(fmt.Sprint(productID)))
+	pipe.Incr(ctx, listGenerationKey)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Drop every cached read
+func invalidateCatalog(ctx context.Context) error {
+	return rdb.Incr(ctx, catalogGenerationKey).Err()
+}
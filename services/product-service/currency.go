@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"ecommerce/pkg/money"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Currency every Product.Price is stored in
+var baseCurrency = strings.ToUpper(getEnv("BASE_CURRENCY", "USD"))
+
+// File the exchange rates are loaded from at startup and on reload
+var exchangeRatesFile = os.Getenv("EXCHANGE_RATES_FILE")
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// ExchangeRate is how many units of Currency one unit of the base currency buys
+type ExchangeRate struct {
+	Currency  string    `gorm:"primaryKey;size:3" json:"currency"`
+	Rate      float64   `json:"rate"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ProductCurrencyPrice overrides conversion with an explicit list price
+type ProductCurrencyPrice struct {
+	ProductID uint    `gorm:"primaryKey" json:"product_id"`
+	Currency  string  `gorm:"primaryKey;size:3" json:"currency"`
+	Price     float64 `json:"price"`
+}
+
+// Parse ?currency=, defaulting to the base currency
+func requestedCurrency(r *http.Request) (string, error) {
+	currency := strings.ToUpper(r.URL.Query().Get("currency"))
+	if currency == "" {
+		return baseCurrency, nil
+	}
+	if !currencyCode.MatchString(currency) {
+		return "", fmt.Errorf("invalid currency %q", currency)
+	}
+	return currency, nil
+}
+
+// Converts base-currency amounts for a set of products into one currency
+type currencyConverter struct {
+	currency string
+	rate     float64
+	explicit map[uint]float64
+}
+
+// Load the rate and any explicit prices needed to show productIDs in currency
+func newCurrencyConverter(currency string, productIDs []uint) (*currencyConverter, error) {
+	converter := &currencyConverter{currency: currency, rate: 1, explicit: map[uint]float64{}}
+	if currency == baseCurrency {
+		return converter, nil
+	}
+
+	var prices []ProductCurrencyPrice
+	if len(productIDs) > 0 {
+		if err := db.Where("currency = ? AND product_id IN ?", currency, productIDs).Find(&prices).Error; err != nil {
+			return nil, err
+		}
+	}
+	for _, price := range prices {
+		converter.explicit[price.ProductID] = price.Price
+	}
+
+	var rate ExchangeRate
+	err := db.First(&rate, "currency = ?", currency).Error
+	switch {
+	case err == nil:
+		converter.rate = rate.Rate
+	case err == gorm.ErrRecordNotFound:
+		// Without a rate only products with explicit prices can be shown
+		converter.rate = 0
+		for _, id := range productIDs {
+			if _, ok := converter.explicit[id]; !ok {
+				return nil, fmt.Errorf("unsupported currency %s", currency)
+			}
+		}
+	default:
+		return nil, err
+	}
+	return converter, nil
+}
+
+// List price of a product in the target currency
+func (c *currencyConverter) listPrice(productID uint, basePrice float64) float64 {
+	if price, ok := c.explicit[productID]; ok {
+		return price
+	}
+	return money.Round(basePrice*c.rate, c.currency)
+}
+
+// Convert a quote. Sale and price-list prices are set in the base currency
+// and converted; an unmodified base price uses the explicit price if any.
+func (c *currencyConverter) quote(productID uint, quote priceQuote) priceQuote {
+	converted := quote
+	converted.BasePrice = c.listPrice(productID, quote.BasePrice)
+	if quote.PriceSource == priceSourceBase {
+		converted.EffectivePrice = converted.BasePrice
+	} else if c.rate > 0 {
+		converted.EffectivePrice = money.Round(quote.EffectivePrice*c.rate, c.currency)
+	} else {
+		// No rate to convert the discount with; fall back to the list price
+		converted.EffectivePrice = converted.BasePrice
+		converted.PriceSource = priceSourceBase
+		converted.SaleEndsAt = nil
+	}
+	return converted
+}
+
+// Rewrite Price and Currency of products in place
+func (c *currencyConverter) products(products []*Product) {
+	for _, product := range products {
+		product.Price = c.listPrice(product.ID, product.Price)
+		product.Currency = c.currency
+	}
+}
+
+// Show a list of products in the requested currency
+func localizeProducts(currency string, products []*Product) error {
+	ids := make([]uint, len(products))
+	for i, product := range products {
+		ids[i] = product.ID
+	}
+	converter, err := newCurrencyConverter(currency, ids)
+	if err != nil {
+		return err
+	}
+	converter.products(products)
+	return nil
+}
+
+// Exchange rate file format, e.g. {"base": "USD", "rates": {"EUR": 0.92}}
+type exchangeRateFile struct {
+	Base  string             `json:"base"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+// Replace the exchange-rate table with the contents of path
+func loadExchangeRates(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var file exchangeRateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if strings.ToUpper(file.Base) != baseCurrency {
+		return 0, fmt.Errorf("rates are based on %s, but the catalog is priced in %s", file.Base, baseCurrency)
+	}
+
+	rates := make([]ExchangeRate, 0, len(file.Rates))
+	for currency, rate := range file.Rates {
+		currency = strings.ToUpper(currency)
+		if !currencyCode.MatchString(currency) || rate <= 0 {
+			return 0, fmt.Errorf("invalid rate %s=%v", currency, rate)
+		}
+		rates = append(rates, ExchangeRate{Currency: currency, Rate: rate, UpdatedAt: time.Now()})
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&ExchangeRate{}).Error; err != nil {
+			return err
+		}
+		if len(rates) > 0 {
+			if err := tx.Create(&rates).Error; err != nil {
+				return err
+			}
+		}
+		return enqueueCatalogEvent(tx, eventCatalogInvalidated, 0, "exchange_rates")
+	})
+	return len(rates), err
+}
+
+func listExchangeRates(w http.ResponseWriter, r *http.Request) {
+	rates := []ExchangeRate{}
+	if err := db.Order("currency").Find(&rates).Error; err != nil {
+		log.Println("❌ Error listing exchange rates:", err)
+		http.Error(w, "Error listing exchange rates", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"base": baseCurrency, "rates": rates})
+}
+
+// Admin: reload EXCHANGE_RATES_FILE
+func reloadExchangeRates(w http.ResponseWriter, r *http.Request) {
+	if exchangeRatesFile == "" {
+		http.Error(w, "EXCHANGE_RATES_FILE is not configured", http.StatusConflict)
+		return
+	}
+
+	count, err := loadExchangeRates(exchangeRatesFile)
+	if err != nil {
+		log.Println("❌ Error loading exchange rates:", err)
+		http.Error(w, "Error loading exchange rates: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	log.Printf("💱 Loaded %d exchange rates from %s", count, exchangeRatesFile)
+	listExchangeRates(w, r)
+}
+
+// Get a product's explicit prices by currency
+func getCurrencyPrices(w http.ResponseWriter, r *http.Request) {
+	product, ok := findProduct(w, r)
+	if !ok {
+		return
+	}
+
+	prices := []ProductCurrencyPrice{}
+	if err := db.Where("product_id = ?", product.ID).Order("currency").Find(&prices).Error; err != nil {
+		log.Println("❌ Error listing currency prices:", err)
+		http.Error(w, "Error listing currency prices", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prices)
+}
+
+// Set explicit prices, e.g. {"prices": {"EUR": 19.99, "JPY": null}}; null
+// removes a price so that currency is converted again
+func setCurrencyPrices(w http.ResponseWriter, r *http.Request) {
+	product, ok := findProduct(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Prices map[string]*float64 `json:"prices"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+	for currency, price := range request.Prices {
+		if !currencyCode.MatchString(currency) || currency == baseCurrency {
+			http.Error(w, fmt.Sprintf("Invalid currency %q", currency), http.StatusBadRequest)
+			return
+		}
+		if price != nil && *price < 0 {
+			http.Error(w, fmt.Sprintf("Price in %s must not be negative", currency), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for currency, price := range request.Prices {
+			if price == nil {
+				if err := tx.Delete(&ProductCurrencyPrice{}, "product_id = ? AND currency = ?", product.ID, currency).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&ProductCurrencyPrice{
+				ProductID: product.ID,
+				Currency:  currency,
+				Price:     money.Round(*price, currency),
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return enqueueCatalogEvent(tx, eventProductUpdated, product.ID, "currency_prices")
+	})
+	if err != nil {
+		log.Println("❌ Error setting currency prices:", err)
+		http.Error(w, "Error setting currency prices", http.StatusInternalServerError)
+		return
+	}
+
+	getCurrencyPrices(w, r)
+}
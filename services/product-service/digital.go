@@ -0,0 +1,543 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Product types. Digital products have no inventory; they are delivered as
+// license keys and/or downloadable files once the order is paid.
+const (
+	productTypePhysical = "physical"
+	productTypeDigital  = "digital"
+)
+
+const (
+	maxDigitalFileSize = 512 << 20 // 512 MB
+	// Stored files live under this prefix and are never served by /media
+	digitalKeyPrefix = "digital/"
+)
+
+// Secret used to sign download links
+var downloadSigningKey = []byte(getEnv("DOWNLOAD_SIGNING_KEY", ""))
+
+// How long a signed download link stays valid (DOWNLOAD_URL_TTL, read in
+// main)
+var downloadURLTTL time.Duration
+
+// LicenseKey is one key in a product's pool. It is sold at most once.
+type LicenseKey struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	ProductID   uint       `gorm:"uniqueIndex:idx_license_keys_product_key" json:"product_id"`
+	Key         string     `gorm:"uniqueIndex:idx_license_keys_product_key" json:"key"`
+	OrderItemID *uint      `gorm:"index" json:"order_item_id,omitempty"`
+	AssignedAt  *time.Time `json:"assigned_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// DigitalFile is delivered to every buyer of its product
+type DigitalFile struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	ProductID   uint      `gorm:"index" json:"product_id"`
+	FileName    string    `json:"file_name"`
+	Key         string    `json:"-"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// DigitalDelivery records that an order item was paid for. Quantity license
+// keys are owed; if the pool ran dry the rest are assigned when restocked.
+type DigitalDelivery struct {
+	OrderItemID uint      `gorm:"primaryKey" json:"order_item_id"`
+	OrderID     uint      `gorm:"index" json:"order_id"`
+	ProductID   uint      `gorm:"index" json:"product_id"`
+	Quantity    int       `json:"quantity"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// What a customer gets for one order item
+type deliveryView struct {
+	OrderItemID     uint           `json:"order_item_id"`
+	ProductID       uint           `json:"product_id"`
+	LicenseKeys     []string       `json:"license_keys"`
+	PendingKeys     int            `json:"pending_keys,omitempty"` // owed but not yet in stock
+	Downloads       []downloadLink `json:"downloads"`
+	DownloadExpires *time.Time     `json:"downloads_expire_at,omitempty"`
+}
+
+type downloadLink struct {
+	FileID   uint   `json:"file_id"`
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
+}
+
+func validProductType(productType string) bool {
+	return productType == productTypePhysical || productType == productTypeDigital || productType == productTypeBundle
+}
+
+// Whether buyers of a product are owed license keys. A product sold only as
+// a download has files and no key pool; one with neither is waiting for keys.
+func owesKeys(poolSize int64, files int) bool {
+	return poolSize > 0 || files == 0
+}
+
+// Like findProduct, but only for digital products
+func findDigitalProduct(w http.ResponseWriter, r *http.Request) (Product, bool) {
+	product, ok := findProduct(w, r)
+	if ok && product.Type != productTypeDigital {
+		http.Error(w, "Product is not digital", http.StatusBadRequest)
+		return product, false
+	}
+	return product, ok
+}
+
+// Assign keys from the pool to deliveries that are still owed some, oldest
+// first. Locked rows are skipped so concurrent assignments never share a key.
+func assignLicenseKeys(tx *gorm.DB, productID uint) error {
+	var deliveries []DigitalDelivery
+	if err := tx.Where("product_id = ?", productID).Order("created_at, order_item_id").Find(&deliveries).Error; err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		var assigned int64
+		if err := tx.Model(&LicenseKey{}).Where("order_item_id = ?", delivery.OrderItemID).Count(&assigned).Error; err != nil {
+			return err
+		}
+		owed := delivery.Quantity - int(assigned)
+		if owed <= 0 {
+			continue
+		}
+
+		var keys []LicenseKey
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("product_id = ? AND order_item_id IS NULL", productID).
+			Order("id").
+			Limit(owed).
+			Find(&keys).Error; err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil // pool is empty; later deliveries stay owed too
+		}
+
+		ids := make([]uint, len(keys))
+		for i, key := range keys {
+			ids[i] = key.ID
+		}
+		if err := tx.Model(&LicenseKey{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"order_item_id": delivery.OrderItemID,
+			"assigned_at":   time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		log.Printf("🔑 Assigned %d license key(s) to order item %d", len(keys), delivery.OrderItemID)
+	}
+	return nil
+}
+
+// Admin: add license keys to a product's pool. Keys already in the pool
+// are ignored.
+func addLicenseKeys(w http.ResponseWriter, r *http.Request) {
+	product, ok := findDigitalProduct(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid license key data", http.StatusBadRequest)
+		return
+	}
+
+	var keys []LicenseKey
+	for _, key := range request.Keys {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, LicenseKey{ProductID: product.ID, Key: key})
+		}
+	}
+	if len(keys) == 0 {
+		http.Error(w, "No license keys given", http.StatusBadRequest)
+		return
+	}
+
+	var added int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&keys)
+		if result.Error != nil {
+			return result.Error
+		}
+		added = result.RowsAffected
+		// Customers who bought while the pool was empty come first
+		return assignLicenseKeys(tx, product.ID)
+	})
+	if err != nil {
+		log.Println("❌ Error adding license keys:", err)
+		http.Error(w, "Error adding license keys", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔑 Added %d license key(s) to Product ID %d", added, product.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int64{"added": added})
+}
+
+// Admin: how many keys are left in a product's pool
+func licenseKeyStats(w http.ResponseWriter, r *http.Request) {
+	product, ok := findDigitalProduct(w, r)
+	if !ok {
+		return
+	}
+
+	var stats struct {
+		Available int64 `json:"available"`
+		Assigned  int64 `json:"assigned"`
+		Owed      int64 `json:"owed"`
+	}
+	db.Model(&LicenseKey{}).Where("product_id = ? AND order_item_id IS NULL", product.ID).Count(&stats.Available)
+	db.Model(&LicenseKey{}).Where("product_id = ? AND order_item_id IS NOT NULL", product.ID).Count(&stats.Assigned)
+	var files int64
+	db.Model(&DigitalFile{}).Where("product_id = ?", product.ID).Count(&files)
+	if owesKeys(stats.Available+stats.Assigned, int(files)) {
+		db.Model(&DigitalDelivery{}).Where("product_id = ?", product.ID).Select("COALESCE(SUM(quantity), 0)").Scan(&stats.Owed)
+		stats.Owed -= stats.Assigned
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// Admin: upload a downloadable file (multipart field "file")
+func uploadDigitalFile(w http.ResponseWriter, r *http.Request) {
+	product, ok := findDigitalProduct(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxDigitalFileSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, `Missing "file" field`, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+
+	name, err := randomName()
+	if err != nil {
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		return
+	}
+	fileName := path.Base(header.Filename)
+	contentType := mime.TypeByExtension(path.Ext(fileName))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	digitalFile := DigitalFile{
+		ProductID:   product.ID,
+		FileName:    fileName,
+		Key:         fmt.Sprintf("%s%d/%s%s", digitalKeyPrefix, product.ID, name, path.Ext(fileName)),
+		ContentType: contentType,
+		Size:        header.Size,
+	}
+	if err := storage.Put(r.Context(), digitalFile.Key, file, header.Size, contentType); err != nil {
+		log.Println("❌ Error storing digital file:", err)
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		return
+	}
+	if err := db.Create(&digitalFile).Error; err != nil {
+		storage.Delete(r.Context(), digitalFile.Key)
+		log.Println("❌ Error saving digital file:", err)
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("💾 Uploaded %s for Product ID %d", fileName, product.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(digitalFile)
+}
+
+func listDigitalFiles(w http.ResponseWriter, r *http.Request) {
+	product, ok := findDigitalProduct(w, r)
+	if !ok {
+		return
+	}
+
+	files := []DigitalFile{}
+	db.Where("product_id = ?", product.ID).Order("id").Find(&files)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+// Admin: remove a file. Links already handed out stop working.
+func deleteDigitalFile(w http.ResponseWriter, r *http.Request) {
+	product, ok := findDigitalProduct(w, r)
+	if !ok {
+		return
+	}
+
+	var digitalFile DigitalFile
+	if err := db.First(&digitalFile, "id = ? AND product_id = ?", chi.URLParam(r, "fileID"), product.ID).Error; err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err := db.Delete(&digitalFile).Error; err != nil {
+		log.Println("❌ Error deleting digital file:", err)
+		http.Error(w, "Error deleting file", http.StatusInternalServerError)
+		return
+	}
+	if err := storage.Delete(r.Context(), digitalFile.Key); err != nil {
+		log.Printf("⚠️ Could not delete stored file %s: %v", digitalFile.Key, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Called by Order Service when an order is paid. Safe to repeat: an order
+// item is only ever delivered once.
+func createDeliveries(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		OrderID uint `json:"order_id"`
+		Items   []struct {
+			OrderItemID uint `json:"order_item_id"`
+			ProductID   uint `json:"product_id"`
+			Quantity    int  `json:"quantity"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.OrderID == 0 {
+		http.Error(w, "Invalid delivery data", http.StatusBadRequest)
+		return
+	}
+
+	var deliveries []DigitalDelivery
+	productIDs := map[uint]bool{}
+	for _, item := range request.Items {
+		if item.OrderItemID == 0 || item.Quantity <= 0 {
+			http.Error(w, "Invalid delivery item", http.StatusBadRequest)
+			return
+		}
+		deliveries = append(deliveries, DigitalDelivery{
+			OrderItemID: item.OrderItemID,
+			OrderID:     request.OrderID,
+			ProductID:   item.ProductID,
+			Quantity:    item.Quantity,
+		})
+		productIDs[item.ProductID] = true
+	}
+	for productID := range productIDs {
+		var product Product
+		if err := db.First(&product, productID).Error; err != nil || product.Type != productTypeDigital {
+			http.Error(w, fmt.Sprintf("Product %d is not a digital product", productID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if len(deliveries) > 0 {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&deliveries).Error; err != nil {
+				return err
+			}
+		}
+		for productID := range productIDs {
+			if err := assignLicenseKeys(tx, productID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("❌ Error creating deliveries:", err)
+		http.Error(w, "Error delivering digital items", http.StatusInternalServerError)
+		return
+	}
+
+	itemIDs := make([]uint, len(deliveries))
+	for i, delivery := range deliveries {
+		itemIDs[i] = delivery.OrderItemID
+	}
+	views, err := deliveryViews(itemIDs)
+	if err != nil {
+		log.Println("❌ Error loading deliveries:", err)
+		http.Error(w, "Error loading deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📬 Delivered %d digital item(s) for order %d", len(deliveries), request.OrderID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// Called by Order Service for a customer's order history. Download links
+// are signed afresh on every call.
+func getDeliveries(w http.ResponseWriter, r *http.Request) {
+	var itemIDs []uint
+	for _, raw := range strings.Split(r.URL.Query().Get("order_item_ids"), ",") {
+		if raw == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid order_item_ids", http.StatusBadRequest)
+			return
+		}
+		itemIDs = append(itemIDs, uint(id))
+	}
+
+	views, err := deliveryViews(itemIDs)
+	if err != nil {
+		log.Println("❌ Error loading deliveries:", err)
+		http.Error(w, "Error loading deliveries", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func deliveryViews(itemIDs []uint) ([]deliveryView, error) {
+	views := []deliveryView{}
+	if len(itemIDs) == 0 {
+		return views, nil
+	}
+
+	var deliveries []DigitalDelivery
+	if err := db.Where("order_item_id IN ?", itemIDs).Order("order_item_id").Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	var keys []LicenseKey
+	if err := db.Where("order_item_id IN ?", itemIDs).Order("id").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	keysByItem := map[uint][]string{}
+	for _, key := range keys {
+		keysByItem[*key.OrderItemID] = append(keysByItem[*key.OrderItemID], key.Key)
+	}
+
+	filesByProduct := map[uint][]DigitalFile{}
+	soldWithKeys := map[uint]bool{}
+	for _, delivery := range deliveries {
+		if _, ok := filesByProduct[delivery.ProductID]; ok {
+			continue
+		}
+		var files []DigitalFile
+		if err := db.Where("product_id = ?", delivery.ProductID).Order("id").Find(&files).Error; err != nil {
+			return nil, err
+		}
+		filesByProduct[delivery.ProductID] = files
+		var pool int64
+		if err := db.Model(&LicenseKey{}).Where("product_id = ?", delivery.ProductID).Count(&pool).Error; err != nil {
+			return nil, err
+		}
+		soldWithKeys[delivery.ProductID] = owesKeys(pool, len(files))
+	}
+
+	expires := time.Now().Add(downloadURLTTL).Truncate(time.Second)
+	for _, delivery := range deliveries {
+		view := deliveryView{
+			OrderItemID: delivery.OrderItemID,
+			ProductID:   delivery.ProductID,
+			LicenseKeys: keysByItem[delivery.OrderItemID],
+			Downloads:   []downloadLink{},
+		}
+		if view.LicenseKeys == nil {
+			view.LicenseKeys = []string{}
+		}
+		// Products that only have files don't owe keys
+		if soldWithKeys[delivery.ProductID] && len(view.LicenseKeys) < delivery.Quantity {
+			view.PendingKeys = delivery.Quantity - len(view.LicenseKeys)
+		}
+		for _, file := range filesByProduct[delivery.ProductID] {
+			view.Downloads = append(view.Downloads, downloadLink{
+				FileID:   file.ID,
+				FileName: file.FileName,
+				Size:     file.Size,
+				URL:      signedDownloadURL(file.ID, delivery.OrderItemID, expires),
+			})
+		}
+		if len(view.Downloads) > 0 {
+			view.DownloadExpires = &expires
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+func downloadSignature(fileID, orderItemID uint, expires int64) string {
+	mac := hmac.New(sha256.New, downloadSigningKey)
+	fmt.Fprintf(mac, "%d:%d:%d", fileID, orderItemID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signedDownloadURL(fileID, orderItemID uint, expires time.Time) string {
+	return fmt.Sprintf("%s/downloads/%d?item=%d&expires=%d&signature=%s",
+		publicBaseURL, fileID, orderItemID, expires.Unix(), downloadSignature(fileID, orderItemID, expires.Unix()))
+}
+
+// Serve a file to whoever holds a valid, unexpired signed link
+func downloadDigitalFile(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	fileID, err := strconv.ParseUint(chi.URLParam(r, "fileID"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	orderItemID, err1 := strconv.ParseUint(query.Get("item"), 10, 64)
+	expires, err2 := strconv.ParseInt(query.Get("expires"), 10, 64)
+	expected := downloadSignature(uint(fileID), uint(orderItemID), expires)
+	if err1 != nil || err2 != nil || !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		http.Error(w, "Invalid download link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "Download link expired", http.StatusGone)
+		return
+	}
+
+	var digitalFile DigitalFile
+	if err := db.First(&digitalFile, fileID).Error; err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := storage.Open(r.Context(), digitalFile.Key)
+	if errors.Is(err, errObjectNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Error opening %s: %v", digitalFile.Key, err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", digitalFile.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": digitalFile.FileName}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("❌ Error serving %s: %v", digitalFile.Key, err)
+	}
+	log.Printf("⬇️ Order item %d downloaded %s", orderItemID, digitalFile.FileName)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+// Catalog change events are published to this Redis stream through the
+// outbox, so an event exists if and only if its change was committed.
+//
+// Stream entry fields:
+//
+//	schema_version  "1"
+//	type            one of the eventProduct* constants
+//	product_id      affected product, "0" for catalog-wide events
+//	event           the catalogEvent as JSON
+//
+// Consumers should skip entries whose schema_version they don't know.
+const (
+	catalogStream        = "catalog.events"
+	catalogSchemaVersion = 1
+	catalogStreamMaxLen  = 100000
+
+	topicCatalogPublish = "catalog.publish"
+
+	eventProductCreated = "product.created"
+	eventProductUpdated = "product.updated"
+	eventProductDeleted = "product.deleted"
+	// Something that affects many products changed (e.g. exchange rates)
+	eventCatalogInvalidated = "catalog.invalidated"
+)
+
+// Consumer group that invalidates the shared product cache, and how long
+// a failed invalidation waits before it is tried again
+const (
+	cacheConsumerGroup = "product-service-cache"
+	cacheRetryInterval = 30 * time.Second
+)
+
+var rdb *redis.Client
+
+// catalogEvent is schema version 1 of a catalog change event
+type catalogEvent struct {
+	SchemaVersion int                    `json:"schema_version"`
+	Type          string                 `json:"type"`
+	ProductID     uint                   `json:"product_id,omitempty"`
+	OccurredAt    time.Time              `json:"occurred_at"`
+	Changes       []string               `json:"changes,omitempty"` // what changed, e.g. "price", "images"
+	Product       map[string]interface{} `json:"product,omitempty"`
+}
+
+// Connect to Redis
+func connectRedis() {
+	rdb = redis.NewClient(&redis.Options{Addr: getEnv("REDIS_ADDR", "redis:6379")})
+	if _, err := rdb.Ping(context.Background()).Result(); err != nil {
+		log.Fatal("❌ Failed to connect to Redis:", err)
+	}
+	log.Println("✅ Connected to Redis")
+}
+
+// Record a catalog event in tx; the outbox relay publishes it after commit
+func enqueueCatalogEvent(tx *gorm.DB, eventType string, productID uint, changes ...string) error {
+	event := catalogEvent{
+		SchemaVersion: catalogSchemaVersion,
+		Type:          eventType,
+		ProductID:     productID,
+		OccurredAt:    time.Now().UTC(),
+		Changes:       changes,
+	}
+
+	// Carry a snapshot so consumers don't have to call back for the basics
+	if productID != 0 && eventType != eventProductDeleted {
+		var product Product
+		if err := tx.First(&product, productID).Error; err != nil {
+			return err
+		}
+		event.Product = map[string]interface{}{
+			"id":       product.ID,
+			"sku":      product.SKU,
+			"name":     product.Name,
+			"category": product.Category,
+			"price":    product.Price,
+			"currency": baseCurrency,
+		}
+	}
+	return enqueueOutbox(tx, topicCatalogPublish, productID, event)
+}
+
+// Outbox handler: append the event to the stream
+func publishCatalogEvent(event OutboxEvent) error {
+	var payload catalogEvent
+	if err := json.Unmarshal([]byte(event.Payload), &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+
+	return rdb.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: catalogStream,
+		MaxLen: catalogStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"schema_version": payload.SchemaVersion,
+			"type":           payload.Type,
+			"product_id":     payload.ProductID,
+			"event":          event.Payload,
+		},
+	}).Err()
+}
+
+// Invalidate cached reads as catalog events arrive. The consumer group
+// makes sure each event is handled by exactly one replica, which is enough
+// because the cache lives in Redis and is shared.
+func runCacheInvalidator() {
+	ctx := context.Background()
+	err := rdb.XGroupCreateMkStream(ctx, catalogStream, cacheConsumerGroup, "$").Err()
+	if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+		log.Fatal("❌ Failed to create catalog consumer group:", err)
+	}
+
+	consumer, _ := os.Hostname()
+	// Work through entries this consumer read but never acknowledged before
+	// taking new ones, and go back to them a while after one fails. Pending
+	// entries are read from position onwards until none are left.
+	position := "0"
+	var retryPendingAt time.Time
+	for {
+		if position == ">" && !retryPendingAt.IsZero() && time.Now().After(retryPendingAt) {
+			position, retryPendingAt = "0", time.Time{}
+		}
+		streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    cacheConsumerGroup,
+			Consumer: consumer,
+			Streams:  []string{catalogStream, position},
+			Count:    100,
+			Block:    5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Println("❌ Error reading catalog events:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		pending := position != ">"
+		read := 0
+		for _, stream := range streams {
+			for _, message := range stream.Messages {
+				read++
+				if pending {
+					position = message.ID
+				}
+				if err := invalidateForEvent(ctx, message.Values); err != nil {
+					log.Printf("❌ Error invalidating cache for event %s: %v", message.ID, err)
+					if retryPendingAt.IsZero() {
+						retryPendingAt = time.Now().Add(cacheRetryInterval)
+					}
+					continue // left pending until then
+				}
+				rdb.XAck(ctx, catalogStream, cacheConsumerGroup, message.ID)
+			}
+		}
+		if pending && read == 0 {
+			position = ">"
+		}
+	}
+}
+
+func invalidateForEvent(ctx context.Context, values map[string]interface{}) error {
+	version, _ := strconv.Atoi(fmt.Sprint(values["schema_version"]))
+	if version != catalogSchemaVersion {
+		return nil
+	}
+
+	if values["type"] == eventCatalogInvalidated {
+		return invalidateCatalog(ctx)
+	}
+	productID, err := strconv.ParseUint(fmt.Sprint(values["product_id"]), 10, 64)
+	if err != nil {
+		return err
+	}
+	return invalidateProduct(ctx, uint(productID))
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // register the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register the WebP decoder
+	"gorm.io/gorm"
+)
+
+const (
+	maxImageSize       = 5 << 20 // 5 MB per file
+	maxImagesPerUpload = 10
+	thumbnailSize      = 320 // longest edge in pixels
+	// Decoding needs about 4 bytes a pixel, whatever the file size, so
+	// dimensions are checked before decoding
+	maxImagePixels = 25_000_000
+)
+
+// Accepted upload types and the extension stored with each
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Where uploads are kept; set up in main
+var storage Storage
+
+// Base URL used to build image links, e.g. http://localhost:8083
+var publicBaseURL = getEnv("PUBLIC_BASE_URL", "http://localhost:8083")
+
+// ProductImage is one image in a product's ordered gallery
+type ProductImage struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	ProductID    uint      `gorm:"index" json:"product_id"`
+	Position     int       `json:"position"`
+	Key          string    `json:"-"`
+	ThumbnailKey string    `json:"-"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	URL          string    `gorm:"-" json:"url"`
+	ThumbnailURL string    `gorm:"-" json:"thumbnail_url"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Fill in the public links after loading
+func (i *ProductImage) AfterFind(tx *gorm.DB) error {
+	i.URL = mediaURL(i.Key)
+	i.ThumbnailURL = mediaURL(i.ThumbnailKey)
+	return nil
+}
+
+func mediaURL(key string) string {
+	return publicBaseURL + "/media/" + key
+}
+
+func randomName() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Scale img so its longest edge is at most thumbnailSize
+func makeThumbnail(img image.Image) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= thumbnailSize && height <= thumbnailSize {
+		return img
+	}
+	if width >= height {
+		height = height * thumbnailSize / width
+		width = thumbnailSize
+	} else {
+		width = width * thumbnailSize / height
+		height = thumbnailSize
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Over, nil)
+	return thumb
+}
+
+// Encode a thumbnail, keeping PNG/GIF as PNG so transparency survives
+func encodeThumbnail(img image.Image, contentType string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch contentType {
+	case "image/png", "image/gif":
+		err := png.Encode(&buf, img)
+		return buf.Bytes(), "image/png", err
+	default:
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", err
+	}
+}
+
+// Validate one uploaded file and store it with its thumbnail
+func storeImage(r *http.Request, productID uint, header *multipart.FileHeader) (ProductImage, int, error) {
+	if header.Size > maxImageSize {
+		return ProductImage{}, http.StatusRequestEntityTooLarge, fmt.Errorf("%s is larger than %d MB", header.Filename, maxImageSize>>20)
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return ProductImage{}, http.StatusBadRequest, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxImageSize+1))
+	if err != nil {
+		return ProductImage{}, http.StatusBadRequest, err
+	}
+	if len(data) > maxImageSize {
+		return ProductImage{}, http.StatusRequestEntityTooLarge, fmt.Errorf("%s is larger than %d MB", header.Filename, maxImageSize>>20)
+	}
+
+	// Trust the bytes, not the client's Content-Type or file name
+	contentType := http.DetectContentType(data)
+	ext, ok := imageExtensions[contentType]
+	if !ok {
+		return ProductImage{}, http.StatusUnsupportedMediaType, fmt.Errorf("%s is %s, expected JPEG, PNG, GIF or WebP", header.Filename, contentType)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ProductImage{}, http.StatusBadRequest, fmt.Errorf("%s could not be decoded: %v", header.Filename, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return ProductImage{}, http.StatusRequestEntityTooLarge, fmt.Errorf("%s is %d×%d pixels, more than %d megapixels", header.Filename, config.Width, config.Height, maxImagePixels/1_000_000)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ProductImage{}, http.StatusBadRequest, fmt.Errorf("%s could not be decoded: %v", header.Filename, err)
+	}
+	thumbnail, thumbnailType, err := encodeThumbnail(makeThumbnail(img), contentType)
+	if err != nil {
+		return ProductImage{}, http.StatusInternalServerError, err
+	}
+
+	name, err := randomName()
+	if err != nil {
+		return ProductImage{}, http.StatusInternalServerError, err
+	}
+	key := fmt.Sprintf("products/%d/%s%s", productID, name, ext)
+	thumbnailKey := fmt.Sprintf("products/%d/%s_thumb%s", productID, name, imageExtensions[thumbnailType])
+
+	ctx := r.Context()
+	if err := storage.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		return ProductImage{}, http.StatusInternalServerError, err
+	}
+	if err := storage.Put(ctx, thumbnailKey, bytes.NewReader(thumbnail), int64(len(thumbnail)), thumbnailType); err != nil {
+		storage.Delete(ctx, key)
+		return ProductImage{}, http.StatusInternalServerError, err
+	}
+
+	bounds := img.Bounds()
+	return ProductImage{
+		ProductID:    productID,
+		Key:          key,
+		ThumbnailKey: thumbnailKey,
+		ContentType:  contentType,
+		Size:         int64(len(data)),
+		Width:        bounds.Dx(),
+		Height:       bounds.Dy(),
+	}, http.StatusCreated, nil
+}
+
+func findProduct(w http.ResponseWriter, r *http.Request) (Product, bool) {
+	var product Product
+	if err := db.First(&product, chi.URLParam(r, "id")).Error; err != nil {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return product, false
+	}
+	return product, true
+}
+
+func productImages(productID uint) ([]ProductImage, error) {
+	images := []ProductImage{}
+	err := db.Where("product_id = ?", productID).Order("position, id").Find(&images).Error
+	return images, err
+}
+
+// Upload one or more images (multipart field "image"), appended in order
+func uploadProductImages(w http.ResponseWriter, r *http.Request) {
+	product, ok := findProduct(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImagesPerUpload*maxImageSize+1<<20)
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		http.Error(w, "Invalid multipart upload", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	headers := r.MultipartForm.File["image"]
+	if len(headers) == 0 {
+		http.Error(w, `Missing "image" file field`, http.StatusBadRequest)
+		return
+	}
+	if len(headers) > maxImagesPerUpload {
+		http.Error(w, fmt.Sprintf("At most %d images per upload", maxImagesPerUpload), http.StatusBadRequest)
+		return
+	}
+
+	var stored []ProductImage
+	cleanup := func() {
+		for _, img := range stored {
+			storage.Delete(r.Context(), img.Key)
+			storage.Delete(r.Context(), img.ThumbnailKey)
+		}
+	}
+	for _, header := range headers {
+		img, status, err := storeImage(r, product.ID, header)
+		if err != nil {
+			cleanup()
+			log.Printf("❌ Rejected image for Product ID %d: %v", product.ID, err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+		stored = append(stored, img)
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var last struct{ Position int }
+		if err := tx.Model(&ProductImage{}).
+			Select("COALESCE(MAX(position), 0) AS position").
+			Where("product_id = ?", product.ID).
+			Scan(&last).Error; err != nil {
+			return err
+		}
+		for i := range stored {
+			stored[i].Position = last.Position + i + 1
+		}
+		if err := tx.Create(&stored).Error; err != nil {
+			return err
+		}
+		return enqueueCatalogEvent(tx, eventProductUpdated, product.ID, "images")
+	})
+	if err != nil {
+		cleanup()
+		log.Println("❌ Error saving product images:", err)
+		http.Error(w, "Error saving images", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range stored {
+		stored[i].AfterFind(nil)
+	}
+	log.Printf("🖼️ Uploaded %d image(s) for Product ID %d", len(stored), product.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(stored)
+}
+
+// List a product's images in display order
+func listProductImages(w http.ResponseWriter, r *http.Request) {
+	product, ok := findProduct(w, r)
+	if !ok {
+		return
+	}
+
+	images, err := productImages(product.ID)
+	if err != nil {
+		log.Println("❌ Error listing product images:", err)
+		http.Error(w, "Error listing images", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(images)
+}
+
+// Set the display order; the body must list every image of the product
+func reorderProductImages(w http.ResponseWriter, r *http.Request) {
+	product, ok := findProduct(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		ImageIDs []uint `json:"image_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+
+	images, err := productImages(product.ID)
+	if err != nil {
+		log.Println("❌ Error listing product images:", err)
+		http.Error(w, "Error reordering images", http.StatusInternalServerError)
+		return
+	}
+
+	byID := map[uint]bool{}
+	for _, img := range images {
+		byID[img.ID] = true
+	}
+	if len(request.ImageIDs) != len(images) {
+		http.Error(w, "image_ids must list every image of the product exactly once", http.StatusBadRequest)
+		return
+	}
+	for _, id := range request.ImageIDs {
+		if !byID[id] {
+			http.Error(w, "image_ids must list every image of the product exactly once", http.StatusBadRequest)
+			return
+		}
+		delete(byID, id)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for position, id := range request.ImageIDs {
+			if err := tx.Model(&ProductImage{}).Where("id = ?", id).Update("position", position+1).Error; err != nil {
+				return err
+			}
+		}
+		return enqueueCatalogEvent(tx, eventProductUpdated, product.ID, "images")
+	})
+	if err != nil {
+		log.Println("❌ Error reordering product images:", err)
+		http.Error(w, "Error reordering images", http.StatusInternalServerError)
+		return
+	}
+
+	images, _ = productImages(product.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(images)
+}
+
+// Delete an image and its stored files
+func deleteProductImage(w http.ResponseWriter, r *http.Request) {
+	product, ok := findProduct(w, r)
+	if !ok {
+		return
+	}
+
+	var img ProductImage
+	if err := db.First(&img, "id = ? AND product_id = ?", chi.URLParam(r, "imageID"), product.ID).Error; err != nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&img).Error; err != nil {
+			return err
+		}
+		return enqueueCatalogEvent(tx, eventProductUpdated, product.ID, "images")
+	})
+	if err != nil {
+		log.Println("❌ Error deleting product image:", err)
+		http.Error(w, "Error deleting image", http.StatusInternalServerError)
+		return
+	}
+	for _, key := range []string{img.Key, img.ThumbnailKey} {
+		if err := storage.Delete(r.Context(), key); err != nil {
+			log.Printf("⚠️ Could not delete stored file %s: %v", key, err)
+		}
+	}
+
+	log.Printf("🗑️ Deleted image %d of Product ID %d", img.ID, product.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Serve a stored file
+func serveMedia(w http.ResponseWriter, r *http.Request) {
+	// Cleaned first, so "/digital/..." or "a/../digital/..." can't slip past
+	// the prefix check
+	key := strings.TrimPrefix(path.Clean("/"+chi.URLParam(r, "*")), "/")
+	// Digital goods are only handed out through signed download links
+	if strings.HasPrefix(key, digitalKeyPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := storage.Open(r.Context(), key)
+	if errors.Is(err, errObjectNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Error opening %s: %v", key, err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// Keys are random and never rewritten, so they can be cached forever
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("❌ Error serving %s: %v", key, err)
+	}
+}
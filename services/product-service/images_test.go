@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func pngImage(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// A tiny PNG whose header claims width×height pixels
+func pngClaiming(t *testing.T, width, height uint32) []byte {
+	data := pngImage(t, 1, 1)
+	// Signature (8 bytes), IHDR length (4), "IHDR" (4), then width and height
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+// Upload data as a multipart "image" field and return its file header
+func uploadedFile(t *testing.T, name string, data []byte) (*http.Request, *multipart.FileHeader) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("image", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/products/1/images", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	if err := r.ParseMultipartForm(maxImageSize); err != nil {
+		t.Fatal(err)
+	}
+	return r, r.MultipartForm.File["image"][0]
+}
+
+func useLocalStorage(t *testing.T) *LocalStorage {
+	local, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := storage
+	storage = local
+	t.Cleanup(func() { storage = previous })
+	return local
+}
+
+func TestStoreImage(t *testing.T) {
+	local := useLocalStorage(t)
+	r, header := uploadedFile(t, "photo.png", pngImage(t, 800, 400))
+
+	stored, status, err := storeImage(r, 1, header)
+	if err != nil {
+		t.Fatalf("storeImage: %v", err)
+	}
+	if status != http.StatusCreated || stored.ContentType != "image/png" || stored.Width != 800 || stored.Height != 400 {
+		t.Fatalf("got status %d and %+v", status, stored)
+	}
+
+	thumbnail, err := local.Open(context.Background(), stored.ThumbnailKey)
+	if err != nil {
+		t.Fatalf("thumbnail not stored: %v", err)
+	}
+	defer thumbnail.Close()
+	config, err := png.DecodeConfig(thumbnail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != thumbnailSize || config.Height != thumbnailSize/2 {
+		t.Fatalf("thumbnail is %d×%d, want %d×%d", config.Width, config.Height, thumbnailSize, thumbnailSize/2)
+	}
+}
+
+func TestStoreImageRejectsHugeDimensions(t *testing.T) {
+	useLocalStorage(t)
+	r, header := uploadedFile(t, "bomb.png", pngClaiming(t, 50000, 50000))
+
+	_, status, err := storeImage(r, 1, header)
+	if err == nil || status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d and error %v, want %d", status, err, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestStoreImageSniffsContentType(t *testing.T) {
+	useLocalStorage(t)
+	r, header := uploadedFile(t, "notes.png", []byte("just some text, not an image"))
+
+	_, status, err := storeImage(r, 1, header)
+	if err == nil || status != http.StatusUnsupportedMediaType {
+		t.Fatalf("got status %d and error %v, want %d", status, err, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestServeMediaHidesDigitalFiles(t *testing.T) {
+	local := useLocalStorage(t)
+	if err := local.Put(context.Background(), digitalKeyPrefix+"1/manual.pdf", strings.NewReader("secret"), 6, "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+	router := chi.NewRouter()
+	router.Get("/media/*", serveMedia)
+
+	for _, target := range []string{"/media/digital/1/manual.pdf", "/media//digital/1/manual.pdf", "/media/products/../digital/1/manual.pdf"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got %d %q, want 404", target, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+
+	maxImportSize   = 10 << 20 // 10 MB
+	exportBatchSize = 500
+)
+
+// Columns of the import/export format, in export order
+var catalogColumns = []string{"sku", "name", "description", "category", "price", "stock"}
+
+// One line of a catalog file. Stock is only used when the SKU is new.
+type catalogRow struct {
+	SKU         string   `json:"sku"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Category    string   `json:"category"`
+	Price       *float64 `json:"price"`
+	Stock       *int     `json:"stock,omitempty"`
+}
+
+type importRowResult struct {
+	Row    int    `json:"row"`
+	SKU    string `json:"sku,omitempty"`
+	Action string `json:"action,omitempty"` // "create" or "update"
+	Error  string `json:"error,omitempty"`
+}
+
+type importReport struct {
+	DryRun  bool              `json:"dry_run"`
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Failed  int               `json:"failed"`
+	Rows    []importRowResult `json:"rows"`
+}
+
+// Pick csv or jsonl from ?format=, falling back to the given content type
+func catalogFormat(r *http.Request, contentType string) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" && contentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		switch mediaType {
+		case "text/csv":
+			format = formatCSV
+		case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+			format = formatJSONL
+		}
+	}
+	switch format {
+	case "":
+		return formatCSV, nil
+	case formatCSV, formatJSONL:
+		return format, nil
+	}
+	return "", fmt.Errorf("unsupported format %q (csv, jsonl)", format)
+}
+
+// Read CSV rows keyed by the header line. Parse errors are reported per row.
+func readCSVRows(body io.Reader) ([]catalogRow, map[int]error, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("missing header row: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"sku", "name", "price"} {
+		if _, ok := columns[required]; !ok {
+			return nil, nil, fmt.Errorf("missing required column %q", required)
+		}
+	}
+
+	var rows []catalogRow
+	rowErrors := map[int]error{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, catalogRow{})
+			rowErrors[len(rows)] = parseErr.Err
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row := catalogRow{
+			SKU:         field("sku"),
+			Name:        field("name"),
+			Description: field("description"),
+			Category:    field("category"),
+		}
+		rows = append(rows, row)
+
+		if raw := field("price"); raw != "" {
+			price, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				rowErrors[len(rows)] = fmt.Errorf("invalid price %q", raw)
+				continue
+			}
+			rows[len(rows)-1].Price = &price
+		}
+		if raw := field("stock"); raw != "" {
+			stock, err := strconv.Atoi(raw)
+			if err != nil {
+				rowErrors[len(rows)] = fmt.Errorf("invalid stock %q", raw)
+				continue
+			}
+			rows[len(rows)-1].Stock = &stock
+		}
+	}
+	return rows, rowErrors, nil
+}
+
+// Read one JSON object per line, skipping blank lines
+func readJSONLRows(body io.Reader) ([]catalogRow, map[int]error, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxImportSize)
+
+	var rows []catalogRow
+	rowErrors := map[int]error{}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var row catalogRow
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			rows = append(rows, catalogRow{})
+			rowErrors[len(rows)] = fmt.Errorf("invalid JSON: %v", err)
+			continue
+		}
+		row.SKU = strings.TrimSpace(row.SKU)
+		row.Name = strings.TrimSpace(row.Name)
+		rows = append(rows, row)
+	}
+	return rows, rowErrors, scanner.Err()
+}
+
+func validateCatalogRow(row catalogRow) error {
+	switch {
+	case row.SKU == "":
+		return errors.New("sku is required")
+	case row.Name == "":
+		return errors.New("name is required")
+	case row.Price == nil:
+		return errors.New("price is required")
+	case *row.Price < 0:
+		return errors.New("price must not be negative")
+	case row.Stock != nil && *row.Stock < 0:
+		return errors.New("stock must not be negative")
+	}
+	return nil
+}
+
+// Upsert products by SKU from CSV or JSON Lines. The whole file is validated
+// first; with ?dry_run=true, or when any row is invalid, nothing is written.
+func importProducts(w http.ResponseWriter, r *http.Request) {
+	format, err := catalogFormat(r, r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+	var rows []catalogRow
+	var rowErrors map[int]error
+	if format == formatCSV {
+		rows, rowErrors, err = readCSVRows(body)
+	} else {
+		rows, rowErrors, err = readJSONLRows(body)
+	}
+	if err != nil {
+		http.Error(w, "Invalid import file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Find which SKUs already exist
+	skus := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if row.SKU != "" {
+			skus = append(skus, row.SKU)
+		}
+	}
+	existing := map[string]Product{}
+	var found []Product
+	if len(skus) > 0 {
+		if err := db.Where("sku IN ?", skus).Find(&found).Error; err != nil {
+			log.Println("❌ Error looking up SKUs:", err)
+			http.Error(w, "Error importing products", http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, product := range found {
+		existing[product.SKU] = product
+	}
+
+	report := importReport{DryRun: dryRun, Rows: make([]importRowResult, 0, len(rows))}
+	seen := map[string]int{}
+	for i, row := range rows {
+		result := importRowResult{Row: i + 1, SKU: row.SKU}
+		err := rowErrors[i+1]
+		if err == nil {
+			err = validateCatalogRow(row)
+		}
+		if err == nil {
+			if first, dup := seen[row.SKU]; dup {
+				err = fmt.Errorf("duplicate sku (first seen on row %d)", first)
+			}
+		}
+
+		switch {
+		case err != nil:
+			result.Error = err.Error()
+			report.Failed++
+		case existing[row.SKU].ID != 0:
+			result.Action = "update"
+			report.Updated++
+		default:
+			result.Action = "create"
+			report.Created++
+		}
+		if row.SKU != "" {
+			if _, dup := seen[row.SKU]; !dup {
+				seen[row.SKU] = i + 1
+			}
+		}
+		report.Rows = append(report.Rows, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Failed > 0 && !dryRun {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	if dryRun {
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			if product, ok := existing[row.SKU]; ok {
+				if err := recordPriceChange(tx, product.ID, product.Price, *row.Price, "import"); err != nil {
+					return err
+				}
+				if err := tx.Model(&product).Updates(map[string]interface{}{
+					"name":        row.Name,
+					"description": row.Description,
+					"category":    row.Category,
+					"price":       *row.Price,
+				}).Error; err != nil {
+					return err
+				}
+				if err := enqueueCatalogEvent(tx, eventProductUpdated, product.ID, "import"); err != nil {
+					return err
+				}
+				continue
+			}
+
+			product := Product{
+				SKU:         row.SKU,
+				Name:        row.Name,
+				Description: row.Description,
+				Category:    row.Category,
+				Price:       *row.Price,
+			}
+			if err := tx.Create(&product).Error; err != nil {
+				return err
+			}
+			if err := recordPriceChange(tx, product.ID, 0, product.Price, "import"); err != nil {
+				return err
+			}
+			stock := 0
+			if row.Stock != nil {
+				stock = *row.Stock
+			}
+			if err := enqueueOutbox(tx, topicInventoryRegister, product.ID, stockRegistration{ProductID: product.ID, Stock: stock}); err != nil {
+				return err
+			}
+			if err := enqueueCatalogEvent(tx, eventProductCreated, product.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("❌ Error importing products:", err)
+		http.Error(w, "Error importing products", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✅ Imported products: %d created, %d updated", report.Created, report.Updated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Stream the catalog, with current stock, in the import format
+func exportProducts(w http.ResponseWriter, r *http.Request) {
+	format, err := catalogFormat(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var writeRow func(catalogRow) error
+	var csvWriter *csv.Writer
+	if format == formatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		csvWriter = csv.NewWriter(w)
+		if err := csvWriter.Write(catalogColumns); err != nil {
+			return
+		}
+		writeRow = func(row catalogRow) error {
+			return csvWriter.Write([]string{
+				row.SKU,
+				row.Name,
+				row.Description,
+				row.Category,
+				strconv.FormatFloat(*row.Price, 'f', -1, 64),
+				strconv.Itoa(*row.Stock),
+			})
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		writeRow = func(row catalogRow) error {
+			return encoder.Encode(row)
+		}
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="products.%s"`, format))
+
+	type exportRow struct {
+		Product
+		Stock int
+	}
+	exported := 0
+	var lastID uint
+	for {
+		var batch []exportRow
+		err := db.Model(&Product{}).
+			Joins("LEFT JOIN inventories ON inventories.product_id = products.id").
+			Select("products.*, COALESCE(inventories.stock, 0) AS stock").
+			Where("products.id > ?", lastID).
+			Order("products.id").
+			Limit(exportBatchSize).
+			Scan(&batch).Error
+		if err == nil {
+			for _, item := range batch {
+				price, stock := item.Price, item.Stock
+				if err = writeRow(catalogRow{
+					SKU:         item.SKU,
+					Name:        item.Name,
+					Description: item.Description,
+					Category:    item.Category,
+					Price:       &price,
+					Stock:       &stock,
+				}); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil && csvWriter != nil {
+			csvWriter.Flush()
+			err = csvWriter.Error()
+		}
+		if err != nil {
+			// Headers are already sent; all we can do is stop and log
+			log.Println("❌ Error exporting products:", err)
+			return
+		}
+
+		exported += len(batch)
+		if len(batch) < exportBatchSize {
+			break
+		}
+		lastID = batch[len(batch)-1].ID
+	}
+	log.Printf("📤 Exported %d products as %s", exported, format)
+}
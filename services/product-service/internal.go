@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// Header other services authenticate internal calls with
+const internalKeyHeader = "X-Internal-Key"
+
+// Customer group an internal caller is asking prices for
+const customerGroupHeader = "X-Customer-Group"
+
+// Shared secret for service-to-service calls
+var internalAPIKey = getEnv("INTERNAL_API_KEY", "")
+
+// Did another service make this call?
+func isInternal(r *http.Request) bool {
+	return internalAPIKey != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(internalKeyHeader)), []byte(internalAPIKey)) == 1
+}
+
+// Middleware: only other services, which send the internal key
+func internalOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isInternal(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
+	"ecommerce/pkg/idempotency"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
 	"gorm.io/driver/postgres"
@@ -17,11 +19,32 @@ import (
 // Database connection
 var db *gorm.DB
 
-// Product model (No stock field)
+// HTTP client for calls to other services
+var httpClient = &http.Client{Timeout: 5 * time.Second}
+
+// Product model (No stock field). Only physical products have inventory.
 type Product struct {
-	ID    uint    `gorm:"primaryKey" json:"id"` // this will give lowercase "id"
-	Name  string  `json:"name"`
-	Price float64 `json:"price"`
+	ID          uint           `gorm:"primaryKey" json:"id"` // this will give lowercase "id"
+	SKU         string         `gorm:"uniqueIndex:idx_products_sku,where:sku <> ''" json:"sku"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Category    string         `gorm:"index" json:"category"`
+	Price       float64        `json:"price"`
+	Type        string         `gorm:"size:16;not null;default:physical" json:"type"`
+	Currency    string         `gorm:"-" json:"currency,omitempty"` // set when converted for display
+	Rating      *ratingSummary `gorm:"-" json:"rating,omitempty"`
+	CreatedAt   time.Time      `json:"created_at"`
+
+	Images     []ProductImage    `gorm:"foreignKey:ProductID" json:"images,omitempty"`
+	Components []BundleComponent `gorm:"foreignKey:BundleID" json:"components,omitempty"`
+}
+
+// Read an environment variable with a default
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
 }
 
 func connectDB() {
@@ -41,65 +64,135 @@ func connectDB() {
 		log.Fatal("❌ Failed to connect to database:", err)
 	}
 
-	if err := db.AutoMigrate(&Product{}); err != nil {
-		log.Fatal("❌ Failed to migrate Product table:", err)
+	if err := db.AutoMigrate(
+		&Product{}, &OutboxEvent{}, &ProductImage{},
+		&SalePrice{}, &PriceList{}, &PriceListItem{}, &PriceHistory{},
+		&ExchangeRate{}, &ProductCurrencyPrice{}, &ProductRecommendation{},
+		&LicenseKey{}, &DigitalFile{}, &DigitalDelivery{}, &BundleComponent{},
+		&idempotency.Key{},
+	); err != nil {
+		log.Fatal("❌ Failed to migrate Product tables:", err)
 	}
-	log.Println("✅ Connected to PostgreSQL and Product table migrated")
+	migrateSearchIndexes()
+	log.Println("✅ Connected to PostgreSQL and Product tables migrated")
 }
 func getProduct(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 
+	currency, err := requestedCurrency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var product Product
-	if err := db.First(&product, id).Error; err != nil {
+	if err := db.Preload("Images", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("position, id")
+	}).Preload("Components", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("component_id")
+	}).Preload("Components.Component").First(&product, id).Error; err != nil {
 		http.Error(w, "Product not found", http.StatusNotFound)
 		return
 	}
 
+	// Price at request time for the caller's customer group
+	quote, err := effectivePrice(product, customerGroup(r), time.Now())
+	if err != nil {
+		log.Println("❌ Error computing effective price:", err)
+		http.Error(w, "Error loading product", http.StatusInternalServerError)
+		return
+	}
+
+	converter, err := newCurrencyConverter(currency, []uint{product.ID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	quote = converter.quote(product.ID, quote)
+	converter.products([]*Product{&product})
+	attachRatings([]*Product{&product})
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(product)
+	json.NewEncoder(w).Encode(struct {
+		Product
+		priceQuote
+	}{product, quote})
 }
 
 // Create product and register stock in Inventory Service
 func createProduct(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		Name  string  `json:"name"`
-		Price float64 `json:"price"`
-		Stock int     `json:"stock"` // User still provides stock when creating the product
+		SKU         string  `json:"sku"`
+		Name        string  `json:"name"`
+		Description string  `json:"description"`
+		Category    string  `json:"category"`
+		Price       float64 `json:"price"`
+		Type        string  `json:"type"`
+		Stock       int     `json:"stock"` // User still provides stock when creating the product
+
+		Components []componentRequest `json:"components"` // bundles only
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, "Invalid product data", http.StatusBadRequest)
 		return
 	}
-
-	// Create product in Product Service
-	product := Product{Name: request.Name, Price: request.Price}
-	result := db.Create(&product)
-	if result.Error != nil {
-		log.Println("❌ Error creating product:", result.Error)
-		http.Error(w, "Error al crear producto", http.StatusInternalServerError)
+	if request.Type == "" {
+		request.Type = productTypePhysical
+	}
+	if !validProductType(request.Type) {
+		http.Error(w, "Invalid product type", http.StatusBadRequest)
 		return
 	}
+	var components []BundleComponent
+	if request.Type == productTypeBundle {
+		var err error
+		if components, err = validateComponents(0, request.Components); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	// Ensure product ID is actually assigned
-	if product.ID == 0 {
-		log.Println("❌ Error: Product ID is 0 after creation")
-		http.Error(w, "Invalid product ID", http.StatusInternalServerError)
+	// Create the product and queue its stock registration atomically; the
+	// outbox relay delivers it to Inventory Service until acknowledged
+	product := Product{
+		SKU:         request.SKU,
+		Name:        request.Name,
+		Description: request.Description,
+		Category:    request.Category,
+		Price:       request.Price,
+		Type:        request.Type,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&product).Error; err != nil {
+			return err
+		}
+		if err := recordPriceChange(tx, product.ID, 0, product.Price, "created"); err != nil {
+			return err
+		}
+		for i := range components {
+			components[i].BundleID = product.ID
+		}
+		if len(components) > 0 {
+			if err := tx.Create(&components).Error; err != nil {
+				return err
+			}
+		}
+		if product.Type == productTypePhysical {
+			if err := enqueueOutbox(tx, topicInventoryRegister, product.ID, stockRegistration{ProductID: product.ID, Stock: request.Stock}); err != nil {
+				return err
+			}
+		}
+		return enqueueCatalogEvent(tx, eventProductCreated, product.ID)
+	})
+	if err != nil {
+		log.Println("❌ Error creating product:", err)
+		http.Error(w, "Error al crear producto", http.StatusInternalServerError)
 		return
 	}
 
 	log.Printf("✅ Created product: %s (ID: %d, Price: %.2f)", product.Name, product.ID, product.Price)
 
-	// Register stock in Inventory Service with retry
-	for attempt := 1; attempt <= 3; attempt++ {
-		err := registerStock(product.ID, request.Stock)
-		if err == nil {
-			break // Success
-		}
-		log.Printf("⏳ Retrying stock registration for Product ID %d (Attempt %d/3)", product.ID, attempt)
-		time.Sleep(200 * time.Millisecond) // Small delay before retrying
-	}
-
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprintf(w, "Producto creado con éxito")
 }
@@ -111,9 +204,6 @@ func registerStock(productID uint, stock int) error {
 		return fmt.Errorf("invalid product ID")
 	}
 
-	// Wait a short time to ensure the Product ID is committed
-	time.Sleep(100 * time.Millisecond) // Small delay for database consistency
-
 	requestBody, _ := json.Marshal(map[string]interface{}{
 		"product_id": productID,
 		"stock":      stock,
@@ -121,8 +211,11 @@ func registerStock(productID uint, stock int) error {
 
 	log.Printf("📡 Sending stock registration request: %s", string(requestBody))
 
-	resp, err := http.Post("http://inventory-service:8082/inventory/create", "application/json",
-		bytes.NewBuffer(requestBody))
+	// The outbox retries deliveries, so make repeats harmless
+	req, _ := http.NewRequest(http.MethodPost, "http://inventory-service:8082/inventory/create", bytes.NewBuffer(requestBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("product-stock:%d", productID))
+	resp, err := httpClient.Do(req)
 
 	if err != nil {
 		log.Println("❌ Error contacting Inventory Service:", err)
@@ -130,6 +223,12 @@ func registerStock(productID uint, stock int) error {
 	}
 	defer resp.Body.Close()
 
+	// 409 means an earlier delivery already created the row
+	if resp.StatusCode == http.StatusConflict {
+		log.Printf("✅ Stock already registered in Inventory Service for Product ID: %d", productID)
+		return nil
+	}
+
 	if resp.StatusCode != http.StatusCreated {
 		log.Printf("❌ Inventory Service returned unexpected status: %d", resp.StatusCode)
 		return fmt.Errorf("inventory service returned %d", resp.StatusCode)
@@ -139,22 +238,107 @@ func registerStock(productID uint, stock int) error {
 	return nil
 }
 
-// Get all products (No stock included)
+// Get products page by page (No stock included)
 func getProducts(w http.ResponseWriter, r *http.Request) {
-	var products []Product
-	db.Find(&products)
+	query := r.URL.Query()
+
+	page, err := parsePage(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if len(products) == 0 {
-		http.Error(w, "No products found", http.StatusNotFound)
+	filters, err := parseSearchFilters(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
+	order, ok := productSorts[query.Get("sort")]
+	if !ok {
+		http.Error(w, "Invalid sort (price_asc, price_desc, name, newest)", http.StatusBadRequest)
+		return
+	}
+
+	currency, err := requestedCurrency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filters.Pricing, err = newSearchPricing(currency); err != nil {
+		log.Println("❌ Error loading exchange rate:", err)
+		http.Error(w, "Error listing products", http.StatusInternalServerError)
+		return
+	}
+
+	listing := db.Model(&Product{}).Scopes(inventoryScope, filterScope(filters, ""))
+
+	var total int64
+	if err := listing.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		log.Println("❌ Error counting products:", err)
+		http.Error(w, "Error listing products", http.StatusInternalServerError)
+		return
+	}
+
+	products := []Product{}
+	if err := listing.Select("products.*").Order(order).Scopes(page.scope).Scan(&products).Error; err != nil {
+		log.Println("❌ Error listing products:", err)
+		http.Error(w, "Error listing products", http.StatusInternalServerError)
+		return
+	}
+
+	localized := make([]*Product, len(products))
+	for i := range products {
+		localized[i] = &products[i]
+	}
+	if err := localizeProducts(currency, localized); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	attachRatings(localized)
+
+	setPaginationHeaders(w, r, page, total)
+	writeJSONWithETag(w, r, products)
 }
 
 func main() {
+	if internalAPIKey == "" {
+		log.Fatal("❌ INTERNAL_API_KEY is required")
+	}
+	if len(downloadSigningKey) == 0 {
+		log.Fatal("❌ DOWNLOAD_SIGNING_KEY is required")
+	}
+	var err error
+	if downloadURLTTL, err = time.ParseDuration(getEnv("DOWNLOAD_URL_TTL", "24h")); err != nil || downloadURLTTL <= 0 {
+		log.Fatal("❌ Invalid DOWNLOAD_URL_TTL:", err)
+	}
+	if recommendationsInterval, err = time.ParseDuration(getEnv("RECOMMENDATIONS_INTERVAL", "1h")); err != nil || recommendationsInterval <= 0 {
+		log.Fatal("❌ Invalid RECOMMENDATIONS_INTERVAL:", err)
+	}
+
 	connectDB()
+	connectRedis()
+
+	if exchangeRatesFile != "" {
+		count, err := loadExchangeRates(exchangeRatesFile)
+		if err != nil {
+			log.Fatal("❌ Failed to load exchange rates:", err)
+		}
+		log.Printf("💱 Loaded %d exchange rates from %s", count, exchangeRatesFile)
+	}
+
+	if storage, err = newStorage(); err != nil {
+		log.Fatal("❌ Failed to set up image storage:", err)
+	}
+	if idempotencyKeys, err = idempotency.New(db, "product-service"); err != nil {
+		log.Fatal("❌ Failed to set up idempotency keys:", err)
+	}
+
+	go runOutboxRelay()
+	go runInventoryReconciliation()
+	go runRecommendationJob()
+	go runCacheInvalidator()
+	go idempotencyKeys.RunCleanup()
 
 	r := chi.NewRouter()
 
@@ -162,13 +346,47 @@ func main() {
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"http://127.0.0.1:3000", "http://localhost:3000"}, // Add frontend URLs
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "If-None-Match", "Idempotency-Key"},
+		ExposedHeaders:   []string{"ETag", "Link", "X-Total-Count", "X-Cache", "Idempotent-Replayed"},
 		AllowCredentials: true,
 	}))
 
-	r.Post("/products", createProduct)
-	r.Get("/products", getProducts)
-	r.Get("/products/{id}", getProduct) // ✅ Add this route
+	r.Post("/products", idempotent(createProduct))
+	r.Get("/products", cached(false, getProducts))
+	r.Get("/products/search", cached(false, searchProducts))
+	r.Get("/products/export", exportProducts)
+	r.Post("/products/import", idempotent(importProducts))
+	r.Get("/products/{id}", cached(true, getProduct)) // ✅ Add this route
+	r.Post("/products/reconcile", reconcileInventoryHandler)
+	r.Post("/products/recommendations/refresh", refreshRecommendations)
+	r.Get("/products/{id}/recommendations", cached(false, getRecommendations))
+	r.Get("/products/{id}/images", cached(true, listProductImages))
+	r.Post("/products/{id}/images", uploadProductImages)
+	r.Put("/products/{id}/images/order", reorderProductImages)
+	r.Delete("/products/{id}/images/{imageID}", deleteProductImage)
+	r.Get("/media/*", serveMedia)
+	r.Put("/products/{id}/price", adminOnly(idempotent(updatePrice)))
+	r.Get("/products/{id}/price-history", getPriceHistory)
+	r.Get("/products/{id}/sales", listSales)
+	r.Post("/products/{id}/sales", adminOnly(idempotent(createSale)))
+	r.Delete("/products/{id}/sales/{saleID}", adminOnly(deleteSale))
+	r.Get("/price-lists", listPriceLists)
+	r.Post("/price-lists", adminOnly(idempotent(createPriceList)))
+	r.Put("/price-lists/{id}/items", adminOnly(setPriceListItems))
+	r.Get("/products/{id}/currency-prices", getCurrencyPrices)
+	r.Put("/products/{id}/currency-prices", adminOnly(setCurrencyPrices))
+	r.Get("/products/{id}/components", getBundleComponents)
+	r.Put("/products/{id}/components", setBundleComponents)
+	r.Get("/products/{id}/license-keys", adminOnly(licenseKeyStats))
+	r.Post("/products/{id}/license-keys", adminOnly(idempotent(addLicenseKeys)))
+	r.Get("/products/{id}/files", listDigitalFiles)
+	r.Post("/products/{id}/files", adminOnly(uploadDigitalFile))
+	r.Delete("/products/{id}/files/{fileID}", adminOnly(deleteDigitalFile))
+	r.Post("/digital/deliveries", internalOnly(idempotent(createDeliveries)))
+	r.Get("/digital/deliveries", internalOnly(getDeliveries))
+	r.Get("/downloads/{fileID}", downloadDigitalFile)
+	r.Get("/exchange-rates", listExchangeRates)
+	r.Post("/exchange-rates/reload", reloadExchangeRates)
 
 	log.Println("📦 Product Service running on :8083")
 	http.ListenAndServe(":8083", r)
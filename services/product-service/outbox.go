@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Outbox topics and how often the relay and reconciliation run
+const (
+	topicInventoryRegister = "inventory.register"
+
+	outboxPollInterval     = 1 * time.Second
+	outboxBatchSize        = 20
+	outboxMaxBackoff       = 5 * time.Minute
+	outboxMaxAttempts      = 20
+	outboxLease            = 5 * time.Minute // to deliver a claimed batch before another relay may take it
+	reconciliationInterval = 10 * time.Minute
+)
+
+// OutboxEvent is written in the same transaction as the change it describes
+// and delivered by the relay until the receiving side acknowledges it, or
+// until it's given up on and FailedAt is set.
+type OutboxEvent struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	Topic         string     `gorm:"index" json:"topic"`
+	AggregateID   uint       `gorm:"index" json:"aggregate_id"`
+	Payload       string     `gorm:"type:jsonb" json:"payload"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"index" json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	DeliveredAt   *time.Time `gorm:"index" json:"delivered_at,omitempty"`
+	FailedAt      *time.Time `gorm:"index" json:"failed_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Other services share the database, so keep the table name specific
+func (OutboxEvent) TableName() string {
+	return "product_outbox_events"
+}
+
+// Payload of an inventory.register event
+type stockRegistration struct {
+	ProductID uint `json:"product_id"`
+	Stock     int  `json:"stock"`
+}
+
+// Deliver an event to its destination. Returning nil acknowledges it.
+var outboxHandlers = map[string]func(OutboxEvent) error{
+	topicInventoryRegister: deliverStockRegistration,
+	topicCatalogPublish:    publishCatalogEvent,
+}
+
+// Record an event inside tx; it is only visible to the relay once tx commits
+func enqueueOutbox(tx *gorm.DB, topic string, aggregateID uint, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&OutboxEvent{
+		Topic:         topic,
+		AggregateID:   aggregateID,
+		Payload:       string(body),
+		NextAttemptAt: time.Now(),
+	}).Error
+}
+
+func deliverStockRegistration(event OutboxEvent) error {
+	var payload stockRegistration
+	if err := json.Unmarshal([]byte(event.Payload), &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+	return registerStock(payload.ProductID, payload.Stock)
+}
+
+// Exponential backoff starting at one second, capped at outboxMaxBackoff
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 16 {
+		return outboxMaxBackoff
+	}
+	backoff := time.Second << uint(attempts-1)
+	if backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
+
+// Claim due events by pushing their next attempt out by outboxLease. The
+// claim commits straight away, so nothing is locked while events are
+// delivered; SKIP LOCKED keeps replicas from claiming the same rows, and a
+// relay that dies mid-batch leaves its events to be retried once the lease
+// runs out.
+func claimOutboxEvents() ([]OutboxEvent, error) {
+	var events []OutboxEvent
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= ?", now).
+			Order("id").
+			Limit(outboxBatchSize).
+			Find(&events).Error; err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		ids := make([]uint, len(events))
+		for i, event := range events {
+			ids[i] = event.ID
+		}
+		return tx.Model(&OutboxEvent{}).Where("id IN ?", ids).Update("next_attempt_at", now.Add(outboxLease)).Error
+	})
+	return events, err
+}
+
+// Deliver one claimed event and record how it went. Events with no handler
+// and ones out of attempts are given up on.
+func deliverOutboxEvent(event OutboxEvent) error {
+	attempts := event.Attempts + 1
+	handler, ok := outboxHandlers[event.Topic]
+	deliveryErr := fmt.Errorf("no handler for topic %s", event.Topic)
+	if ok {
+		deliveryErr = handler(event)
+	}
+
+	updates := map[string]interface{}{"attempts": attempts}
+	switch {
+	case deliveryErr == nil:
+		updates["delivered_at"] = time.Now()
+		updates["last_error"] = ""
+	case !ok || attempts >= outboxMaxAttempts:
+		updates["failed_at"] = time.Now()
+		updates["last_error"] = deliveryErr.Error()
+		log.Printf("❌ Giving up on outbox event %d (%s) after %d attempts: %v", event.ID, event.Topic, attempts, deliveryErr)
+	default:
+		updates["next_attempt_at"] = time.Now().Add(outboxBackoff(attempts))
+		updates["last_error"] = deliveryErr.Error()
+		log.Printf("⏳ Outbox event %d (%s) failed on attempt %d: %v", event.ID, event.Topic, attempts, deliveryErr)
+	}
+	return db.Model(&OutboxEvent{}).Where("id = ?", event.ID).Updates(updates).Error
+}
+
+// Deliver a batch of due events, reporting how many were claimed
+func relayOutboxBatch() (int, error) {
+	events, err := claimOutboxEvents()
+	if err != nil {
+		return 0, err
+	}
+	for _, event := range events {
+		if err := deliverOutboxEvent(event); err != nil {
+			return len(events), err
+		}
+	}
+	return len(events), nil
+}
+
+// Relay outbox events for as long as the service runs
+func runOutboxRelay() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Drain the backlog before waiting for the next tick
+		for {
+			claimed, err := relayOutboxBatch()
+			if err != nil {
+				log.Println("❌ Outbox relay error:", err)
+				break
+			}
+			if claimed < outboxBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// Queue stock registration for products that have no inventory row and no
+// registration still in flight. Returns the IDs that were queued.
+func reconcileInventory() ([]uint, error) {
+	var missing []uint
+	// inventory-service shares the ecommerce database
+	err := db.Model(&Product{}).
+		Joins("LEFT JOIN inventories ON inventories.product_id = products.id").
+		Where("inventories.product_id IS NULL AND products.type = ?", productTypePhysical).
+		Where("NOT EXISTS (?)", db.Model(&OutboxEvent{}).
+			Select("1").
+			Where("topic = ? AND delivered_at IS NULL AND failed_at IS NULL", topicInventoryRegister).
+			Where("aggregate_id = products.id")).
+		Pluck("products.id", &missing).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, productID := range missing {
+		// A registration that was given up on still has the original
+		// quantity, so send that again. Without one the quantity is unknown;
+		// register the product with no stock so it can be adjusted from the
+		// dashboard.
+		var failed []OutboxEvent
+		if err := db.Where("topic = ? AND aggregate_id = ? AND failed_at IS NOT NULL", topicInventoryRegister, productID).
+			Order("id DESC").
+			Limit(1).
+			Find(&failed).Error; err != nil {
+			return nil, err
+		}
+		var payload interface{} = stockRegistration{ProductID: productID}
+		if len(failed) > 0 {
+			payload = json.RawMessage(failed[0].Payload)
+		}
+		if err := enqueueOutbox(db, topicInventoryRegister, productID, payload); err != nil {
+			return nil, err
+		}
+		log.Printf("🔁 Reconciliation queued stock registration for Product ID %d", productID)
+	}
+	return missing, nil
+}
+
+// Run reconciliation periodically
+func runInventoryReconciliation() {
+	ticker := time.NewTicker(reconciliationInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := reconcileInventory(); err != nil {
+			log.Println("❌ Inventory reconciliation error:", err)
+		}
+	}
+}
+
+// Admin: trigger reconciliation immediately
+func reconcileInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	queued, err := reconcileInventory()
+	if err != nil {
+		log.Println("❌ Inventory reconciliation error:", err)
+		http.Error(w, "Error reconciling inventory", http.StatusInternalServerError)
+		return
+	}
+	if queued == nil {
+		queued = []uint{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"queued": queued})
+}
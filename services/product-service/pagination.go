@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+	maxPageNumber    = 10000 // keeps the offset well within an int
+)
+
+// Sort orders accepted by ?sort= on product listings
+var productSorts = map[string]string{
+	"":           "products.id",
+	"price_asc":  "products.price ASC, products.id",
+	"price_desc": "products.price DESC, products.id",
+	"name":       "products.name ASC, products.id",
+	"newest":     "products.created_at DESC NULLS LAST, products.id DESC",
+}
+
+type pageRequest struct {
+	Number int
+	Limit  int
+}
+
+func (p pageRequest) scope(tx *gorm.DB) *gorm.DB {
+	return tx.Offset((p.Number - 1) * p.Limit).Limit(p.Limit)
+}
+
+// Parse ?page= (1-based) and ?limit=
+func parsePage(query url.Values) (pageRequest, error) {
+	page := pageRequest{Number: 1, Limit: defaultPageLimit}
+
+	if raw := query.Get("page"); raw != "" {
+		number, err := strconv.Atoi(raw)
+		if err != nil || number < 1 || number > maxPageNumber {
+			return page, fmt.Errorf("invalid page (1-%d)", maxPageNumber)
+		}
+		page.Number = number
+	}
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return page, fmt.Errorf("invalid limit (1-%d)", maxPageLimit)
+		}
+		page.Limit = limit
+	}
+	return page, nil
+}
+
+// Set X-Total-Count and an RFC 8288 Link header for neighbouring pages
+func setPaginationHeaders(w http.ResponseWriter, r *http.Request, page pageRequest, total int64) {
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+
+	link := func(number int, rel string) string {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(number))
+		query.Set("limit", strconv.Itoa(page.Limit))
+		return fmt.Sprintf("<%s?%s>; rel=%q", r.URL.Path, query.Encode(), rel)
+	}
+
+	var links []string
+	if page.Number > 1 {
+		links = append(links, link(page.Number-1, "prev"))
+	}
+	if int64(page.Number*page.Limit) < total {
+		links = append(links, link(page.Number+1, "next"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// Write v as JSON with a content-hash ETag, answering 304 when the client
+// already holds the same representation.
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(v); err != nil {
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(body.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body.Bytes())
+}
+
+// Weak comparison as required for If-None-Match (RFC 9110 13.1.2)
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
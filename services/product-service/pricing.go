@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Where an effective price came from
+const (
+	priceSourceBase      = "base"
+	priceSourcePriceList = "price_list"
+	priceSourceSale      = "sale"
+)
+
+// SalePrice discounts a product between StartsAt and EndsAt (open-ended if nil)
+type SalePrice struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	ProductID uint       `gorm:"index" json:"product_id"`
+	Price     float64    `json:"price"`
+	StartsAt  time.Time  `gorm:"index" json:"starts_at"`
+	EndsAt    *time.Time `gorm:"index" json:"ends_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// PriceList holds prices for one customer group, e.g. "wholesale"
+type PriceList struct {
+	ID            uint            `gorm:"primaryKey" json:"id"`
+	Name          string          `json:"name"`
+	CustomerGroup string          `gorm:"uniqueIndex" json:"customer_group"`
+	Items         []PriceListItem `gorm:"foreignKey:PriceListID" json:"items,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+type PriceListItem struct {
+	PriceListID uint    `gorm:"primaryKey" json:"price_list_id"`
+	ProductID   uint    `gorm:"primaryKey" json:"product_id"`
+	Price       float64 `json:"price"`
+}
+
+// PriceHistory records every change to a product's base price
+type PriceHistory struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ProductID uint      `gorm:"index" json:"product_id"`
+	OldPrice  float64   `json:"old_price"`
+	NewPrice  float64   `json:"new_price"`
+	Reason    string    `json:"reason"`
+	ChangedAt time.Time `gorm:"autoCreateTime" json:"changed_at"`
+}
+
+func (PriceHistory) TableName() string {
+	return "price_history"
+}
+
+// The price a customer pays at a given moment, in the base currency unless
+// converted
+type priceQuote struct {
+	BasePrice      float64    `json:"base_price"`
+	EffectivePrice float64    `json:"effective_price"`
+	PriceSource    string     `json:"price_source"`
+	SaleEndsAt     *time.Time `json:"sale_ends_at,omitempty"`
+}
+
+func recordPriceChange(tx *gorm.DB, productID uint, oldPrice, newPrice float64, reason string) error {
+	if oldPrice == newPrice {
+		return nil
+	}
+	return tx.Create(&PriceHistory{ProductID: productID, OldPrice: oldPrice, NewPrice: newPrice, Reason: reason}).Error
+}
+
+// Customer group to price for: the one in the caller's token, or the one
+// named by another service pricing an order on a customer's behalf. It is
+// never taken from the query string, which anyone can set.
+func customerGroup(r *http.Request) string {
+	if isInternal(r) {
+		return r.Header.Get(customerGroupHeader)
+	}
+	if claims := tokenClaims(r); claims != nil {
+		return claims.CustomerGroup
+	}
+	return ""
+}
+
+// Work out what product costs for customerGroup at time at. A group price
+// list replaces the base price; an active sale applies when it is lower.
+func effectivePrice(product Product, customerGroup string, at time.Time) (priceQuote, error) {
+	quote := priceQuote{BasePrice: product.Price, EffectivePrice: product.Price, PriceSource: priceSourceBase}
+
+	if customerGroup != "" {
+		var item PriceListItem
+		err := db.Joins("JOIN price_lists ON price_lists.id = price_list_items.price_list_id").
+			Where("price_lists.customer_group = ? AND price_list_items.product_id = ?", customerGroup, product.ID).
+			Take(&item).Error
+		if err == nil {
+			quote.EffectivePrice = item.Price
+			quote.PriceSource = priceSourcePriceList
+		} else if err != gorm.ErrRecordNotFound {
+			return quote, err
+		}
+	}
+
+	var sale SalePrice
+	err := db.Where("product_id = ? AND starts_at <= ? AND (ends_at IS NULL OR ends_at > ?)", product.ID, at, at).
+		Order("price").
+		Take(&sale).Error
+	if err == nil && sale.Price < quote.EffectivePrice {
+		quote.EffectivePrice = sale.Price
+		quote.PriceSource = priceSourceSale
+		quote.SaleEndsAt = sale.EndsAt
+	} else if err != nil && err != gorm.ErrRecordNotFound {
+		return quote, err
+	}
+	return quote, nil
+}
+
+// Change a product's base price, keeping the history
+func updatePrice(w http.ResponseWriter, r *http.Request) {
+	product, ok := findProduct(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Price  float64 `json:"price"`
+		Reason string  `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Price < 0 {
+		http.Error(w, "Invalid price data", http.StatusBadRequest)
+		return
+	}
+	if request.Reason == "" {
+		request.Reason = "manual"
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Lock the row so concurrent changes are recorded in order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&product, product.ID).Error; err != nil {
+			return err
+		}
+		if err := recordPriceChange(tx, product.ID, product.Price, request.Price, request.Reason); err != nil {
+			return err
+		}
+		if err := tx.Model(&product).Update("price", request.Price).Error; err != nil {
+			return err
+		}
+		return enqueueCatalogEvent(tx, eventProductUpdated, product.ID, "price")
+	})
+	if err != nil {
+		log.Println("❌ Error updating price:", err)
+		http.Error(w, "Error updating price", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("💲 Price of Product ID %d set to %.2f (%s)", product.ID, request.Price, request.Reason)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
+
+// List base price changes, newest first
+func getPriceHistory(w http.ResponseWriter, r *http.Request) {
+	product, ok := findProduct(w, r)
+	if !ok {
+		return
+	}
+
+	history := []PriceHistory{}
+	if err := db.Where("product_id = ?", product.ID).Order("changed_at DESC, id DESC").Find(&history).Error; err != nil {
+		log.Println("❌ Error loading price history:", err)
+		http.Error(w, "Error loading price history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// Schedule a sale price
+func createSale(w http.ResponseWriter, r *http.Request) {
+	product, ok := findProduct(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Price    float64    `json:"price"`
+		StartsAt *time.Time `json:"starts_at"`
+		EndsAt   *time.Time `json:"ends_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Price < 0 {
+		http.Error(w, "Invalid sale data", http.StatusBadRequest)
+		return
+	}
+
+	sale := SalePrice{ProductID: product.ID, Price: request.Price, StartsAt: time.Now(), EndsAt: request.EndsAt}
+	if request.StartsAt != nil {
+		sale.StartsAt = *request.StartsAt
+	}
+	if sale.EndsAt != nil && !sale.EndsAt.After(sale.StartsAt) {
+		http.Error(w, "ends_at must be after starts_at", http.StatusBadRequest)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&sale).Error; err != nil {
+			return err
+		}
+		return enqueueCatalogEvent(tx, eventProductUpdated, product.ID, "sale")
+	})
+	if err != nil {
+		log.Println("❌ Error creating sale:", err)
+		http.Error(w, "Error creating sale", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🏷️ Sale %d scheduled for Product ID %d at %.2f", sale.ID, product.ID, sale.Price)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sale)
+}
+
+// List current and scheduled sales; ?all=true includes past ones
+func listSales(w http.ResponseWriter, r *http.Request) {
+	product, ok := findProduct(w, r)
+	if !ok {
+		return
+	}
+
+	query := db.Where("product_id = ?", product.ID)
+	if r.URL.Query().Get("all") != "true" {
+		query = query.Where("ends_at IS NULL OR ends_at > ?", time.Now())
+	}
+
+	sales := []SalePrice{}
+	if err := query.Order("starts_at").Find(&sales).Error; err != nil {
+		log.Println("❌ Error listing sales:", err)
+		http.Error(w, "Error listing sales", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sales)
+}
+
+func deleteSale(w http.ResponseWriter, r *http.Request) {
+	var sale SalePrice
+	if err := db.First(&sale, "id = ? AND product_id = ?", chi.URLParam(r, "saleID"), chi.URLParam(r, "id")).Error; err != nil {
+		http.Error(w, "Sale not found", http.StatusNotFound)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&sale).Error; err != nil {
+			return err
+		}
+		return enqueueCatalogEvent(tx, eventProductUpdated, sale.ProductID, "sale")
+	})
+	if err != nil {
+		log.Println("❌ Error deleting sale:", err)
+		http.Error(w, "Error deleting sale", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func createPriceList(w http.ResponseWriter, r *http.Request) {
+	var priceList PriceList
+	if err := json.NewDecoder(r.Body).Decode(&priceList); err != nil || priceList.CustomerGroup == "" {
+		http.Error(w, "Invalid price list data", http.StatusBadRequest)
+		return
+	}
+	priceList.ID = 0
+	priceList.Items = nil
+	if priceList.Name == "" {
+		priceList.Name = priceList.CustomerGroup
+	}
+
+	var existing PriceList
+	if err := db.First(&existing, "customer_group = ?", priceList.CustomerGroup).Error; err == nil {
+		http.Error(w, "A price list already exists for this customer group", http.StatusConflict)
+		return
+	}
+
+	if err := db.Create(&priceList).Error; err != nil {
+		log.Println("❌ Error creating price list:", err)
+		http.Error(w, "Error creating price list", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(priceList)
+}
+
+func listPriceLists(w http.ResponseWriter, r *http.Request) {
+	priceLists := []PriceList{}
+	if err := db.Preload("Items").Order("id").Find(&priceLists).Error; err != nil {
+		log.Println("❌ Error listing price lists:", err)
+		http.Error(w, "Error listing price lists", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(priceLists)
+}
+
+// Set prices on a price list; a null price removes the product from it
+func setPriceListItems(w http.ResponseWriter, r *http.Request) {
+	var priceList PriceList
+	if err := db.First(&priceList, chi.URLParam(r, "id")).Error; err != nil {
+		http.Error(w, "Price list not found", http.StatusNotFound)
+		return
+	}
+
+	var request struct {
+		Items []struct {
+			ProductID uint     `json:"product_id"`
+			Price     *float64 `json:"price"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+
+	for _, item := range request.Items {
+		if item.Price == nil {
+			continue
+		}
+		if *item.Price < 0 {
+			http.Error(w, fmt.Sprintf("Price for product %d must not be negative", item.ProductID), http.StatusBadRequest)
+			return
+		}
+		var product Product
+		if err := db.Select("id").First(&product, item.ProductID).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Product %d not found", item.ProductID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, item := range request.Items {
+			if item.Price == nil {
+				if err := tx.Delete(&PriceListItem{}, "price_list_id = ? AND product_id = ?", priceList.ID, item.ProductID).Error; err != nil {
+					return err
+				}
+			} else if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&PriceListItem{
+				PriceListID: priceList.ID,
+				ProductID:   item.ProductID,
+				Price:       *item.Price,
+			}).Error; err != nil {
+				return err
+			}
+			if err := enqueueCatalogEvent(tx, eventProductUpdated, item.ProductID, "price_list"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("❌ Error updating price list:", err)
+		http.Error(w, "Error updating price list", http.StatusInternalServerError)
+		return
+	}
+
+	db.Preload("Items").First(&priceList, priceList.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(priceList)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Base URL of Review Service
+const reviewServiceURL = "http://review-service:8085"
+
+// Ratings are decoration, so don't let a slow Review Service hold up reads
+var reviewClient = &http.Client{Timeout: 2 * time.Second}
+
+// Aggregated approved-review rating, as returned by Review Service
+type ratingSummary struct {
+	Average float64 `json:"average"`
+	Count   int64   `json:"count"`
+}
+
+// Fetch rating summaries for the products in one request
+func fetchRatings(productIDs []uint) (map[uint]ratingSummary, error) {
+	ids := make([]string, len(productIDs))
+	for i, id := range productIDs {
+		ids[i] = strconv.FormatUint(uint64(id), 10)
+	}
+
+	resp, err := reviewClient.Get(reviewServiceURL + "/reviews/summary?" + url.Values{"product_ids": {strings.Join(ids, ",")}}.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("review service returned %d", resp.StatusCode)
+	}
+
+	var summaries []struct {
+		ProductID uint `json:"product_id"`
+		ratingSummary
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&summaries); err != nil {
+		return nil, err
+	}
+
+	ratings := make(map[uint]ratingSummary, len(summaries))
+	for _, summary := range summaries {
+		ratings[summary.ProductID] = summary.ratingSummary
+	}
+	return ratings, nil
+}
+
+// Attach ratings to products. If Review Service is unavailable the products
+// are returned without them rather than failing the read.
+func attachRatings(products []*Product) {
+	if len(products) == 0 {
+		return
+	}
+	ids := make([]uint, len(products))
+	for i, product := range products {
+		ids[i] = product.ID
+	}
+
+	ratings, err := fetchRatings(ids)
+	if err != nil {
+		log.Println("⚠️ Could not load ratings from Review Service:", err)
+		return
+	}
+	for _, product := range products {
+		if rating, ok := ratings[product.ID]; ok {
+			product.Rating = &rating
+		}
+	}
+}
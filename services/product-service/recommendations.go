@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of recommendation
+const (
+	recommendationBoughtTogether = "bought_together"
+	recommendationSameCategory   = "same_category"
+)
+
+const maxRecommendations = 10
+
+// How often the batch job recomputes the table (RECOMMENDATIONS_INTERVAL,
+// read in main)
+var recommendationsInterval time.Duration
+
+// ProductRecommendation is one precomputed entry; Rank 1 is shown first
+type ProductRecommendation struct {
+	ProductID     uint      `gorm:"primaryKey" json:"product_id"`
+	RecommendedID uint      `gorm:"primaryKey" json:"recommended_id"`
+	Kind          string    `json:"kind"`
+	Score         float64   `json:"score"`
+	Rank          int       `gorm:"index" json:"rank"`
+	ComputedAt    time.Time `json:"computed_at"`
+}
+
+type recommendation struct {
+	Product Product `json:"product"`
+	Kind    string  `json:"kind"`
+	Score   float64 `json:"score"`
+}
+
+// Recompute every product's recommendations: products most often ordered
+// together first, topped up with popular products from the same category.
+func computeRecommendations() (int, error) {
+	started := time.Now()
+
+	// order-service shares the ecommerce database; cancelled orders say
+	// nothing about what goes together
+	var pairs []ProductRecommendation
+	err := db.Raw(`
+		SELECT product_id, recommended_id, score FROM (
+			SELECT a.product_id, b.product_id AS recommended_id,
+			       COUNT(DISTINCT a.order_id) AS score,
+			       ROW_NUMBER() OVER (
+			           PARTITION BY a.product_id
+			           ORDER BY COUNT(DISTINCT a.order_id) DESC, b.product_id
+			       ) AS rank
+			FROM order_items a
+			JOIN order_items b ON b.order_id = a.order_id AND b.product_id <> a.product_id
+			JOIN orders ON orders.id = a.order_id AND orders.status <> 'CANCELLED'
+			JOIN products ON products.id = b.product_id
+			GROUP BY a.product_id, b.product_id
+		) ranked
+		WHERE rank <= ?`, maxRecommendations).Scan(&pairs).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var products []struct {
+		ID         uint
+		Category   string
+		Popularity int64
+	}
+	err = db.Raw(`
+		SELECT products.id, products.category,
+		       COALESCE(SUM(order_items.quantity) FILTER (WHERE orders.id IS NOT NULL), 0) AS popularity
+		FROM products
+		LEFT JOIN order_items ON order_items.product_id = products.id
+		LEFT JOIN orders ON orders.id = order_items.order_id AND orders.status <> 'CANCELLED'
+		GROUP BY products.id, products.category
+		ORDER BY popularity DESC, products.id`).Scan(&products).Error
+	if err != nil {
+		return 0, err
+	}
+
+	byProduct := map[uint][]ProductRecommendation{}
+	for _, pair := range pairs {
+		pair.Kind = recommendationBoughtTogether
+		byProduct[pair.ProductID] = append(byProduct[pair.ProductID], pair)
+	}
+
+	// Products per category, most popular first (the query's order)
+	byCategory := map[string][]uint{}
+	for _, product := range products {
+		if product.Category != "" {
+			byCategory[product.Category] = append(byCategory[product.Category], product.ID)
+		}
+	}
+
+	var rows []ProductRecommendation
+	for _, product := range products {
+		chosen := byProduct[product.ID]
+		sort.SliceStable(chosen, func(i, j int) bool { return chosen[i].Score > chosen[j].Score })
+
+		taken := map[uint]bool{product.ID: true}
+		for _, rec := range chosen {
+			taken[rec.RecommendedID] = true
+		}
+		for _, candidate := range byCategory[product.Category] {
+			if len(chosen) >= maxRecommendations {
+				break
+			}
+			if !taken[candidate] {
+				chosen = append(chosen, ProductRecommendation{ProductID: product.ID, RecommendedID: candidate, Kind: recommendationSameCategory})
+				taken[candidate] = true
+			}
+		}
+
+		for i := range chosen {
+			chosen[i].Rank = i + 1
+			chosen[i].ComputedAt = started
+		}
+		rows = append(rows, chosen...)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&ProductRecommendation{}).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(rows, 1000).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("✨ Computed %d recommendations for %d products in %s", len(rows), len(products), time.Since(started).Round(time.Millisecond))
+	return len(rows), nil
+}
+
+// Recompute recommendations at startup and then periodically
+func runRecommendationJob() {
+	for {
+		if _, err := computeRecommendations(); err != nil {
+			log.Println("❌ Error computing recommendations:", err)
+		}
+		time.Sleep(recommendationsInterval)
+	}
+}
+
+// Admin: recompute recommendations now
+func refreshRecommendations(w http.ResponseWriter, r *http.Request) {
+	count, err := computeRecommendations()
+	if err != nil {
+		log.Println("❌ Error computing recommendations:", err)
+		http.Error(w, "Error computing recommendations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"recommendations": count})
+}
+
+// Recommendations for a product, served from the precomputed table
+func getRecommendations(w http.ResponseWriter, r *http.Request) {
+	product, ok := findProduct(w, r)
+	if !ok {
+		return
+	}
+
+	limit := maxRecommendations
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxRecommendations {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	currency, err := requestedCurrency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var precomputed []ProductRecommendation
+	if err := db.Where("product_id = ?", product.ID).Order("rank").Limit(limit).Find(&precomputed).Error; err != nil {
+		log.Println("❌ Error loading recommendations:", err)
+		http.Error(w, "Error loading recommendations", http.StatusInternalServerError)
+		return
+	}
+
+	// Products created since the last run have no rows yet
+	if len(precomputed) == 0 && product.Category != "" {
+		var ids []uint
+		db.Model(&Product{}).
+			Where("category = ? AND id <> ?", product.Category, product.ID).
+			Order("created_at DESC NULLS LAST, id DESC").
+			Limit(limit).
+			Pluck("id", &ids)
+		for _, id := range ids {
+			precomputed = append(precomputed, ProductRecommendation{ProductID: product.ID, RecommendedID: id, Kind: recommendationSameCategory})
+		}
+	}
+
+	ids := make([]uint, len(precomputed))
+	for i, rec := range precomputed {
+		ids[i] = rec.RecommendedID
+	}
+	var found []Product
+	if len(ids) > 0 {
+		if err := db.Where("id IN ?", ids).Find(&found).Error; err != nil {
+			log.Println("❌ Error loading recommended products:", err)
+			http.Error(w, "Error loading recommendations", http.StatusInternalServerError)
+			return
+		}
+	}
+	byID := map[uint]Product{}
+	for _, p := range found {
+		byID[p.ID] = p
+	}
+
+	recommendations := []recommendation{}
+	for _, rec := range precomputed {
+		if p, ok := byID[rec.RecommendedID]; ok {
+			recommendations = append(recommendations, recommendation{Product: p, Kind: rec.Kind, Score: rec.Score})
+		}
+	}
+
+	localized := make([]*Product, len(recommendations))
+	for i := range recommendations {
+		localized[i] = &recommendations[i].Product
+	}
+	if err := localizeProducts(currency, localized); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recommendations)
+}
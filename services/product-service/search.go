@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"ecommerce/pkg/money"
+	"gorm.io/gorm"
+)
+
+// Full-text document for a product. Must match the expression index below
+// so PostgreSQL can use it.
+const searchDocument = "to_tsvector('simple', coalesce(products.name, '') || ' ' || coalesce(products.description, ''))"
+
+// Category as shown in facets; products without one are "uncategorized"
+const categoryExpression = "COALESCE(NULLIF(products.category, ''), 'uncategorized')"
+
+// Stock each product has at active locations, which is what inventory-service
+// reports as available. Quarantined lots are already out of location stock.
+const availableStockQuery = `SELECT location_stocks.product_id, SUM(location_stocks.quantity) AS quantity
+	FROM location_stocks
+	JOIN locations ON locations.id = location_stocks.location_id AND locations.active
+	GROUP BY location_stocks.product_id`
+
+// Whether a product can be bought now. Digital products have no inventory;
+// a bundle is in stock while every component has enough for one bundle.
+const inStockExpression = `(products.type = 'digital'
+	OR (products.type = 'bundle' AND NOT EXISTS (
+		SELECT 1 FROM bundle_components
+		LEFT JOIN (` + availableStockQuery + `) component_stock ON component_stock.product_id = bundle_components.component_id
+		WHERE bundle_components.bundle_id = products.id
+		AND COALESCE(component_stock.quantity, 0) < bundle_components.quantity))
+	OR COALESCE(available_stock.quantity, 0) > 0)`
+
+// Price bands used for the price facet, in the base currency and scaled by
+// the exchange rate for others. Max < 0 means "no upper bound".
+type priceBand struct {
+	Min float64
+	Max float64
+}
+
+var priceBands = []priceBand{
+	{Min: 0, Max: 25},
+	{Min: 25, Max: 50},
+	{Min: 50, Max: 100},
+	{Min: 100, Max: -1},
+}
+
+type searchResult struct {
+	Product
+	Rank float64 `json:"rank"`
+}
+
+type facetCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+type searchResponse struct {
+	Query   string                  `json:"query"`
+	Total   int64                   `json:"total"`
+	Page    int                     `json:"page"`
+	Limit   int                     `json:"limit"`
+	Results []searchResult          `json:"results"`
+	Facets  map[string][]facetCount `json:"facets"`
+}
+
+// Filters the storefront can narrow a search with. Prices are in the
+// currency being shown.
+type searchFilters struct {
+	Category     string
+	MinPrice     *float64
+	MaxPrice     *float64
+	Availability string // "in_stock" or "out_of_stock"
+	Pricing      searchPricing
+}
+
+// How list prices in the currency being shown are worked out in SQL, the way
+// currencyConverter does it: an explicit price in that currency if the
+// product has one, otherwise the base price converted and rounded. Without
+// an exchange rate only explicitly priced products have a price there.
+type searchPricing struct {
+	currency string // empty for the base currency
+	rate     float64
+}
+
+func newSearchPricing(currency string) (searchPricing, error) {
+	if currency == baseCurrency {
+		return searchPricing{}, nil
+	}
+	pricing := searchPricing{currency: currency}
+	var rate ExchangeRate
+	err := db.First(&rate, "currency = ?", currency).Error
+	switch {
+	case err == nil:
+		pricing.rate = rate.Rate
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return pricing, err
+	}
+	return pricing, nil
+}
+
+// Join the explicit prices the expression needs
+func (p searchPricing) scope(tx *gorm.DB) *gorm.DB {
+	if p.currency == "" {
+		return tx
+	}
+	return tx.Joins("LEFT JOIN product_currency_prices search_prices ON search_prices.product_id = products.id AND search_prices.currency = ?", p.currency)
+}
+
+// SQL for a product's list price
+func (p searchPricing) expression() string {
+	switch {
+	case p.currency == "":
+		return "products.price"
+	case p.rate == 0:
+		return "search_prices.price"
+	}
+	return fmt.Sprintf("COALESCE(search_prices.price, ROUND((products.price * %s)::numeric, %d)::float8)",
+		strconv.FormatFloat(p.rate, 'f', -1, 64), money.MinorUnits(p.currency))
+}
+
+// A base-currency amount in the currency being shown
+func (p searchPricing) convert(amount float64) float64 {
+	if p.currency == "" || p.rate == 0 {
+		return amount
+	}
+	return money.Round(amount*p.rate, p.currency)
+}
+
+// Create the extensions and indexes used by search
+func migrateSearchIndexes() {
+	statements := []string{
+		"CREATE EXTENSION IF NOT EXISTS pg_trgm",
+		"CREATE INDEX IF NOT EXISTS idx_products_search ON products USING GIN (" + searchDocument + ")",
+		"CREATE INDEX IF NOT EXISTS idx_products_name_trgm ON products USING GIN (name gin_trgm_ops)",
+	}
+	for _, stmt := range statements {
+		if err := db.Exec(stmt).Error; err != nil {
+			log.Fatal("❌ Failed to create search indexes:", err)
+		}
+	}
+}
+
+func parseSearchFilters(query url.Values) (searchFilters, error) {
+	filters := searchFilters{Category: query.Get("category")}
+
+	for name, target := range map[string]**float64{"min_price": &filters.MinPrice, "max_price": &filters.MaxPrice} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil || value < 0 {
+			return filters, fmt.Errorf("invalid %s", name)
+		}
+		*target = &value
+	}
+
+	switch availability := query.Get("availability"); availability {
+	case "", "in_stock", "out_of_stock":
+		filters.Availability = availability
+	default:
+		return filters, fmt.Errorf("invalid availability")
+	}
+
+	// in_stock=true is shorthand for availability=in_stock
+	if raw := query.Get("in_stock"); raw != "" {
+		inStock, err := strconv.ParseBool(raw)
+		if err != nil {
+			return filters, fmt.Errorf("invalid in_stock")
+		}
+		if inStock {
+			filters.Availability = "in_stock"
+		}
+	}
+	return filters, nil
+}
+
+// Join available stock. inventory-service shares the ecommerce database, so
+// availability comes straight from its tables.
+func inventoryScope(tx *gorm.DB) *gorm.DB {
+	return tx.Joins("LEFT JOIN (" + availableStockQuery + ") available_stock ON available_stock.product_id = products.id")
+}
+
+// Restrict products to those matching q, either through the full-text index
+// or through trigram similarity on the name so typos still find something.
+func matchScope(q string) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		tx = inventoryScope(tx)
+		if q == "" {
+			return tx
+		}
+		return tx.Where(
+			"("+searchDocument+" @@ websearch_to_tsquery('simple', ?) OR products.name % ? OR ? <% products.name)",
+			q, q, q,
+		)
+	}
+}
+
+// Apply the filters, skipping the one named by facet so a facet's counts
+// aren't narrowed by its own selection.
+func filterScope(filters searchFilters, facet string) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		tx = filters.Pricing.scope(tx)
+		if filters.Category != "" && facet != "category" {
+			tx = tx.Where(categoryExpression+" = ?", filters.Category)
+		}
+		if facet != "price" {
+			if filters.MinPrice != nil {
+				tx = tx.Where(filters.Pricing.expression()+" >= ?", *filters.MinPrice)
+			}
+			if filters.MaxPrice != nil {
+				tx = tx.Where(filters.Pricing.expression()+" <= ?", *filters.MaxPrice)
+			}
+		}
+		if facet != "availability" {
+			switch filters.Availability {
+			case "in_stock":
+				tx = tx.Where(inStockExpression)
+			case "out_of_stock":
+				tx = tx.Where("NOT " + inStockExpression)
+			}
+		}
+		return tx
+	}
+}
+
+// SQL CASE expression bucketing prices into priceBands, labelled in the
+// currency being shown
+func priceBandExpression(pricing searchPricing) string {
+	price := pricing.expression()
+	var b strings.Builder
+	b.WriteString("CASE")
+	for _, band := range priceBands {
+		low := strconv.FormatFloat(pricing.convert(band.Min), 'f', -1, 64)
+		if band.Max < 0 {
+			fmt.Fprintf(&b, " WHEN %s >= %s THEN '%s+'", price, low, low)
+		} else {
+			high := strconv.FormatFloat(pricing.convert(band.Max), 'f', -1, 64)
+			fmt.Fprintf(&b, " WHEN %s >= %s AND %s < %s THEN '%s-%s'", price, low, price, high, low, high)
+		}
+	}
+	b.WriteString(" END")
+	return b.String()
+}
+
+func facetCounts(q string, filters searchFilters, facet, expression string) ([]facetCount, error) {
+	counts := []facetCount{}
+	err := db.Model(&Product{}).
+		Scopes(matchScope(q), filterScope(filters, facet)).
+		Select(expression + " AS value, COUNT(*) AS count").
+		Group("value").
+		Order("count DESC, value").
+		Scan(&counts).Error
+	return counts, err
+}
+
+// Search products by text with ranking and facet counts
+func searchProducts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+
+	filters, err := parseSearchFilters(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := parsePage(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	currency, err := requestedCurrency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filters.Pricing, err = newSearchPricing(currency); err != nil {
+		log.Println("❌ Error loading exchange rate:", err)
+		http.Error(w, "Error searching products", http.StatusInternalServerError)
+		return
+	}
+
+	response := searchResponse{Query: q, Page: page.Number, Limit: page.Limit, Results: []searchResult{}, Facets: map[string][]facetCount{}}
+
+	rank := "0"
+	args := []interface{}{}
+	if q != "" {
+		rank = "ts_rank(" + searchDocument + ", websearch_to_tsquery('simple', ?)) + similarity(products.name, ?)"
+		args = append(args, q, q)
+	}
+
+	results := db.Model(&Product{}).Scopes(matchScope(q), filterScope(filters, ""))
+	if err := results.Session(&gorm.Session{}).Count(&response.Total).Error; err != nil {
+		log.Println("❌ Error counting search results:", err)
+		http.Error(w, "Error searching products", http.StatusInternalServerError)
+		return
+	}
+	if err := results.
+		Select("products.*, "+rank+" AS rank", args...).
+		Order("rank DESC, products.id").
+		Scopes(page.scope).
+		Scan(&response.Results).Error; err != nil {
+		log.Println("❌ Error searching products:", err)
+		http.Error(w, "Error searching products", http.StatusInternalServerError)
+		return
+	}
+
+	localized := make([]*Product, len(response.Results))
+	for i := range response.Results {
+		localized[i] = &response.Results[i].Product
+	}
+	if err := localizeProducts(currency, localized); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	attachRatings(localized)
+
+	facets := map[string]string{
+		"category":     categoryExpression,
+		"price":        priceBandExpression(filters.Pricing),
+		"availability": "CASE WHEN " + inStockExpression + " THEN 'in_stock' ELSE 'out_of_stock' END",
+	}
+	for name, expression := range facets {
+		counts, err := facetCounts(q, filters, name, expression)
+		if err != nil {
+			log.Printf("❌ Error computing %s facet: %v", name, err)
+			http.Error(w, "Error searching products", http.StatusInternalServerError)
+			return
+		}
+		response.Facets[name] = counts
+	}
+
+	log.Printf("🔎 Search %q returned %d of %d products", q, len(response.Results), response.Total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Storage keeps uploaded files under slash-separated keys
+type Storage interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Returned by Open when the key does not exist
+var errObjectNotFound = errors.New("object not found")
+
+// Pick the storage backend from STORAGE_DRIVER ("local" or "s3")
+func newStorage() (Storage, error) {
+	switch driver := getEnv("STORAGE_DRIVER", "local"); driver {
+	case "local":
+		return newLocalStorage(getEnv("STORAGE_LOCAL_DIR", "./uploads"))
+	case "s3":
+		return newS3Storage(
+			getEnv("S3_ENDPOINT", "minio:9000"),
+			os.Getenv("S3_ACCESS_KEY"),
+			os.Getenv("S3_SECRET_KEY"),
+			getEnv("S3_BUCKET", "product-images"),
+			getEnv("S3_USE_SSL", "false") == "true",
+		)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q", driver)
+	}
+}
+
+// LocalStorage keeps files in a directory on disk
+type LocalStorage struct {
+	root string
+}
+
+func newLocalStorage(root string) (*LocalStorage, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	log.Printf("✅ Storing uploads in %s", root)
+	return &LocalStorage{root: root}, nil
+}
+
+// Map a key to a path inside root, refusing keys that escape it
+func (s *LocalStorage) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial upload
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errObjectNotFound
+	}
+	return file, err
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// S3Storage keeps files in a bucket on any S3-compatible service
+// (AWS S3, MinIO, ...)
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3Storage(endpoint, accessKey, secretKey, bucket string, useSSL bool) (*S3Storage, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The service may start before the object store is up, so keep trying
+	// for a while before giving up
+	deadline := time.Now().Add(s3StartupTimeout)
+	for backoff := time.Second; ; backoff = min(backoff*2, 10*time.Second) {
+		err = ensureBucket(client, bucket)
+		if err == nil {
+			break
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("object store at %s unavailable: %w", endpoint, err)
+		}
+		log.Printf("⏳ Waiting for object store at %s: %v", endpoint, err)
+		time.Sleep(backoff)
+	}
+	log.Printf("✅ Storing uploads in s3://%s on %s", bucket, endpoint)
+	return &S3Storage{client: client, bucket: bucket}, nil
+}
+
+// How long to wait for the object store at startup
+var s3StartupTimeout = time.Minute
+
+func ensureBucket(client *minio.Client, bucket string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			return err
+		}
+		log.Printf("✅ Created bucket %s", bucket)
+	}
+	return nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, body, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *S3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	// GetObject is lazy; Stat surfaces a missing key before we start serving
+	if _, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{}); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, errObjectNotFound
+		}
+		return nil, err
+	}
+	return s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Put, read back, overwrite and delete through any Storage
+func testStorage(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	key := "products/1/test.txt"
+
+	if _, err := storage.Open(ctx, key); !errors.Is(err, errObjectNotFound) {
+		t.Fatalf("Open of a missing key: got %v, want errObjectNotFound", err)
+	}
+
+	for _, content := range []string{"first version", "second, longer version"} {
+		if err := storage.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		body, err := storage.Open(ctx, key)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		got, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %v", key, err)
+		}
+		if string(got) != content {
+			t.Fatalf("Open returned %q, want %q", got, content)
+		}
+	}
+
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := storage.Open(ctx, key); !errors.Is(err, errObjectNotFound) {
+		t.Fatalf("Open after Delete: got %v, want errObjectNotFound", err)
+	}
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete of a missing key: %v", err)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	storage, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, storage)
+}
+
+func TestLocalStorageRejectsEscapingKeys(t *testing.T) {
+	storage, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"../outside", "products/../../outside", ""} {
+		if err := storage.Put(context.Background(), key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+	}
+}
+
+// Runs against the MinIO from docker-compose when S3_TEST_ENDPOINT is set
+// (e.g. localhost:9000), otherwise against an in-process stand-in
+func TestS3Storage(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	accessKey, secretKey := getEnv("S3_TEST_ACCESS_KEY", "minioadmin"), getEnv("S3_TEST_SECRET_KEY", "minioadmin")
+	if endpoint == "" {
+		server := httptest.NewServer(newFakeS3())
+		defer server.Close()
+		endpoint = strings.TrimPrefix(server.URL, "http://")
+	}
+
+	bucket := fmt.Sprintf("storage-test-%d", time.Now().UnixNano())
+	storage, err := newS3Storage(endpoint, accessKey, secretKey, bucket, false)
+	if err != nil {
+		t.Fatalf("newS3Storage: %v", err)
+	}
+	testStorage(t, storage)
+}
+
+func TestS3StorageWaitsForObjectStore(t *testing.T) {
+	fake := newFakeS3()
+	fake.unavailable = 2 // the first requests fail as if the store was still starting
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	if _, err := newS3Storage(strings.TrimPrefix(server.URL, "http://"), "key", "secret", "images", false); err != nil {
+		t.Fatalf("newS3Storage gave up: %v", err)
+	}
+}
+
+// fakeS3 is just enough of the S3 API, path-style, for S3Storage
+type fakeS3 struct {
+	mu          sync.Mutex
+	buckets     map[string]map[string][]byte
+	unavailable int // requests left to answer with 503
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{buckets: map[string]map[string][]byte{}}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unavailable > 0 {
+		s.unavailable--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if _, ok := r.URL.Query()["location"]; ok {
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+		return
+	}
+	objects, exists := s.buckets[bucket]
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodHead:
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPut:
+			s.buckets[bucket] = map[string][]byte{}
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+		return
+	}
+	if !exists {
+		s3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := readS3Body(r)
+		if err != nil {
+			s3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		objects[key] = body
+		w.Header().Set("ETag", `"fake"`)
+	case http.MethodGet, http.MethodHead:
+		body, ok := objects[key]
+		if !ok {
+			s3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"fake"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+	}
+}
+
+// Uploads over plain HTTP come aws-chunked: "<hex size>;chunk-signature=...",
+// the data, and a zero-sized chunk at the end
+func readS3Body(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Decoded-Content-Length") == "" {
+		return io.ReadAll(r.Body)
+	}
+	var body bytes.Buffer
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return body.Bytes(), nil
+		}
+		if _, err := io.CopyN(&body, reader, size); err != nil {
+			return nil, err
+		}
+		if _, err := reader.Discard(2); err != nil { // CRLF after the data
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/cors"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// Database connection
+var db *gorm.DB
+
+// JWT Secret Key (shared with auth-service)
+var jwtSecret = []byte("your_secret_key")
+
+// Other services
+const (
+	productServiceURL = "http://product-service:8083"
+	orderServiceURL   = "http://order-service:8081"
+)
+
+// HTTP client for calls to other services
+var httpClient = &http.Client{Timeout: 5 * time.Second}
+
+// Moderation states
+const (
+	statusPending  = "pending"
+	statusApproved = "approved"
+	statusRejected = "rejected"
+)
+
+// Review model. Only approved reviews are public and counted in ratings.
+type Review struct {
+	ID               uint      `gorm:"primaryKey" json:"id"`
+	ProductID        uint      `gorm:"uniqueIndex:idx_reviews_product_email" json:"product_id"`
+	Email            string    `gorm:"uniqueIndex:idx_reviews_product_email" json:"-"`
+	Author           string    `json:"author"`
+	Rating           int       `json:"rating"`
+	Title            string    `json:"title"`
+	Body             string    `json:"body"`
+	Status           string    `gorm:"index" json:"status"`
+	VerifiedPurchase bool      `json:"verified_purchase"`
+	ModerationNote   string    `json:"moderation_note,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// Aggregated rating of a product's approved reviews
+type ratingSummary struct {
+	ProductID    uint          `json:"product_id"`
+	Average      float64       `json:"average"`
+	Count        int64         `json:"count"`
+	Distribution map[int]int64 `json:"distribution"`
+}
+
+// JWT Claims
+type Claims struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// Connect to PostgreSQL with retries
+func connectDB() {
+	dsn := "host=postgres user=postgres dbname=ecommerce password=password sslmode=disable"
+
+	var err error
+	for retries := 5; retries > 0; retries-- {
+		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		if err == nil {
+			break
+		}
+		log.Println("⏳ Waiting for database connection...")
+		time.Sleep(5 * time.Second)
+	}
+
+	if err != nil {
+		log.Fatal("❌ Failed to connect to database:", err)
+	}
+
+	if err := db.AutoMigrate(&Review{}); err != nil {
+		log.Fatal("❌ Failed to migrate Review table:", err)
+	}
+	log.Println("✅ Connected to PostgreSQL and Review table migrated")
+}
+
+// Middleware: Authenticate User
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenStr := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if tokenStr == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+			return jwtSecret, nil
+		})
+		if err != nil || !token.Valid {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		claims, _ := token.Claims.(*Claims)
+		r.Header.Set("User-Email", claims.Email)
+		r.Header.Set("User-Role", claims.Role)
+
+		next(w, r)
+	}
+}
+
+// Middleware: Admin Access Only
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Role") != "admin" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Check the product exists in Product Service
+func productExists(productID uint) (bool, error) {
+	resp, err := httpClient.Get(fmt.Sprintf("%s/products/%d", productServiceURL, productID))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("product service returned %d", resp.StatusCode)
+}
+
+// Ask Order Service whether the caller bought the product, passing their
+// token along so it answers for the same user
+func hasPurchased(authorization string, productID uint) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/orders/purchased/%d", orderServiceURL, productID), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("order service returned %d", resp.StatusCode)
+	}
+	var result struct {
+		Purchased bool `json:"purchased"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result.Purchased, err
+}
+
+// Submit a review; it stays pending until a moderator approves it
+func createReview(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ProductID uint   `json:"product_id"`
+		Rating    int    `json:"rating"`
+		Title     string `json:"title"`
+		Body      string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid review data", http.StatusBadRequest)
+		return
+	}
+	if request.Rating < 1 || request.Rating > 5 {
+		http.Error(w, "Rating must be between 1 and 5", http.StatusBadRequest)
+		return
+	}
+
+	exists, err := productExists(request.ProductID)
+	if err != nil {
+		log.Println("❌ Error contacting Product Service:", err)
+		http.Error(w, "Could not verify product", http.StatusBadGateway)
+		return
+	}
+	if !exists {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	email := r.Header.Get("User-Email")
+	var existing Review
+	if err := db.First(&existing, "product_id = ? AND email = ?", request.ProductID, email).Error; err == nil {
+		http.Error(w, "You already reviewed this product", http.StatusConflict)
+		return
+	}
+
+	// A failed lookup only costs the badge, not the review
+	verified, err := hasPurchased(r.Header.Get("Authorization"), request.ProductID)
+	if err != nil {
+		log.Printf("⚠️ Could not verify purchase of product %d by %s: %v", request.ProductID, email, err)
+	}
+
+	review := Review{
+		ProductID:        request.ProductID,
+		Email:            email,
+		Author:           strings.SplitN(email, "@", 2)[0],
+		Rating:           request.Rating,
+		Title:            strings.TrimSpace(request.Title),
+		Body:             strings.TrimSpace(request.Body),
+		Status:           statusPending,
+		VerifiedPurchase: verified,
+	}
+	if err := db.Create(&review).Error; err != nil {
+		log.Println("❌ Error saving review:", err)
+		http.Error(w, "Error saving review", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📝 Review %d submitted for product %d by %s", review.ID, review.ProductID, email)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(review)
+}
+
+// List approved reviews of a product, newest first
+func getReviews(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(r.URL.Query().Get("product_id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid product_id parameter", http.StatusBadRequest)
+		return
+	}
+
+	reviews := []Review{}
+	if err := db.Where("product_id = ? AND status = ?", productID, statusApproved).
+		Order("created_at DESC").
+		Find(&reviews).Error; err != nil {
+		log.Println("❌ Error listing reviews:", err)
+		http.Error(w, "Error listing reviews", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// Rating summaries for ?product_ids=1,2,3
+func getRatingSummaries(w http.ResponseWriter, r *http.Request) {
+	var productIDs []uint
+	for _, raw := range strings.Split(r.URL.Query().Get("product_ids"), ",") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid product_ids parameter", http.StatusBadRequest)
+			return
+		}
+		productIDs = append(productIDs, uint(id))
+	}
+	if len(productIDs) == 0 {
+		http.Error(w, "Missing product_ids parameter", http.StatusBadRequest)
+		return
+	}
+
+	var rows []struct {
+		ProductID uint
+		Rating    int
+		Count     int64
+	}
+	if err := db.Model(&Review{}).
+		Select("product_id, rating, COUNT(*) AS count").
+		Where("product_id IN ? AND status = ?", productIDs, statusApproved).
+		Group("product_id, rating").
+		Scan(&rows).Error; err != nil {
+		log.Println("❌ Error computing ratings:", err)
+		http.Error(w, "Error computing ratings", http.StatusInternalServerError)
+		return
+	}
+
+	summaries := map[uint]*ratingSummary{}
+	for _, id := range productIDs {
+		summaries[id] = &ratingSummary{ProductID: id, Distribution: map[int]int64{1: 0, 2: 0, 3: 0, 4: 0, 5: 0}}
+	}
+	for _, row := range rows {
+		summary := summaries[row.ProductID]
+		summary.Distribution[row.Rating] = row.Count
+		summary.Count += row.Count
+		summary.Average += float64(row.Rating * int(row.Count))
+	}
+
+	result := make([]ratingSummary, 0, len(productIDs))
+	for _, id := range productIDs {
+		summary := summaries[id]
+		if summary.Count > 0 {
+			// One decimal is what the storefront shows
+			summary.Average = math.Round(summary.Average/float64(summary.Count)*10) / 10
+		}
+		result = append(result, *summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Admin: reviews waiting for moderation, oldest first
+func getPendingReviews(w http.ResponseWriter, r *http.Request) {
+	reviews := []Review{}
+	if err := db.Where("status = ?", statusPending).Order("created_at").Find(&reviews).Error; err != nil {
+		log.Println("❌ Error listing pending reviews:", err)
+		http.Error(w, "Error listing reviews", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// Admin: approve or reject a review
+func moderateReview(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		return
+	}
+	if request.Status != statusApproved && request.Status != statusRejected {
+		http.Error(w, "Status must be approved or rejected", http.StatusBadRequest)
+		return
+	}
+
+	var review Review
+	if err := db.First(&review, chi.URLParam(r, "id")).Error; err != nil {
+		http.Error(w, "Review not found", http.StatusNotFound)
+		return
+	}
+
+	review.Status = request.Status
+	review.ModerationNote = request.Note
+	if err := db.Model(&review).Select("status", "moderation_note").Updates(&review).Error; err != nil {
+		log.Println("❌ Error moderating review:", err)
+		http.Error(w, "Error moderating review", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("✅ Review %d %s by %s", review.ID, request.Status, r.Header.Get("User-Email"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+func main() {
+	connectDB()
+
+	r := chi.NewRouter()
+
+	// ✅ Enable CORS for Next.js Frontend
+	r.Use(cors.Handler(cors.Options{
+		AllowedOrigins:   []string{"http://127.0.0.1:3000", "http://localhost:3000"},
+		AllowedMethods:   []string{"GET", "POST", "PATCH", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowCredentials: true,
+	}))
+
+	r.Get("/reviews", getReviews)
+	r.Get("/reviews/summary", getRatingSummaries)
+	r.Post("/reviews", authMiddleware(createReview))
+	r.Get("/reviews/pending", authMiddleware(adminMiddleware(getPendingReviews)))
+	r.Patch("/reviews/{id}/moderate", authMiddleware(adminMiddleware(moderateReview)))
+
+	log.Println("⭐ Review Service running on :8085")
+	http.ListenAndServe(":8085", r)
+}